@@ -2,41 +2,137 @@
 package main // import "github.com/jaeyeom/gofiletable/command"
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/jaeyeom/gofiletable/table"
 )
 
-// ls prints the list of keys of each path.
-func ls(tablePaths []string) {
+// openTable opens the table in option.BaseDirectory with the storage
+// mode recorded in its manifest. Tables without a manifest are
+// assumed to keep snapshots.
+func openTable(option table.TableOption) (*table.Table, error) {
+	option.KeepSnapshots, option.AdoptManifest = true, true
+	return table.Open(option)
+}
+
+// parseFlags parses args with flags. Unlike flags.Parse, flags may
+// follow positional arguments. It returns the positional arguments.
+func parseFlags(flags *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := flags.Parse(args); err != nil {
+			return nil, err
+		}
+		args = flags.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+// ls prints the list of keys of each path in order, encoded in the key
+// encoding of the table if --encoded is given. The key given by --after
+// is taken in the same form as the keys are printed.
+func ls(args []string) {
+	flags := flag.NewFlagSet("ls", flag.ContinueOnError)
+	encoded := flags.Bool("encoded", false, "print the keys in the key encoding of the table")
+	prefix := flags.String("prefix", "", "print only the keys starting with the prefix")
+	after := flags.String("after", "", "print the keys after the key, given as the keys are printed")
+	limit := flags.Int("limit", 0, "print at most N keys")
+	tablePaths, err := parseFlags(flags, args)
+	if err != nil || len(tablePaths) == 0 || *limit < 0 {
+		help("ls")
+		return
+	}
 	for _, tablePath := range tablePaths {
-		tbl, err := table.Create(table.TableOption{
+		tbl, err := openTable(table.TableOption{
 			BaseDirectory: tablePath,
-			KeepSnapshots: true,
+			ReadOnly:      true,
 		})
 		if err != nil {
 			log.Println("Error on path", tablePath, ":", err)
 			return
 		}
-		for key := range tbl.Keys() {
-			fmt.Println(string(key))
+		start := []byte(*prefix)
+		if *after != "" {
+			key := []byte(*after)
+			if *encoded {
+				if key, err = tbl.KeyEncoding().DecodeKey(*after); err != nil {
+					log.Println(err)
+					tbl.Close()
+					return
+				}
+			}
+			if next := append(key, 0); bytes.Compare(next, start) > 0 {
+				start = next
+			}
+		}
+		items, err := tbl.Scan(start, table.PrefixEnd([]byte(*prefix)), table.ScanOption{Limit: *limit})
+		tbl.Close()
+		if err != nil {
+			log.Println("Error on path", tablePath, ":", err)
+			return
+		}
+		for _, item := range items {
+			if *encoded {
+				fmt.Println(tbl.KeyEncoding().EncodeKey(item.Key))
+			} else {
+				fmt.Println(string(item.Key))
+			}
 		}
 	}
 }
 
 // cat prints the value of the key.
-func cat(tablePath string, key string) {
-	tbl, err := table.Create(table.TableOption{
+func cat(args []string) {
+	flags := flag.NewFlagSet("cat", flag.ContinueOnError)
+	at := flags.String("at", "", "print the value as of the time in RFC 3339 format")
+	raw := flags.Bool("raw", false, "print the value as it is stored, without decoding it")
+	encoded := flags.Bool("encoded", false, "take the key in the key encoding of the table")
+	positional, err := parseFlags(flags, args)
+	if err != nil || len(positional) != 2 || (*raw && *at != "") {
+		help("cat")
+		return
+	}
+	tablePath, key := positional[0], positional[1]
+	tbl, err := openTable(table.TableOption{
 		BaseDirectory: tablePath,
-		KeepSnapshots: true,
+		ReadOnly:      true,
 	})
 	if err != nil {
 		log.Println(err)
 		return
 	}
-	value, err := tbl.Get([]byte(key))
+	defer tbl.Close()
+	keyBytes := []byte(key)
+	if *encoded {
+		if keyBytes, err = tbl.KeyEncoding().DecodeKey(key); err != nil {
+			log.Println(err)
+			return
+		}
+	}
+	var value []byte
+	if *raw {
+		value, err = tbl.GetRaw(keyBytes)
+	} else if *at == "" {
+		value, err = tbl.Get(keyBytes)
+	} else {
+		var t time.Time
+		t, err = time.Parse(time.RFC3339Nano, *at)
+		if err == nil {
+			value, err = tbl.GetAt(keyBytes, t)
+		}
+	}
 	if err != nil {
 		log.Println(err)
 		return
@@ -44,11 +140,184 @@ func cat(tablePath string, key string) {
 	fmt.Println(string(value))
 }
 
+// migrate converts the table at tablePath to the given layout, which
+// is either "snapshots" or "plain".
+func migrate(tablePath string, layout string) {
+	if layout != "snapshots" && layout != "plain" {
+		help("migrate")
+		return
+	}
+	keepSnapshots := layout == "snapshots"
+	// The current layout is recorded in the manifest, or detected
+	// from the key files of tables without one.
+	err := table.Migrate(table.TableOption{
+		BaseDirectory: tablePath,
+		KeepSnapshots: keepSnapshots,
+	}, keepSnapshots)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// parseTiers parses tiers of the form "interval:period" separated by
+// commas, such as "1h:24h,24h:720h".
+func parseTiers(s string) ([]table.Tier, error) {
+	var tiers []table.Tier
+	for _, field := range strings.Split(s, ",") {
+		parts := strings.Split(field, ":")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid tier %q", field)
+		}
+		interval, err := time.ParseDuration(parts[0])
+		if err != nil {
+			return nil, err
+		}
+		period, err := time.ParseDuration(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		tiers = append(tiers, table.Tier{Interval: interval, Period: period})
+	}
+	return tiers, nil
+}
+
+// compact applies a retention policy to all keys of a table.
+func compact(args []string) {
+	flags := flag.NewFlagSet("compact", flag.ContinueOnError)
+	keepLast := flags.Int("keep-last", 0, "keep the last N snapshots")
+	keepFor := flags.Duration("keep-for", 0, "keep the snapshots written within the duration")
+	tiered := flags.String("tiered", "", "keep one snapshot per interval for each period, e.g. 1h:24h,24h:720h")
+	dryRun := flags.Bool("dry-run", false, "report what would be removed without removing")
+	positional, err := parseFlags(flags, args)
+	if err != nil || len(positional) != 1 {
+		help("compact")
+		return
+	}
+	var policies []table.RetentionPolicy
+	if *keepLast > 0 {
+		policies = append(policies, table.KeepLast(*keepLast))
+	}
+	if *keepFor > 0 {
+		policies = append(policies, table.KeepFor(*keepFor))
+	}
+	if *tiered != "" {
+		tiers, err := parseTiers(*tiered)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		policies = append(policies, table.KeepTiered(tiers...))
+	}
+	if len(policies) != 1 {
+		log.Println(errors.New("exactly one of --keep-last, --keep-for and --tiered is required"))
+		return
+	}
+	tbl, err := openTable(table.TableOption{
+		BaseDirectory: positional[0],
+		ReadOnly:      *dryRun,
+		Retention:     policies[0],
+	})
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer tbl.Close()
+	report, err := tbl.Compact(*dryRun)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	verb := "removed"
+	if *dryRun {
+		verb = "would remove"
+	}
+	fmt.Printf("%d keys examined, %s %d snapshots from %d keys (%d bytes) and %d removal markers\n",
+		report.Keys, verb, report.RemovedSnapshots, report.CompactedKeys, report.ReclaimedBytes, report.PrunedMarkers)
+}
+
+// fsck verifies the table and repairs it if --repair is given.
+func fsck(args []string) {
+	flags := flag.NewFlagSet("fsck", flag.ContinueOnError)
+	repair := flags.Bool("repair", false, "truncate corrupt keys to the last good snapshot and move unreadable files aside")
+	positional, err := parseFlags(flags, args)
+	if err != nil || len(positional) != 1 {
+		help("fsck")
+		return
+	}
+	tablePath := positional[0]
+	// The table is verified read-only first, since opening it for
+	// writing already repairs files torn by a crash.
+	tbl, err := openTable(table.TableOption{
+		BaseDirectory: tablePath,
+		ReadOnly:      true,
+	})
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	report, err := tbl.Verify(context.Background())
+	tbl.Close()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	for _, problem := range report.Problems {
+		fmt.Println(problem.Path, ":", problem.Err)
+	}
+	fmt.Printf("%d keys and %d snapshots checked, %d problems found\n",
+		report.Keys, report.Snapshots, len(report.Problems))
+	if !*repair || len(report.Problems) == 0 {
+		return
+	}
+	tbl, err = openTable(table.TableOption{BaseDirectory: tablePath})
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer tbl.Close()
+	if report, err = tbl.Repair(context.Background()); err != nil {
+		log.Println(err)
+		return
+	}
+	for _, path := range report.Repaired {
+		fmt.Println(path, ": truncated to the last good snapshot")
+	}
+	for _, path := range report.Quarantined {
+		fmt.Println(path, ": moved to lost+found")
+	}
+	fmt.Printf("%d problems remain\n", len(report.Problems)-len(report.Repaired)-len(report.Quarantined))
+}
+
+// reshard moves the key files of the table at tablePath into the
+// layout with the given levels of subdirectories.
+func reshard(tablePath string, levels string) {
+	n, err := strconv.Atoi(levels)
+	if err != nil {
+		help("reshard")
+		return
+	}
+	// The table stays readable by other processes while the files
+	// are moved.
+	tbl, err := openTable(table.TableOption{BaseDirectory: tablePath, Shared: true})
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer tbl.Close()
+	if err := tbl.Reshard(context.Background(), n); err != nil {
+		log.Println(err)
+	}
+}
+
 // help prints help message. If cmd is empty, prints the list of commands.
 func help(cmd string) {
 	helpDetails := map[string]string{
-		"ls":  "ls path [path...] - prints list of keys from each path",
-		"cat": "cat path key - prints the value",
+		"ls":      "ls path [path...] [--prefix P] [--after K] [--limit N] [--encoded] - prints sorted keys from each path, a page at a time if given",
+		"cat":     "cat path key [--encoded] [--at time|--raw] - prints the value, as of the time or as stored if given",
+		"migrate": "migrate path snapshots|plain - converts the table to the layout",
+		"compact": "compact path --keep-last N|--keep-for D|--tiered I:P[,I:P...] [--dry-run] - removes old snapshots",
+		"fsck":    "fsck path [--repair] - verifies the table and repairs corrupt key files",
+		"reshard": "reshard path levels - moves the key files into levels of subdirectories, 0 to 3",
 	}
 	if cmd == "" {
 		fmt.Println("Available commands are:")
@@ -73,18 +342,34 @@ func main() {
 	}
 	cmd := args[0]
 	if cmd == "ls" {
-		if len(args) < 2 {
-			help("ls")
-			return
-		}
 		ls(args[1:])
 		return
 	}
 	if cmd == "cat" {
+		cat(args[1:])
+		return
+	}
+	if cmd == "migrate" {
+		if len(args) != 3 {
+			help("migrate")
+			return
+		}
+		migrate(args[1], args[2])
+		return
+	}
+	if cmd == "compact" {
+		compact(args[1:])
+		return
+	}
+	if cmd == "fsck" {
+		fsck(args[1:])
+		return
+	}
+	if cmd == "reshard" {
 		if len(args) != 3 {
-			help("cat")
+			help("reshard")
 			return
 		}
-		cat(args[1], args[2])
+		reshard(args[1], args[2])
 	}
 }
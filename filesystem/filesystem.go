@@ -2,11 +2,15 @@
 package filesystem
 
 import (
+	"errors"
 	"io"
 	"os"
 	"path/filepath"
 )
 
+// ErrLocked is returned by Lock when the lock is held by someone else.
+var ErrLocked = errors.New("filesystem: file is locked")
+
 // osFileSystem is a FileSystem implementation that just simply calls
 // functions in the go os package library.
 type osFileSystem struct{}
@@ -29,7 +33,8 @@ func (osFileSystem) RemoveAll(path string) error {
 }
 
 // Open opens the named file for reading. If successful, methods on
-// the returned file can be used for reading.
+// the returned file can be used for reading. The returned file is an
+// *os.File, which also implements io.Seeker and io.ReaderAt.
 func (osFileSystem) Open(name string) (io.ReadCloser, error) {
 	return os.Open(name)
 }
@@ -41,12 +46,46 @@ func (osFileSystem) Create(name string) (io.ReadWriteCloser, error) {
 	return os.Create(name)
 }
 
+// Append opens the named file for appending, creating it with mode
+// 0666 (before umask) if it doesn't exist. Every write goes to the
+// end of the file.
+func (osFileSystem) Append(name string) (io.WriteCloser, error) {
+	return os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+}
+
 // Remove removes the named file or directory. If there is an error,
 // it will be of type *PathError.
 func (osFileSystem) Remove(name string) error {
 	return os.Remove(name)
 }
 
+// Rename renames (moves) oldpath to newpath. If newpath already
+// exists and is not a directory, Rename replaces it atomically.
+func (osFileSystem) Rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+// Sync commits the current contents of the named file or directory
+// to stable storage. Syncing a directory makes the renames and
+// removals of its entries durable.
+func (osFileSystem) Sync(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Stat returns a FileInfo describing the named file. If there is an
+// error, it will be of type *PathError.
+func (osFileSystem) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
 // Walk calls the default Walk function.
 func (osFileSystem) Walk(root string, walkFn filepath.WalkFunc) error {
 	return filepath.Walk(root, walkFn)
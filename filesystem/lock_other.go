@@ -0,0 +1,20 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd || windows)
+
+package filesystem
+
+import "io"
+
+// noLock is the lock of a platform without file locks.
+type noLock struct{}
+
+func (noLock) Close() error {
+	return nil
+}
+
+// Lock creates nothing and always succeeds, since file locks are not
+// supported on this platform. Tables on such platforms are not
+// protected against being opened by several processes at once; the
+// caller must make sure that only one process writes to a table.
+func (osFileSystem) Lock(name string, exclusive bool) (io.Closer, error) {
+	return noLock{}, nil
+}
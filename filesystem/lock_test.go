@@ -0,0 +1,36 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd || windows
+
+package filesystem
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestOSFileSystemLock(t *testing.T) {
+	name := filepath.Join(t.TempDir(), ".lock")
+	shared, err := OSFileSystem.Lock(name, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := OSFileSystem.Lock(name, false)
+	if err != nil {
+		t.Fatalf("second shared Lock() error = %v", err)
+	}
+	if _, err := OSFileSystem.Lock(name, true); err != ErrLocked {
+		t.Errorf("exclusive Lock() while shared error = %v, want %v", err, ErrLocked)
+	}
+	shared.Close()
+	other.Close()
+
+	exclusive, err := OSFileSystem.Lock(name, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer exclusive.Close()
+	for _, ex := range []bool{false, true} {
+		if _, err := OSFileSystem.Lock(name, ex); err != ErrLocked {
+			t.Errorf("Lock(exclusive=%t) while exclusive error = %v, want %v", ex, err, ErrLocked)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package filesystem
+
+import (
+	"io"
+	"os"
+	"syscall"
+)
+
+// Lock acquires an advisory lock on the named file with flock(2),
+// creating the file if necessary. If exclusive is false, a shared
+// lock is acquired, which can be held by many processes at once. It
+// doesn't wait for the lock; if another process holds a conflicting
+// lock, ErrLocked is returned. Closing the returned Closer releases
+// the lock.
+func (osFileSystem) Lock(name string, exclusive bool) (io.Closer, error) {
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0600)
+	if os.IsPermission(err) && !exclusive {
+		// A shared lock doesn't need write access, so read-only
+		// tables can be locked as long as the lock file exists.
+		f, err = os.Open(name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	for {
+		err = syscall.Flock(int(f.Fd()), how|syscall.LOCK_NB)
+		if err != syscall.EINTR {
+			break
+		}
+	}
+	if err == syscall.EWOULDBLOCK {
+		f.Close()
+		return nil, ErrLocked
+	}
+	if err != nil {
+		f.Close()
+		return nil, &os.PathError{Op: "flock", Path: name, Err: err}
+	}
+	return f, nil
+}
@@ -0,0 +1,51 @@
+//go:build windows
+
+package filesystem
+
+import (
+	"io"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+var procLockFileEx = syscall.NewLazyDLL("kernel32.dll").NewProc("LockFileEx")
+
+// Flags of LockFileEx and the error it returns for a held lock.
+const (
+	lockfileFailImmediately               = 0x1
+	lockfileExclusiveLock                 = 0x2
+	errorLockViolation      syscall.Errno = 33
+)
+
+// Lock acquires a lock on the named file with LockFileEx, creating the
+// file if necessary. If exclusive is false, a shared lock is acquired,
+// which can be held by many processes at once. It doesn't wait for the
+// lock; if another process holds a conflicting lock, ErrLocked is
+// returned. Closing the returned Closer releases the lock.
+func (osFileSystem) Lock(name string, exclusive bool) (io.Closer, error) {
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0600)
+	if os.IsPermission(err) && !exclusive {
+		// A shared lock doesn't need write access, so read-only
+		// tables can be locked as long as the lock file exists.
+		f, err = os.Open(name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	flags := uintptr(lockfileFailImmediately)
+	if exclusive {
+		flags |= lockfileExclusiveLock
+	}
+	// The first byte of the file is locked.
+	overlapped := new(syscall.Overlapped)
+	r, _, err := procLockFileEx.Call(f.Fd(), flags, 0, 1, 0, uintptr(unsafe.Pointer(overlapped)))
+	if r == 0 {
+		f.Close()
+		if err == errorLockViolation || err == syscall.ERROR_IO_PENDING {
+			return nil, ErrLocked
+		}
+		return nil, &os.PathError{Op: "LockFileEx", Path: name, Err: err}
+	}
+	return f, nil
+}
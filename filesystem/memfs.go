@@ -4,26 +4,100 @@ import (
 	"bytes"
 	"errors"
 	"io"
-	"io/ioutil"
 	"os"
 	"path/filepath"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 )
 
-// MemoryFileSystem is a fake file system.
+// MemoryFileSystem is a fake file system. It is safe for concurrent
+// use by multiple goroutines.
 type MemoryFileSystem struct {
-	files map[string][]byte
+	mu       *sync.RWMutex
+	files    map[string][]byte
+	modTimes map[string]time.Time
+	locks    map[string]int // -1 if locked exclusively, otherwise the number of shared locks
+
+	// names maps the paths in files to their base names as they
+	// were created, if the file system is case-insensitive.
+	// Otherwise it is nil.
+	names map[string]string
 }
 
 // NewMemoryFileSystem creates an in-memory file system.
 func NewMemoryFileSystem() *MemoryFileSystem {
 	return &MemoryFileSystem{
+		mu: &sync.RWMutex{},
 		files: map[string][]byte{
 			string(filepath.Separator): nil,
 		},
+		modTimes: map[string]time.Time{},
+		locks:    map[string]int{},
+	}
+}
+
+// NewCaseInsensitiveMemoryFileSystem creates an in-memory file system
+// that ignores the case of ASCII letters in paths like the default
+// file systems of macOS and Windows. The case of a name is preserved
+// as it was when the file or directory was created.
+func NewCaseInsensitiveMemoryFileSystem() *MemoryFileSystem {
+	mfs := NewMemoryFileSystem()
+	mfs.names = map[string]string{}
+	return mfs
+}
+
+// clean returns the cleaned path, which is folded to lower case if the
+// file system is case-insensitive.
+func (mfs MemoryFileSystem) clean(path string) string {
+	cleaned := filepath.Clean(path)
+	if mfs.names == nil {
+		return cleaned
+	}
+	return strings.Map(func(r rune) rune {
+		if 'A' <= r && r <= 'Z' {
+			return r + 'a' - 'A'
+		}
+		return r
+	}, cleaned)
+}
+
+// setName records the base name of name for the path in files, unless
+// it already has one and replace is false.
+func (mfs MemoryFileSystem) setName(path, name string, replace bool) {
+	if mfs.names == nil {
+		return
+	}
+	if _, ok := mfs.names[path]; ok && !replace {
+		return
 	}
+	mfs.names[path] = filepath.Base(name)
+}
+
+// nameOf returns the path in files with the names as they were
+// created.
+func (mfs MemoryFileSystem) nameOf(path string) string {
+	cleaned := filepath.Clean(path)
+	if mfs.names == nil || cleaned == string(filepath.Separator) || cleaned == "." {
+		return path
+	}
+	base, ok := mfs.names[path]
+	if !ok {
+		base = filepath.Base(cleaned)
+	}
+	name := filepath.Join(mfs.nameOf(parentDir(cleaned)), base)
+	if strings.HasSuffix(path, string(filepath.Separator)) {
+		name += string(filepath.Separator)
+	}
+	return name
+}
+
+// remove removes the path in files.
+func (mfs MemoryFileSystem) remove(path string) {
+	delete(mfs.files, path)
+	delete(mfs.modTimes, path)
+	delete(mfs.names, path)
 }
 
 type fileWriter interface {
@@ -96,7 +170,14 @@ func parentDir(path string) string {
 // Mkdir creates a new directory with the specified name and permission bits
 // (before umask). If there is an error, it will be of type *os.PathError.
 func (mfs MemoryFileSystem) Mkdir(name string, perm os.FileMode) error {
-	current := filepath.Clean(name)
+	mfs.mu.Lock()
+	defer mfs.mu.Unlock()
+	return mfs.mkdir(name, perm)
+}
+
+// mkdir implements Mkdir without locking.
+func (mfs MemoryFileSystem) mkdir(name string, perm os.FileMode) error {
+	current := mfs.clean(name)
 	if _, exists := mfs.files[parentDir(current)]; !exists {
 		return &os.PathError{
 			Op:   "mkdir",
@@ -105,6 +186,7 @@ func (mfs MemoryFileSystem) Mkdir(name string, perm os.FileMode) error {
 		}
 	}
 	mfs.files[ensureDirName(current)] = nil
+	mfs.setName(ensureDirName(current), ensureDirName(name), false)
 	return nil
 }
 
@@ -113,85 +195,348 @@ func (mfs MemoryFileSystem) Mkdir(name string, perm os.FileMode) error {
 // compatibility and does nothing. If path is already a directory,
 // MkdirAll does nothing and returns nil.
 func (mfs MemoryFileSystem) MkdirAll(path string, perm os.FileMode) error {
+	mfs.mu.Lock()
+	defer mfs.mu.Unlock()
+	return mfs.mkdirAll(path, perm)
+}
+
+// mkdirAll implements MkdirAll without locking.
+func (mfs MemoryFileSystem) mkdirAll(path string, perm os.FileMode) error {
 	current := filepath.Clean(path)
 	if current == "." || current == string(filepath.Separator) {
 		return nil
 	}
-	if _, exists := mfs.files[ensureDirName(current)]; exists {
+	if _, exists := mfs.files[ensureDirName(mfs.clean(current))]; exists {
 		return nil
 	}
-	mfs.MkdirAll(parentDir(current), perm)
-	return mfs.Mkdir(ensureDirName(current), perm)
+	mfs.mkdirAll(filepath.Dir(current), perm)
+	return mfs.mkdir(current, perm)
 }
 
 // RemoveAll removes path and any children it contains. It removes
 // everything it can but returns the first error it encounters. If the
 // path does not exist, RemoveAll returns nil (no error).
 func (mfs MemoryFileSystem) RemoveAll(path string) error {
-	cleaned := filepath.Clean(path) + string(filepath.Separator)
+	mfs.mu.Lock()
+	defer mfs.mu.Unlock()
+	cleaned := mfs.clean(path) + string(filepath.Separator)
 	for k, _ := range mfs.files {
 		if strings.HasPrefix(k, cleaned) {
-			delete(mfs.files, k)
+			mfs.remove(k)
 		}
 	}
 	return nil
 }
 
+// memoryReader is a file of MemoryFileSystem opened for reading.
+type memoryReader struct {
+	*bytes.Reader
+}
+
+// Close does nothing.
+func (memoryReader) Close() error {
+	return nil
+}
+
 // Open opens the named file for reading. If successful, methods on
-// the returned file can be used for reading.
+// the returned file can be used for reading. The returned file also
+// implements io.Seeker and io.ReaderAt.
 func (mfs MemoryFileSystem) Open(name string) (io.ReadCloser, error) {
-	cleaned := filepath.Clean(name)
+	mfs.mu.RLock()
+	defer mfs.mu.RUnlock()
+	cleaned := mfs.clean(name)
 	content, ok := mfs.files[cleaned]
 	if !ok {
 		return nil, os.ErrNotExist
 	}
-	return ioutil.NopCloser(bytes.NewReader(content)), nil
+	return memoryReader{bytes.NewReader(content)}, nil
 }
 
 // Create creates the named file, truncating it if it already
 // exists, and returns a writer to the file.
 func (mfs MemoryFileSystem) Create(name string) (io.ReadWriteCloser, error) {
-	cleaned := filepath.Clean(name)
+	mfs.mu.Lock()
+	defer mfs.mu.Unlock()
+	cleaned := mfs.clean(name)
 	mfs.files[cleaned] = nil
+	mfs.modTimes[cleaned] = time.Now()
+	mfs.setName(cleaned, filepath.Clean(name), false)
 	f := fileCloser{
-		Buffer: *bytes.NewBuffer(mfs.files[cleaned]),
-		fw:     mfs,
-		path:   name,
-		perm:   0666,
+		fw:   mfs,
+		path: name,
+		perm: 0666,
 	}
 	return &f, nil
 }
 
+// memoryAppender buffers the data appended to a file of
+// MemoryFileSystem until it is closed.
+type memoryAppender struct {
+	bytes.Buffer
+	mfs  MemoryFileSystem
+	path string
+}
+
+// Close appends the buffer to the file.
+func (a *memoryAppender) Close() error {
+	a.mfs.mu.Lock()
+	defer a.mfs.mu.Unlock()
+	content := a.mfs.files[a.path]
+	// Readers may still hold the old content, so it is never
+	// modified in place.
+	a.mfs.files[a.path] = append(content[:len(content):len(content)], a.Bytes()...)
+	a.mfs.modTimes[a.path] = time.Now()
+	return nil
+}
+
+// Append opens the named file for appending, creating it if it
+// doesn't exist. The appended data becomes visible when the returned
+// writer is closed.
+func (mfs MemoryFileSystem) Append(name string) (io.WriteCloser, error) {
+	mfs.mu.Lock()
+	defer mfs.mu.Unlock()
+	cleaned := mfs.clean(name)
+	if _, ok := mfs.files[cleaned]; !ok {
+		mfs.files[cleaned] = nil
+		mfs.modTimes[cleaned] = time.Now()
+		mfs.setName(cleaned, filepath.Clean(name), false)
+	}
+	return &memoryAppender{mfs: mfs, path: cleaned}, nil
+}
+
 // Remove removes the named file or directory. If there is an error,
 // it will be of type *PathError.
 func (mfs MemoryFileSystem) Remove(name string) error {
-	cleaned := filepath.Clean(name)
-	delete(mfs.files, cleaned)
+	mfs.mu.Lock()
+	defer mfs.mu.Unlock()
+	cleaned := mfs.clean(name)
+	if _, ok := mfs.files[cleaned]; ok {
+		mfs.remove(cleaned)
+		return nil
+	}
+	dir := ensureDirName(cleaned)
+	if _, ok := mfs.files[dir]; !ok {
+		return nil
+	}
+	for k := range mfs.files {
+		if k != dir && strings.HasPrefix(k, dir) {
+			return &os.PathError{
+				Op:   "remove",
+				Path: name,
+				Err:  errors.New("Directory not empty"),
+			}
+		}
+	}
+	mfs.remove(dir)
+	return nil
+}
+
+// Rename renames (moves) oldpath to newpath. If newpath already
+// exists and is not a directory, Rename replaces it. Directories are
+// moved along with everything they contain.
+func (mfs MemoryFileSystem) Rename(oldpath, newpath string) error {
+	mfs.mu.Lock()
+	defer mfs.mu.Unlock()
+	oldCleaned := mfs.clean(oldpath)
+	newCleaned := mfs.clean(newpath)
+	if _, exists := mfs.files[parentDir(newCleaned)]; !exists {
+		return &os.PathError{
+			Op:   "rename",
+			Path: newpath,
+			Err:  errors.New("No such file or directory"),
+		}
+	}
+	if content, ok := mfs.files[oldCleaned]; ok {
+		modTime := mfs.modTimes[oldCleaned]
+		mfs.remove(oldCleaned)
+		mfs.files[newCleaned] = content
+		mfs.modTimes[newCleaned] = modTime
+		mfs.setName(newCleaned, filepath.Clean(newpath), true)
+		return nil
+	}
+	oldDir := ensureDirName(oldCleaned)
+	if _, ok := mfs.files[oldDir]; !ok {
+		return &os.PathError{
+			Op:   "rename",
+			Path: oldpath,
+			Err:  os.ErrNotExist,
+		}
+	}
+	newDir := ensureDirName(newCleaned)
+	moved := map[string]string{}
+	for k := range mfs.files {
+		if strings.HasPrefix(k, oldDir) {
+			moved[k] = newDir + strings.TrimPrefix(k, oldDir)
+		}
+	}
+	files, modTimes, names := map[string][]byte{}, map[string]time.Time{}, map[string]string{}
+	for k := range moved {
+		files[k], modTimes[k] = mfs.files[k], mfs.modTimes[k]
+		if name, ok := mfs.names[k]; ok {
+			names[k] = name
+		}
+		mfs.remove(k)
+	}
+	for k, newK := range moved {
+		mfs.files[newK] = files[k]
+		if !modTimes[k].IsZero() {
+			mfs.modTimes[newK] = modTimes[k]
+		}
+		if name, ok := names[k]; ok {
+			mfs.setName(newK, name, true)
+		}
+	}
+	mfs.setName(newDir, newpath, true)
+	return nil
+}
+
+// Sync does nothing since the memory file system has no stable
+// storage. It returns an error if the named file does not exist.
+func (mfs MemoryFileSystem) Sync(name string) error {
+	mfs.mu.RLock()
+	defer mfs.mu.RUnlock()
+	cleaned := mfs.clean(name)
+	if _, ok := mfs.files[cleaned]; ok {
+		return nil
+	}
+	if _, ok := mfs.files[ensureDirName(cleaned)]; ok {
+		return nil
+	}
+	return &os.PathError{
+		Op:   "sync",
+		Path: name,
+		Err:  os.ErrNotExist,
+	}
+}
+
+// Stat returns a FileInfo describing the named file or directory.
+func (mfs MemoryFileSystem) Stat(name string) (os.FileInfo, error) {
+	mfs.mu.RLock()
+	defer mfs.mu.RUnlock()
+	cleaned := mfs.clean(name)
+	if content, ok := mfs.files[cleaned]; ok {
+		return MemoryFile{
+			path:    mfs.nameOf(cleaned),
+			content: content,
+			mode:    0666,
+			modTime: mfs.modTimes[cleaned],
+		}, nil
+	}
+	if _, ok := mfs.files[ensureDirName(cleaned)]; ok {
+		return MemoryFile{
+			path: mfs.nameOf(ensureDirName(cleaned)),
+			mode: os.ModeDir | 0777,
+		}, nil
+	}
+	return nil, &os.PathError{
+		Op:   "stat",
+		Path: name,
+		Err:  os.ErrNotExist,
+	}
+}
+
+// memoryLock is a lock acquired by MemoryFileSystem.Lock.
+type memoryLock struct {
+	mfs  MemoryFileSystem
+	path string
+	once sync.Once
+}
+
+// Close releases the lock.
+func (l *memoryLock) Close() error {
+	l.once.Do(func() {
+		l.mfs.mu.Lock()
+		defer l.mfs.mu.Unlock()
+		if l.mfs.locks[l.path] <= 1 {
+			delete(l.mfs.locks, l.path)
+		} else {
+			l.mfs.locks[l.path]--
+		}
+	})
 	return nil
 }
 
-// Walk implements filepath.Walk function for memory file system.
+// Lock acquires a lock on the named file, creating the file if
+// necessary. If exclusive is false, a shared lock is acquired. It
+// doesn't wait for the lock; ErrLocked is returned if a conflicting
+// lock is held. Closing the returned Closer releases the lock.
+func (mfs MemoryFileSystem) Lock(name string, exclusive bool) (io.Closer, error) {
+	mfs.mu.Lock()
+	defer mfs.mu.Unlock()
+	cleaned := mfs.clean(name)
+	if _, exists := mfs.files[parentDir(cleaned)]; !exists {
+		return nil, &os.PathError{
+			Op:   "lock",
+			Path: name,
+			Err:  os.ErrNotExist,
+		}
+	}
+	if _, exists := mfs.files[cleaned]; !exists {
+		mfs.files[cleaned] = nil
+		mfs.modTimes[cleaned] = time.Now()
+		mfs.setName(cleaned, filepath.Clean(name), false)
+	}
+	holders := mfs.locks[cleaned]
+	if holders < 0 || (exclusive && holders > 0) {
+		return nil, ErrLocked
+	}
+	if exclusive {
+		mfs.locks[cleaned] = -1
+	} else {
+		mfs.locks[cleaned] = holders + 1
+	}
+	return &memoryLock{mfs: mfs, path: cleaned}, nil
+}
+
+// Walk implements filepath.Walk function for memory file system. The
+// walk sees the files as they were when Walk was called, so walkFn
+// may modify the file system.
 func (mfs MemoryFileSystem) Walk(root string, walkFn filepath.WalkFunc) error {
-	cleaned := filepath.Clean(root)
+	cleaned := mfs.clean(root)
+	rootDir := ensureDirName(cleaned)
 	paths := []string{}
-	for path, _ := range mfs.files {
-		if strings.HasPrefix(path, cleaned) {
+	contents := map[string][]byte{}
+	modTimes := map[string]time.Time{}
+	names := map[string]string{}
+	mfs.mu.RLock()
+	for path, content := range mfs.files {
+		if path == cleaned || strings.HasPrefix(path, rootDir) {
 			paths = append(paths, path)
+			contents[path] = content
+			modTimes[path] = mfs.modTimes[path]
+			names[path] = mfs.nameOf(path)
 		}
 	}
+	mfs.mu.RUnlock()
 	sort.Strings(paths)
+	skipped := []string{}
 	for _, path := range paths {
+		if hasAnyPrefix(path, skipped) {
+			continue
+		}
 		// TODO: Provide the right information.
 		mode := os.FileMode(0777)
 		if strings.HasSuffix(path, "/") {
 			mode |= os.ModeDir
 		}
 		mf := MemoryFile{
-			path:    path,
-			content: []byte{},
+			path:    names[path],
+			content: contents[path],
 			mode:    mode,
+			modTime: modTimes[path],
+		}
+		err := walkFn(filepath.Clean(names[path]), mf, nil)
+		if err == filepath.SkipDir {
+			if mf.IsDir() {
+				skipped = append(skipped, path)
+			} else {
+				skipped = append(skipped, parentDir(path))
+			}
+			continue
+		}
+		if err == filepath.SkipAll {
+			return nil
 		}
-		err := walkFn(filepath.Clean(path), mf, nil)
 		if err != nil {
 			return err
 		}
@@ -199,12 +544,26 @@ func (mfs MemoryFileSystem) Walk(root string, walkFn filepath.WalkFunc) error {
 	return nil
 }
 
+// hasAnyPrefix returns true if s starts with any of the prefixes.
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
 // WriteFile writes data to a file named by filename. If the file does not
 // exist, WriteFile creates it with permissions perm; otherwise WriteFile
 // truncates it before writing.
 func (mfs MemoryFileSystem) WriteFile(filename string, data []byte, perm os.FileMode) error {
-	cleaned := filepath.Clean(filename)
+	mfs.mu.Lock()
+	defer mfs.mu.Unlock()
+	cleaned := mfs.clean(filename)
 	mfs.files[cleaned] = data
+	mfs.modTimes[cleaned] = time.Now()
+	mfs.setName(cleaned, filepath.Clean(filename), false)
 	_ = perm // TODO: Implement perm.
 	return nil
 }
@@ -86,3 +86,76 @@ func ExampleWriteFile() {
 	fmt.Println(string(buf))
 	// Output: content
 }
+
+func ExampleMemoryFileSystem_Rename() {
+	if filepath.Separator != '/' {
+		// Testing only on Unix like file system.
+		// TODO: Test other platforms like Windows.
+		return
+	}
+	mfs := NewMemoryFileSystem()
+	mfs.MkdirAll("/path/to", 0700)
+	mfs.WriteFile("/path/to/old.txt", []byte("old"), 0600)
+	mfs.WriteFile("/path/to/new.txt", []byte("new"), 0600)
+	fmt.Println(mfs.Rename("/path/to/new.txt", "/path/to/old.txt"))
+	r, _ := mfs.Open("/path/to/old.txt")
+	buf, _ := ioutil.ReadAll(r)
+	fmt.Println(string(buf))
+	_, err := mfs.Open("/path/to/new.txt")
+	fmt.Println(err)
+	// Output:
+	// <nil>
+	// new
+	// file does not exist
+}
+
+func ExampleMemoryFileSystem_Remove() {
+	if filepath.Separator != '/' {
+		// Testing only on Unix like file system.
+		// TODO: Test other platforms like Windows.
+		return
+	}
+	ls := func(path string, f os.FileInfo, err error) error {
+		fmt.Println(path, f.IsDir())
+		return nil
+	}
+	mfs := NewMemoryFileSystem()
+	mfs.MkdirAll("/path/to/empty", 0700)
+	mfs.WriteFile("/path/to/file.txt", []byte("content"), 0600)
+	fmt.Println(mfs.Remove("/path/to"))
+	fmt.Println(mfs.Remove("/path/to/empty"))
+	mfs.Walk("/", ls)
+	// Output:
+	// remove /path/to: Directory not empty
+	// <nil>
+	// / true
+	// /path true
+	// /path/to true
+	// /path/to/file.txt false
+}
+
+func ExampleNewCaseInsensitiveMemoryFileSystem() {
+	if filepath.Separator != '/' {
+		// Testing only on Unix like file system.
+		// TODO: Test other platforms like Windows.
+		return
+	}
+	ls := func(path string, f os.FileInfo, err error) error {
+		fmt.Println(path, f.IsDir())
+		return nil
+	}
+	mfs := NewCaseInsensitiveMemoryFileSystem()
+	mfs.MkdirAll("/Path/To", 0700)
+	mfs.WriteFile("/path/to/File.txt", []byte("old"), 0600)
+	mfs.WriteFile("/PATH/TO/file.TXT", []byte("new"), 0600)
+	r, _ := mfs.Open("/path/to/file.txt")
+	buf, _ := ioutil.ReadAll(r)
+	fmt.Println(string(buf))
+	mfs.Walk("/", ls)
+	// Output:
+	// new
+	// / true
+	// /Path true
+	// /Path/To true
+	// /Path/To/File.txt false
+}
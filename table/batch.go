@@ -0,0 +1,512 @@
+package table
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// batchDirPrefix starts the names of the directories in the table
+// where Batch stages the key files of a commit.
+const batchDirPrefix = ".batch-"
+
+// batchJournalName is the name of the journal in a batch directory.
+// It is written after all the staged files, so the batch is committed
+// once the journal exists.
+const batchJournalName = "journal"
+
+// batchState records whether a committed batch couldn't be finished,
+// which blocks writes until Recover finishes it. It is shared by the
+// copies of a Table.
+type batchState struct {
+	mu      sync.Mutex
+	pending bool
+}
+
+// set records whether a committed batch is unfinished.
+func (s *batchState) set(pending bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending = pending
+}
+
+// check returns ErrBatchPending if a committed batch is unfinished.
+// Writers call it with the locks of the keys they write held, since
+// the locks of the keys of the batch are held until it is recorded.
+func (s *batchState) check() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.pending {
+		return ErrBatchPending
+	}
+	return nil
+}
+
+// batchOpKind is the kind of a write in a batch.
+type batchOpKind int
+
+const (
+	batchPut batchOpKind = iota
+	batchPutSnapshots
+	batchRemove
+)
+
+// batchOp is a write staged in a batch.
+type batchOp struct {
+	kind      batchOpKind
+	key       []byte
+	value     []byte     // For batchPut
+	snapshots []Snapshot // For batchPutSnapshots
+}
+
+// batchEntry is the change of a key file recorded in the journal of a
+// batch.
+type batchEntry struct {
+	Path   string `json:"path"`             // Path relative to the table
+	Staged string `json:"staged,omitempty"` // Name of the staged file
+	Remove bool   `json:"remove,omitempty"` // Whether the file is removed
+	Marker string `json:"marker,omitempty"` // Name of the staged removal marker
+}
+
+// Batch is a set of writes to keys of a table that are committed
+// atomically: after a crash, Recover either completes or discards the
+// whole batch. The writes are staged in memory until Commit, which
+// holds the locks of all the keys while their files are replaced, so
+// readers see either all or none of the writes. A Batch is not safe for
+// concurrent use.
+type Batch struct {
+	tbl Table
+	ops []batchOp
+}
+
+// NewBatch returns an empty batch of writes to the table.
+func (tbl Table) NewBatch() *Batch {
+	return &Batch{tbl: tbl}
+}
+
+// Put stages writing the value to the key like Table.Put.
+func (b *Batch) Put(key, value []byte) {
+	b.ops = append(b.ops, batchOp{
+		kind:  batchPut,
+		key:   append([]byte(nil), key...),
+		value: append([]byte(nil), value...),
+	})
+}
+
+// PutSnapshots stages replacing the snapshots of the key like
+// Table.PutSnapshots. Commit returns ErrSnapshotsDisabled if the table
+// doesn't keep snapshots.
+func (b *Batch) PutSnapshots(key []byte, snapshots []Snapshot) {
+	copied := make([]Snapshot, len(snapshots))
+	for i, snapshot := range snapshots {
+		copied[i] = Snapshot{snapshot.Info, append([]byte(nil), snapshot.Value...)}
+	}
+	b.ops = append(b.ops, batchOp{kind: batchPutSnapshots, key: append([]byte(nil), key...), snapshots: copied})
+}
+
+// Remove stages removing the key. Removing a key that doesn't exist
+// is not an error.
+func (b *Batch) Remove(key []byte) {
+	b.ops = append(b.ops, batchOp{kind: batchRemove, key: append([]byte(nil), key...)})
+}
+
+// Len returns the number of staged writes.
+func (b *Batch) Len() int {
+	return len(b.ops)
+}
+
+// batchKey is the state of a key written by a batch.
+type batchKey struct {
+	key       []byte
+	path      string
+	longName  string
+	removed   bool
+	loaded    bool // Whether snapshots has the history of the key
+	value     []byte
+	snapshots []storedSnapshot
+	lost      seqRange    // Sequence numbers of the dropped snapshots
+	marker    *fileHeader // Removal marker, if the batch removes the key
+}
+
+// Commit writes the staged writes atomically. The batch is left
+// empty if it succeeds. The writes are applied in order, so a later
+// write to a key overrides an earlier one, except that Puts to a table
+// keeping snapshots all add a snapshot. If the key files can't be
+// replaced once the batch is committed, the error is returned and
+// writes to the table fail with ErrBatchPending until Recover finishes
+// the batch.
+func (b *Batch) Commit() error {
+	return b.commit(nil, nil)
+}
+
+// commit commits the batch like Commit. The keys are locked along
+// with the keys written by the batch, and validate, if not nil, is
+// called with the locks held before anything is written. The batch
+// isn't committed if validate returns an error.
+func (b *Batch) commit(keys [][]byte, validate func() error) error {
+	tbl := b.tbl
+	if tbl.readOnly {
+		return ErrReadOnly
+	}
+	if len(b.ops) == 0 && validate == nil {
+		return nil
+	}
+	for _, op := range b.ops {
+		keys = append(keys, op.key)
+	}
+	unlock := tbl.locks.lockKeys(keys)
+	defer unlock()
+	if err := tbl.batches.check(); err != nil {
+		return err
+	}
+	if validate != nil {
+		if err := validate(); err != nil {
+			return err
+		}
+	}
+	if len(b.ops) == 0 {
+		return nil
+	}
+	states := map[string]*batchKey{}
+	var order []*batchKey
+	for _, op := range b.ops {
+		state := states[string(op.key)]
+		if state == nil {
+			state = &batchKey{key: op.key, path: tbl.keyPath(op.key)}
+			_, state.longName = tbl.fileName(op.key)
+			states[string(op.key)] = state
+			order = append(order, state)
+		}
+		if err := tbl.applyBatchOp(state, op); err != nil {
+			return err
+		}
+	}
+	dir := filepath.Join(tbl.baseDirectory, fmt.Sprintf("%s%016x", batchDirPrefix, rand.Uint64()))
+	if err := tbl.fileSystem.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	entries, err := tbl.stageBatch(dir, order)
+	if err == nil {
+		err = tbl.writeBatchJournal(dir, entries)
+	}
+	if err != nil {
+		tbl.fileSystem.RemoveAll(dir)
+		return err
+	}
+	// The batch is committed, so it is rolled forward. If that
+	// fails, nothing else may be written before Recover finishes it.
+	if err := tbl.finishBatch(dir, entries); err != nil {
+		tbl.batches.set(true)
+		return err
+	}
+	b.ops = nil
+	return nil
+}
+
+// applyBatchOp applies the write to the state of its key.
+func (tbl Table) applyBatchOp(state *batchKey, op batchOp) error {
+	if op.kind == batchRemove {
+		if tbl.keepSnapshots {
+			if err := tbl.markBatchRemoval(state); err != nil {
+				return err
+			}
+		}
+		state.removed, state.loaded = true, true
+		state.value, state.snapshots, state.lost = nil, nil, seqRange{}
+		return nil
+	}
+	if !tbl.keepSnapshots {
+		if op.kind == batchPutSnapshots {
+			return ErrSnapshotsDisabled
+		}
+		if state.longName != "" {
+			return ErrKeyTooLong
+		}
+		state.removed, state.value = false, op.value
+		return nil
+	}
+	if op.kind == batchPutSnapshots {
+		if err := tbl.sequenceSnapshots(op.snapshots); err != nil {
+			return err
+		}
+		stored := make([]storedSnapshot, len(op.snapshots))
+		for i, snapshot := range op.snapshots {
+			var err error
+			if stored[i], err = tbl.encode(op.key, snapshot); err != nil {
+				return err
+			}
+		}
+		// A corrupt history is replaced as a whole.
+		if err := tbl.loadBatchKey(state); errors.Is(err, ErrCorrupt) {
+			state.loaded, state.snapshots, state.lost = true, nil, corruptHistory(stored)
+		} else if err != nil {
+			return err
+		}
+		state.lost = replacedSequences(state.lost, state.snapshots, stored)
+		state.removed, state.snapshots = false, stored
+		return nil
+	}
+	if err := tbl.loadBatchKey(state); err != nil {
+		return err
+	}
+	now := tbl.clock.Now()
+	info, err := tbl.stamp(now, len(op.value))
+	if err != nil {
+		return err
+	}
+	snapshot, err := tbl.encode(op.key, Snapshot{Info: info, Value: op.value})
+	if err != nil {
+		return err
+	}
+	snapshots := append(state.snapshots, snapshot)
+	infos := make([]SnapshotInfo, len(snapshots))
+	for i, snapshot := range snapshots {
+		infos[i] = snapshot.Info
+	}
+	if retain := retainInfos(tbl.retention, infos, now); retain != nil {
+		var kept []storedSnapshot
+		for i, snapshot := range snapshots {
+			if retain[i] {
+				kept = append(kept, snapshot)
+			} else {
+				state.lost = state.lost.add(snapshot.Info.Sequence)
+			}
+		}
+		snapshots = kept
+	}
+	state.removed, state.snapshots = false, snapshots
+	return nil
+}
+
+// loadBatchKey reads the history of the key into its state, unless it
+// has it already.
+func (tbl Table) loadBatchKey(state *batchKey) error {
+	if state.loaded {
+		return nil
+	}
+	header, snapshots, err := tbl.readKeyFile(state.path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	state.loaded, state.snapshots, state.lost = true, snapshots, header.lost
+	return nil
+}
+
+// markBatchRemoval sets the removal marker of the key in its state
+// for the removal of its history, if it has one.
+func (tbl Table) markBatchRemoval(state *batchKey) error {
+	first := uint64(1)
+	if err := tbl.loadBatchKey(state); err == nil {
+		if len(state.snapshots) == 0 && state.lost.first == 0 {
+			return nil
+		}
+		records := make([]record, len(state.snapshots))
+		for i, snapshot := range state.snapshots {
+			records[i].Info = snapshot.Info
+		}
+		first = firstSequence(fileHeader{lost: state.lost}, records)
+	} else if !errors.Is(err, ErrCorrupt) {
+		return err
+	}
+	name, _ := tbl.fileName(state.key)
+	marker, err := tbl.removal(name, state.longName, first)
+	if err != nil {
+		return err
+	}
+	if state.marker != nil {
+		marker.lost = marker.lost.merge(state.marker.lost)
+	}
+	state.marker = &marker
+	return nil
+}
+
+// stageBatch writes the new key files of the keys to the batch
+// directory and returns the journal entries of the keys.
+func (tbl Table) stageBatch(dir string, keys []*batchKey) ([]batchEntry, error) {
+	entries := make([]batchEntry, len(keys))
+	for i, state := range keys {
+		rel, err := filepath.Rel(tbl.baseDirectory, state.path)
+		if err != nil {
+			return nil, err
+		}
+		entries[i] = batchEntry{Path: rel, Remove: state.removed}
+		if state.marker != nil {
+			entries[i].Marker = strconv.Itoa(i) + ".marker"
+			if err := tbl.writeSnapshots(filepath.Join(dir, entries[i].Marker), *state.marker, nil); err != nil {
+				return nil, err
+			}
+		}
+		if state.removed {
+			continue
+		}
+		entries[i].Staged = strconv.Itoa(i)
+		staged := filepath.Join(dir, entries[i].Staged)
+		if tbl.keepSnapshots {
+			err = tbl.writeSnapshots(staged, fileHeader{name: state.longName, lost: state.lost}, state.snapshots)
+		} else {
+			err = tbl.writeFile(staged, func(w io.Writer) error {
+				_, err := w.Write(state.value)
+				return err
+			})
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+// writeBatchJournal writes the journal of the batch in dir, which
+// commits the batch.
+func (tbl Table) writeBatchJournal(dir string, entries []batchEntry) error {
+	buf, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	return tbl.writeFile(filepath.Join(dir, batchJournalName), func(w io.Writer) error {
+		_, err := w.Write(append(buf, '\n'))
+		return err
+	})
+}
+
+// finishBatch applies the journal entries of the committed batch in
+// dir and removes the directory. Entries already applied are skipped,
+// so an interrupted batch can be finished again.
+func (tbl Table) finishBatch(dir string, entries []batchEntry) error {
+	dirs := map[string]bool{}
+	for _, entry := range entries {
+		path := filepath.Join(tbl.baseDirectory, entry.Path)
+		dirs[filepath.Dir(path)] = true
+		if entry.Marker != "" {
+			// The removal is recorded before the history is gone.
+			marker := tbl.markerPath(filepath.Base(path))
+			dirs[filepath.Dir(marker)] = true
+			if err := tbl.moveStaged(filepath.Join(dir, entry.Marker), marker); err != nil {
+				return err
+			}
+		}
+		if entry.Remove {
+			if err := tbl.fileSystem.Remove(path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			continue
+		}
+		if err := tbl.moveStaged(filepath.Join(dir, entry.Staged), path); err != nil {
+			return err
+		}
+	}
+	for dir := range dirs {
+		if err := tbl.fileSystem.Sync(dir); err != nil {
+			return err
+		}
+	}
+	return tbl.fileSystem.RemoveAll(dir)
+}
+
+// moveStaged moves the staged file of a batch to path, unless it was
+// moved before the batch was interrupted.
+func (tbl Table) moveStaged(staged, path string) error {
+	if _, err := tbl.fileSystem.Stat(staged); os.IsNotExist(err) {
+		return nil
+	}
+	if err := tbl.fileSystem.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return tbl.fileSystem.Rename(staged, path)
+}
+
+// batchDirs returns the directories of the batches in the table.
+func (tbl Table) batchDirs() ([]string, error) {
+	var dirs []string
+	base := filepath.Clean(tbl.baseDirectory)
+	walkFunc := func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == base || !info.IsDir() {
+			return nil
+		}
+		if strings.HasPrefix(info.Name(), batchDirPrefix) {
+			dirs = append(dirs, path)
+		}
+		return filepath.SkipDir
+	}
+	if err := tbl.fileSystem.Walk(base, walkFunc); err != nil {
+		return nil, err
+	}
+	return dirs, nil
+}
+
+// checkCommittedBatches returns ErrBatchPending if the table has a
+// committed batch that isn't finished.
+func (tbl Table) checkCommittedBatches() error {
+	dirs, err := tbl.batchDirs()
+	if err != nil {
+		return err
+	}
+	for _, dir := range dirs {
+		_, err := tbl.fileSystem.Stat(filepath.Join(dir, batchJournalName))
+		if err == nil {
+			return ErrBatchPending
+		}
+		if !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// recoverBatches finishes the committed batches that were interrupted
+// and discards the others. It returns the batch directories that were
+// finished and discarded.
+func (tbl Table) recoverBatches() (finished, discarded []string, err error) {
+	dirs, err := tbl.batchDirs()
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, dir := range dirs {
+		entries, err := tbl.readBatchJournal(dir)
+		if os.IsNotExist(err) {
+			discarded = append(discarded, dir)
+			if err := tbl.fileSystem.RemoveAll(dir); err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		finished = append(finished, dir)
+		if err := tbl.finishBatch(dir, entries); err != nil {
+			return nil, nil, err
+		}
+	}
+	tbl.batches.set(false)
+	return finished, discarded, nil
+}
+
+// readBatchJournal reads the journal of the batch in dir.
+func (tbl Table) readBatchJournal(dir string) ([]batchEntry, error) {
+	f, err := tbl.fileSystem.Open(filepath.Join(dir, batchJournalName))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	buf, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	var entries []batchEntry
+	if err := json.Unmarshal(buf, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
@@ -0,0 +1,201 @@
+package table
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/jaeyeom/gofiletable/filesystem"
+)
+
+func TestBatchCommit(t *testing.T) {
+	mfs := filesystem.NewMemoryFileSystem()
+	tbl, err := Create(TableOption{BaseDirectory: "/test-table", FileSystem: mfs, KeepSnapshots: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tbl.Put([]byte("a"), []byte("old a"))
+	tbl.Put([]byte("gone"), []byte("value"))
+
+	b := tbl.NewBatch()
+	b.Put([]byte("a"), []byte("new a"))
+	b.Put([]byte("b"), []byte("first b"))
+	b.Put([]byte("b"), []byte("second b"))
+	b.Remove([]byte("gone"))
+	b.Remove([]byte("missing"))
+	b.PutSnapshots([]byte("c"), []Snapshot{{Info: SnapshotInfo{Timestamp: 100, ByteSize: 1}, Value: []byte("c")}})
+	if b.Len() != 6 {
+		t.Errorf("Len() = %d, want 6", b.Len())
+	}
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if b.Len() != 0 {
+		t.Errorf("Len() after Commit = %d, want 0", b.Len())
+	}
+	for key, want := range map[string][]string{
+		"a": {"old a", "new a"},
+		"b": {"first b", "second b"},
+		"c": {"c"},
+	} {
+		var got []string
+		for snapshot, err := range tbl.IterSnapshots(t.Context(), []byte(key)) {
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, string(snapshot.Value))
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("snapshots of %q = %q, want %q", key, got, want)
+		}
+	}
+	if _, err := tbl.Get([]byte("gone")); !os.IsNotExist(err) {
+		t.Errorf("Get(gone) error = %v, want not exist", err)
+	}
+	report, err := tbl.Recover()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.ReplayedBatches) != 0 || len(report.DiscardedBatches) != 0 {
+		t.Errorf("batches left behind: %+v", report)
+	}
+}
+
+func TestBatchPlainTable(t *testing.T) {
+	mfs := filesystem.NewMemoryFileSystem()
+	tbl, err := Create(TableOption{BaseDirectory: "/test-table", FileSystem: mfs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := tbl.NewBatch()
+	b.Put([]byte("a"), []byte("1"))
+	b.Put([]byte("a"), []byte("2"))
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := tbl.Get([]byte("a")); err != nil || string(value) != "2" {
+		t.Errorf("Get(a) = %q, %v, want 2", value, err)
+	}
+	b.PutSnapshots([]byte("b"), nil)
+	if err := b.Commit(); err != ErrSnapshotsDisabled {
+		t.Errorf("Commit() error = %v, want %v", err, ErrSnapshotsDisabled)
+	}
+	if _, err := tbl.Get([]byte("b")); !os.IsNotExist(err) {
+		t.Errorf("Get(b) error = %v, want not exist", err)
+	}
+}
+
+func TestBatchRecover(t *testing.T) {
+	mfs := filesystem.NewMemoryFileSystem()
+	tbl, err := Create(TableOption{BaseDirectory: "/test-table", FileSystem: mfs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tbl.Put([]byte("a"), []byte("old a"))
+	tbl.Put([]byte("b"), []byte("old b"))
+	entries := []batchEntry{
+		{Path: string(encodeKey([]byte("a"))), Staged: "0"},
+		{Path: string(encodeKey([]byte("b"))), Remove: true},
+	}
+
+	// A batch interrupted before its journal was written.
+	uncommitted := filepath.Join("/test-table", batchDirPrefix+"0000000000000001")
+	mfs.MkdirAll(uncommitted, 0700)
+	mfs.WriteFile(filepath.Join(uncommitted, "0"), []byte("lost a"), 0600)
+
+	// A committed batch interrupted while it was applied.
+	committed := filepath.Join("/test-table", batchDirPrefix+"0000000000000002")
+	mfs.MkdirAll(committed, 0700)
+	mfs.WriteFile(filepath.Join(committed, "0"), []byte("new a"), 0600)
+	if err := tbl.writeBatchJournal(committed, entries); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := tbl.Scan(nil, nil, ScanOption{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 {
+		t.Errorf("Scan() found %d keys, want batch directories skipped", len(keys))
+	}
+	report, err := tbl.Recover()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(report.ReplayedBatches, []string{committed}) {
+		t.Errorf("ReplayedBatches = %q, want %q", report.ReplayedBatches, committed)
+	}
+	if !reflect.DeepEqual(report.DiscardedBatches, []string{uncommitted}) {
+		t.Errorf("DiscardedBatches = %q, want %q", report.DiscardedBatches, uncommitted)
+	}
+	if value, err := tbl.Get([]byte("a")); err != nil || string(value) != "new a" {
+		t.Errorf("Get(a) = %q, %v, want new a", value, err)
+	}
+	if _, err := tbl.Get([]byte("b")); !os.IsNotExist(err) {
+		t.Errorf("Get(b) error = %v, want not exist", err)
+	}
+	for _, dir := range []string{committed, uncommitted} {
+		if _, err := mfs.Stat(dir); !os.IsNotExist(err) {
+			t.Errorf("%s is left: %v", dir, err)
+		}
+	}
+}
+
+// failingRenameFileSystem wraps a FileSystem and fails moving staged
+// batch files while fail is set.
+type failingRenameFileSystem struct {
+	*filesystem.MemoryFileSystem
+	fail *bool
+}
+
+var errRename = errors.New("rename failed")
+
+func (fs failingRenameFileSystem) Rename(oldpath, newpath string) error {
+	if *fs.fail && strings.Contains(oldpath, batchDirPrefix) && !strings.HasPrefix(filepath.Base(oldpath), tempFilePrefix) {
+		return errRename
+	}
+	return fs.MemoryFileSystem.Rename(oldpath, newpath)
+}
+
+func TestBatchUnfinished(t *testing.T) {
+	fail := false
+	option := TableOption{BaseDirectory: "/test-table", FileSystem: failingRenameFileSystem{filesystem.NewMemoryFileSystem(), &fail}}
+	tbl, err := Create(option)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := tbl.NewBatch()
+	b.Put([]byte("a"), []byte("new a"))
+	b.Put([]byte("b"), []byte("new b"))
+	fail = true
+	if err := b.Commit(); err != errRename {
+		t.Fatalf("Commit() error = %v, want %v", err, errRename)
+	}
+	fail = false
+	if err := tbl.Put([]byte("a"), []byte("newer a")); err != ErrBatchPending {
+		t.Errorf("Put() after an unfinished batch error = %v, want %v", err, ErrBatchPending)
+	}
+	tbl.Close()
+
+	readOnlyOption := option
+	readOnlyOption.ReadOnly = true
+	if _, err := Open(readOnlyOption); err != ErrBatchPending {
+		t.Errorf("Open() read-only with an unfinished batch error = %v, want %v", err, ErrBatchPending)
+	}
+	tbl, err = Open(option)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tbl.Close()
+	for _, key := range []string{"a", "b"} {
+		if value, err := tbl.Get([]byte(key)); err != nil || string(value) != "new "+key {
+			t.Errorf("Get(%s) = %q, %v, want new %s", key, value, err, key)
+		}
+	}
+	if err := tbl.Put([]byte("a"), []byte("newer a")); err != nil {
+		t.Errorf("Put() after recovery error = %v", err)
+	}
+}
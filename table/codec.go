@@ -0,0 +1,225 @@
+package table
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"sync"
+)
+
+// Codec encodes values before they are stored in snapshots and
+// decodes them when they are read. The name of the codec is stored
+// with each snapshot, so snapshots written with another codec, or
+// none, stay readable after the codec of a table is changed. Codecs
+// other than the built-in ones must be registered with RegisterCodec
+// to read their snapshots from tables that use another codec.
+type Codec interface {
+	// Name returns the name stored with the snapshots. It must not
+	// be empty.
+	Name() string
+	Encode(value []byte) ([]byte, error)
+	Decode(data []byte) ([]byte, error)
+}
+
+// gzipCodec is a Codec that compresses values with gzip.
+type gzipCodec struct {
+	level int
+}
+
+// Gzip returns a Codec that compresses values with gzip at the
+// compression level, such as gzip.DefaultCompression. Its name is
+// "gzip" for all levels.
+func Gzip(level int) Codec {
+	return gzipCodec{level}
+}
+
+func (gzipCodec) Name() string {
+	return "gzip"
+}
+
+func (c gzipCodec) Encode(value []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := gzip.NewWriterLevel(&buf, c.level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(value); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gzipCodec) Decode(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// flateCodec is a Codec that compresses values with DEFLATE.
+type flateCodec struct {
+	level int
+}
+
+// Flate returns a Codec that compresses values with raw DEFLATE at
+// the compression level, such as flate.DefaultCompression. It has
+// less overhead than Gzip for small values. Its name is "flate" for
+// all levels.
+func Flate(level int) Codec {
+	return flateCodec{level}
+}
+
+func (flateCodec) Name() string {
+	return "flate"
+}
+
+func (c flateCodec) Encode(value []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, c.level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(value); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (flateCodec) Decode(data []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(data))
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = map[string]Codec{
+		"gzip":  Gzip(gzip.DefaultCompression),
+		"flate": Flate(flate.DefaultCompression),
+	}
+)
+
+// RegisterCodec makes the codec available for decoding the snapshots
+// stored with its name, replacing the codec registered with the same
+// name.
+func RegisterCodec(codec Codec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	codecs[codec.Name()] = codec
+}
+
+// codecByName returns the codec for decoding the snapshots stored
+// with the name. The codec of the table takes precedence over the
+// registered ones.
+func (tbl Table) codecByName(name string) (Codec, error) {
+	if tbl.codec != nil && tbl.codec.Name() == name {
+		return tbl.codec, nil
+	}
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	codec, ok := codecs[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownCodec, name)
+	}
+	return codec, nil
+}
+
+// storedSnapshot is a snapshot as it is stored in a key file, with the
+// value encoded by the named codec and then encrypted.
+type storedSnapshot struct {
+	Info       SnapshotInfo // ByteSize is the size of data
+	codec      string       // Name of the codec, or "" if not encoded
+	keyID      string       // ID of the encryption key, or "" if not encrypted
+	wrappedKey []byte       // Data key encrypted under the key with keyID
+	data       []byte
+}
+
+// encode encodes the value of the snapshot of the key with the codec
+// of the table and encrypts it if the table is encrypted.
+func (tbl Table) encode(key []byte, snapshot Snapshot) (storedSnapshot, error) {
+	stored := storedSnapshot{Info: snapshot.Info, data: snapshot.Value}
+	if tbl.codec != nil {
+		data, err := tbl.codec.Encode(snapshot.Value)
+		if err != nil {
+			return storedSnapshot{}, err
+		}
+		stored.codec = tbl.codec.Name()
+		stored.data = data
+		stored.Info.ByteSize = uint64(len(data))
+	}
+	if tbl.encryption != nil {
+		return tbl.encrypt(key, stored)
+	}
+	return stored, nil
+}
+
+// readStored reads the stored snapshot of the record in sf.
+func readStored(sf *snapshotFile, rec record) (storedSnapshot, error) {
+	data, err := sf.Value(rec)
+	if err != nil {
+		return storedSnapshot{}, err
+	}
+	return storedSnapshot{rec.Info, rec.codec, rec.keyID, rec.wrappedKey, data}, nil
+}
+
+// value reads the value of the record in sf, decrypts it and decodes
+// it.
+func (tbl Table) value(sf *snapshotFile, rec record) ([]byte, error) {
+	data, err := sf.Value(rec)
+	if err != nil {
+		return nil, err
+	}
+	if rec.keyID != "" {
+		if data, err = tbl.decrypt(sf.key, storedSnapshot{rec.Info, rec.codec, rec.keyID, rec.wrappedKey, data}); err != nil {
+			return nil, err
+		}
+	}
+	if rec.codec == "" {
+		return data, nil
+	}
+	codec, err := tbl.codecByName(rec.codec)
+	if err != nil {
+		return nil, err
+	}
+	return codec.Decode(data)
+}
+
+// snapshot reads the snapshot of the record in sf with the decoded
+// value. The byte size in its info is the size of the decoded value.
+func (tbl Table) snapshot(sf *snapshotFile, rec record) (*Snapshot, error) {
+	value, err := tbl.value(sf, rec)
+	if err != nil {
+		return nil, err
+	}
+	info := rec.Info
+	info.ByteSize = uint64(len(value))
+	return &Snapshot{info, value}, nil
+}
+
+// GetRaw gets the value of the key as it is stored, without decrypting
+// it or decoding it with the codec of the latest snapshot.
+func (tbl Table) GetRaw(key []byte) ([]byte, error) {
+	if !tbl.keepSnapshots {
+		return tbl.Get(key)
+	}
+	sf, err := tbl.openKeySnapshots(key)
+	if err != nil {
+		return nil, err
+	}
+	defer sf.Close()
+	last, err := sf.Last()
+	if err != nil {
+		return nil, err
+	}
+	return sf.Value(last)
+}
@@ -0,0 +1,118 @@
+package table
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/jaeyeom/gofiletable/filesystem"
+)
+
+// reverseCodec is a Codec that reverses the bytes of values.
+type reverseCodec struct{}
+
+func (reverseCodec) Name() string {
+	return "test-reverse"
+}
+
+func (reverseCodec) Encode(value []byte) ([]byte, error) {
+	data := make([]byte, len(value))
+	for i, b := range value {
+		data[len(value)-1-i] = b
+	}
+	return data, nil
+}
+
+func (c reverseCodec) Decode(data []byte) ([]byte, error) {
+	return c.Encode(data)
+}
+
+// registerCodec registers the codec like RegisterCodec until the test
+// ends, when the registry is restored.
+func registerCodec(t *testing.T, codec Codec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	name := codec.Name()
+	old, ok := codecs[name]
+	codecs[name] = codec
+	t.Cleanup(func() {
+		codecsMu.Lock()
+		defer codecsMu.Unlock()
+		if ok {
+			codecs[name] = old
+		} else {
+			delete(codecs, name)
+		}
+	})
+}
+
+func TestCodecs(t *testing.T) {
+	mfs := filesystem.NewMemoryFileSystem()
+	option := TableOption{BaseDirectory: "/test-table", FileSystem: mfs, KeepSnapshots: true, Codec: Gzip(gzip.BestCompression)}
+	tbl, err := Create(option)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := []string{
+		strings.Repeat(`{"name": "gzip"}`, 100),
+		strings.Repeat(`{"name": "flate"}`, 100),
+		strings.Repeat(`{"name": "reverse"}`, 100),
+		strings.Repeat(`{"name": "none"}`, 100),
+	}
+	key := []byte("key")
+	put := func(codec Codec, value string) {
+		tbl.Close()
+		option.Codec = codec
+		if tbl, err = Open(option); err != nil {
+			t.Fatal(err)
+		}
+		if err := tbl.Put(key, []byte(value)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	put(Gzip(gzip.BestCompression), values[0])
+	raw, err := tbl.GetRaw(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(raw) >= len(values[0])/5 || bytes.Contains(raw, []byte("gzip")) {
+		t.Errorf("GetRaw() = %q; want the compressed value", raw)
+	}
+	put(Flate(flate.BestSpeed), values[1])
+	put(reverseCodec{}, values[2])
+	put(nil, values[3])
+	if raw, err := tbl.GetRaw(key); err != nil || string(raw) != values[3] {
+		t.Errorf("GetRaw() = %q, %v; want %q", raw, err, values[3])
+	}
+
+	// The table doesn't know the reverse codec anymore.
+	c, cerr := tbl.GetSnapshots(key)
+	for range c {
+	}
+	if err := <-cerr; !errors.Is(err, ErrUnknownCodec) {
+		t.Errorf("GetSnapshots() without the codec = %v; want %v", err, ErrUnknownCodec)
+	}
+	registerCodec(t, reverseCodec{})
+	var got []string
+	c, cerr = tbl.GetSnapshots(key)
+	for snapshot := range c {
+		if snapshot.Info.ByteSize != uint64(len(snapshot.Value)) {
+			t.Errorf("GetSnapshots() returned ByteSize %d for a value of %d bytes", snapshot.Info.ByteSize, len(snapshot.Value))
+		}
+		got = append(got, string(snapshot.Value))
+	}
+	if err := <-cerr; err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, values) {
+		t.Errorf("GetSnapshots() = %q; want %q", got, values)
+	}
+
+	if _, err := Create(TableOption{BaseDirectory: "/plain-table", FileSystem: mfs, Codec: Gzip(gzip.DefaultCompression)}); err != ErrSnapshotsDisabled {
+		t.Errorf("Create() of a plain table with a codec = %v; want %v", err, ErrSnapshotsDisabled)
+	}
+}
@@ -0,0 +1,90 @@
+package table
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sync"
+	"testing"
+)
+
+func TestConcurrentPutAndGet(t *testing.T) {
+	const (
+		writers = 8
+		readers = 4
+		puts    = 50
+	)
+	valuePattern := regexp.MustCompile(`^writer[0-9]+-put[0-9]+$`)
+	for name, option := range fileSystems {
+		t.Run(name, func(t *testing.T) {
+			tbl, err := Create(option(t))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var wg sync.WaitGroup
+			done := make(chan struct{})
+			for i := 0; i < writers; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					for j := 0; j < puts; j++ {
+						value := []byte(fmt.Sprintf("writer%d-put%d", i, j))
+						if err := tbl.Put([]byte("shared"), value); err != nil {
+							t.Error(err)
+						}
+						if err := tbl.Put([]byte(fmt.Sprintf("own%d", i)), value); err != nil {
+							t.Error(err)
+						}
+					}
+				}(i)
+			}
+			var readerWg sync.WaitGroup
+			for i := 0; i < readers; i++ {
+				readerWg.Add(1)
+				go func() {
+					defer readerWg.Done()
+					for {
+						select {
+						case <-done:
+							return
+						default:
+						}
+						value, err := tbl.Get([]byte("shared"))
+						if os.IsNotExist(err) {
+							continue
+						}
+						if err != nil {
+							t.Error(err)
+							return
+						}
+						if !valuePattern.Match(value) {
+							t.Errorf("Get() observed a partial value %q", value)
+							return
+						}
+					}
+				}()
+			}
+			wg.Wait()
+			close(done)
+			readerWg.Wait()
+
+			count := 0
+			c, cerr := tbl.GetSnapshots([]byte("shared"))
+			for range c {
+				count++
+			}
+			if err := <-cerr; err != nil {
+				t.Fatal(err)
+			}
+			if count != writers*puts {
+				t.Errorf("%d snapshots found; want %d", count, writers*puts)
+			}
+			for i := 0; i < writers; i++ {
+				value, err := tbl.Get([]byte(fmt.Sprintf("own%d", i)))
+				if want := fmt.Sprintf("writer%d-put%d", i, puts-1); err != nil || string(value) != want {
+					t.Errorf("Get(own%d) = %q, %v; want %q", i, value, err, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,301 @@
+package table
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+// KeyProvider supplies the AES-256 keys that encrypt a table. Keys
+// are identified by IDs, which are stored with the encrypted
+// snapshots, so a key must stay available as long as snapshots
+// encrypted with it exist.
+type KeyProvider interface {
+	// CurrentKeyID returns the ID of the key that new snapshots are
+	// encrypted with.
+	CurrentKeyID() (string, error)
+
+	// Key returns the 32-byte key with the ID.
+	Key(id string) ([]byte, error)
+}
+
+// Encryption is the option to encrypt a table at rest.
+//
+// Each snapshot value is encrypted with AES-256-GCM under a random
+// data key, which is in turn encrypted under the current key of the
+// provider and stored with the snapshot along with the key ID. Both
+// are bound to the key, timestamp, sequence number and codec of the
+// snapshot, so a snapshot copied to another key or changed otherwise
+// fails to decrypt. Use Rekey to re-encrypt existing snapshots under
+// the current key.
+type Encryption struct {
+	Keys KeyProvider
+
+	// EncryptNames encrypts the names of the key files, which
+	// otherwise reveal the keys. Names are encrypted
+	// deterministically under the current key when the table is
+	// created, whose ID is recorded in the manifest. That key can't
+	// be rotated, and Rekey refuses to re-encrypt the snapshots under
+	// another key. It can only be set when the table is created.
+	EncryptNames bool
+}
+
+// dataKeySize is the byte size of the data keys and the keys of
+// KeyProvider.
+const dataKeySize = 32
+
+// newAEAD returns AES-256-GCM with the key.
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != dataKeySize {
+		return nil, fmt.Errorf("%w: got %d bytes, want %d", ErrInvalidEncryptionKey, len(key), dataKeySize)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts plaintext with a random nonce, which is prepended to
+// the result, and authenticates it with the additional data.
+func seal(aead cipher.AEAD, plaintext, additionalData []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+// unseal decrypts data sealed by seal with the same additional data.
+func unseal(aead cipher.AEAD, data, additionalData []byte) ([]byte, error) {
+	if len(data) < aead.NonceSize() {
+		return nil, ErrDecryption
+	}
+	plaintext, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], additionalData)
+	if err != nil {
+		return nil, ErrDecryption
+	}
+	return plaintext, nil
+}
+
+// keyAEAD returns AES-256-GCM with the key of the provider with the
+// ID.
+func (tbl Table) keyAEAD(id string) (cipher.AEAD, error) {
+	if tbl.encryption == nil {
+		return nil, ErrNoKeyProvider
+	}
+	key, err := tbl.encryption.Keys.Key(id)
+	if err != nil {
+		return nil, err
+	}
+	return newAEAD(key)
+}
+
+// snapshotAD returns the additional data that binds an encrypted
+// snapshot to its key, timestamp, sequence number and codec, so that
+// it can't be moved to another key or position unnoticed.
+func snapshotAD(key []byte, snapshot storedSnapshot) []byte {
+	buf := binary.AppendUvarint(nil, uint64(len(key)))
+	buf = append(buf, key...)
+	buf = binary.AppendUvarint(buf, snapshot.Info.Timestamp)
+	buf = binary.AppendUvarint(buf, snapshot.Info.Sequence)
+	return append(buf, snapshot.codec...)
+}
+
+// encrypt encrypts the data of the stored snapshot of the key under a
+// new data key, which is encrypted under the current key.
+func (tbl Table) encrypt(key []byte, snapshot storedSnapshot) (storedSnapshot, error) {
+	id, err := tbl.encryption.Keys.CurrentKeyID()
+	if err != nil {
+		return storedSnapshot{}, err
+	}
+	keyAEAD, err := tbl.keyAEAD(id)
+	if err != nil {
+		return storedSnapshot{}, err
+	}
+	dataKey := make([]byte, dataKeySize)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return storedSnapshot{}, err
+	}
+	dataAEAD, err := newAEAD(dataKey)
+	if err != nil {
+		return storedSnapshot{}, err
+	}
+	ad := snapshotAD(key, snapshot)
+	if snapshot.wrappedKey, err = seal(keyAEAD, dataKey, ad); err != nil {
+		return storedSnapshot{}, err
+	}
+	if snapshot.data, err = seal(dataAEAD, snapshot.data, ad); err != nil {
+		return storedSnapshot{}, err
+	}
+	snapshot.keyID = id
+	snapshot.Info.ByteSize = uint64(len(snapshot.data))
+	return snapshot, nil
+}
+
+// decrypt decrypts the data of the stored snapshot of the key
+// encrypted by encrypt.
+func (tbl Table) decrypt(key []byte, snapshot storedSnapshot) ([]byte, error) {
+	keyAEAD, err := tbl.keyAEAD(snapshot.keyID)
+	if err != nil {
+		return nil, err
+	}
+	ad := snapshotAD(key, snapshot)
+	dataKey, err := unseal(keyAEAD, snapshot.wrappedKey, ad)
+	if err != nil {
+		return nil, err
+	}
+	dataAEAD, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return unseal(dataAEAD, snapshot.data, ad)
+}
+
+// nameCipher encrypts the names of key files deterministically, so
+// the name of a key can be found without listing the table.
+type nameCipher struct {
+	aead   cipher.AEAD
+	macKey []byte
+	keyID  string // ID of the key the keys are derived from
+}
+
+// newNameCipher returns a nameCipher whose keys are derived from key.
+func newNameCipher(key []byte) (*nameCipher, error) {
+	derive := func(label string) []byte {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(label))
+		return mac.Sum(nil)
+	}
+	aead, err := newAEAD(derive("gofiletable name encryption"))
+	if err != nil {
+		return nil, err
+	}
+	return &nameCipher{aead: aead, macKey: derive("gofiletable name nonce")}, nil
+}
+
+// encrypt encrypts the key with a nonce derived from the key.
+func (nc *nameCipher) encrypt(key []byte) []byte {
+	mac := hmac.New(sha256.New, nc.macKey)
+	mac.Write(key)
+	nonce := mac.Sum(nil)[:nc.aead.NonceSize()]
+	return nc.aead.Seal(nonce, nonce, key, nil)
+}
+
+// decrypt decrypts the key encrypted by encrypt.
+func (nc *nameCipher) decrypt(data []byte) ([]byte, error) {
+	return unseal(nc.aead, data, nil)
+}
+
+// loadNameCipher sets up the encryption of the key file names with
+// the key with the ID.
+func (tbl *Table) loadNameCipher(id string) error {
+	key, err := tbl.encryption.Keys.Key(id)
+	if err != nil {
+		return err
+	}
+	if tbl.names, err = newNameCipher(key); err != nil {
+		return err
+	}
+	tbl.names.keyID = id
+	return nil
+}
+
+// RekeyReport describes what Rekey did.
+type RekeyReport struct {
+	Keys      int // Number of keys rewritten
+	Snapshots int // Number of snapshots re-encrypted
+}
+
+// Rekey re-encrypts all the snapshots of the table that are not
+// encrypted under the current key of the provider, including the ones
+// that were written before the table was encrypted. Each of them gets
+// a new data key. Keys are rewritten one at a time, so Rekey can be
+// interrupted and run again. It stops early with the error of ctx if
+// ctx is done.
+//
+// The names of the key files can't be re-encrypted, so the key they
+// are encrypted with can't be rotated. If the table encrypts names and
+// the current key is another one, ErrNameKeyRotation is returned
+// before anything is rewritten.
+func (tbl Table) Rekey(ctx context.Context) (*RekeyReport, error) {
+	if tbl.encryption == nil {
+		return nil, ErrNoKeyProvider
+	}
+	if tbl.readOnly {
+		return nil, ErrReadOnly
+	}
+	id, err := tbl.encryption.Keys.CurrentKeyID()
+	if err != nil {
+		return nil, err
+	}
+	if tbl.names != nil && tbl.names.keyID != id {
+		return nil, ErrNameKeyRotation
+	}
+	var keys [][]byte
+	for key, err := range tbl.IterKeys(ctx) {
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	report := &RekeyReport{}
+	for _, key := range keys {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if err := tbl.rekeyKey(key, id, report); err != nil {
+			return nil, err
+		}
+	}
+	return report, nil
+}
+
+// rekeyKey re-encrypts the snapshots of the key that are not encrypted
+// under the key with the ID.
+func (tbl Table) rekeyKey(key []byte, id string, report *RekeyReport) error {
+	lock := tbl.locks.of(key)
+	lock.Lock()
+	defer lock.Unlock()
+	if err := tbl.batches.check(); err != nil {
+		return err
+	}
+	path := tbl.keyPath(key)
+	header, snapshots, err := tbl.readKeyFile(path)
+	if os.IsNotExist(err) {
+		// Removed since it was listed.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	rekeyed := 0
+	for i, snapshot := range snapshots {
+		if snapshot.keyID == id {
+			continue
+		}
+		if snapshot.keyID != "" {
+			if snapshot.data, err = tbl.decrypt(key, snapshot); err != nil {
+				return err
+			}
+		}
+		if snapshots[i], err = tbl.encrypt(key, snapshot); err != nil {
+			return err
+		}
+		rekeyed++
+	}
+	if rekeyed == 0 {
+		return nil
+	}
+	report.Keys++
+	report.Snapshots += rekeyed
+	_, header.name = tbl.fileName(key)
+	return tbl.writeSnapshots(path, header, snapshots)
+}
@@ -0,0 +1,165 @@
+package table
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jaeyeom/gofiletable/filesystem"
+)
+
+// staticKeys is a KeyProvider with fixed keys.
+type staticKeys struct {
+	current string
+	keys    map[string][]byte
+}
+
+func (k *staticKeys) CurrentKeyID() (string, error) {
+	return k.current, nil
+}
+
+func (k *staticKeys) Key(id string) ([]byte, error) {
+	key, ok := k.keys[id]
+	if !ok {
+		return nil, errors.New("no such key")
+	}
+	return key, nil
+}
+
+func TestEncryption(t *testing.T) {
+	keys := &staticKeys{"k1", map[string][]byte{
+		"k1": bytes.Repeat([]byte{1}, 32),
+		"k2": bytes.Repeat([]byte{2}, 32),
+	}}
+	mfs := filesystem.NewMemoryFileSystem()
+	option := TableOption{
+		BaseDirectory: "/test-table",
+		FileSystem:    mfs,
+		KeepSnapshots: true,
+		Encryption:    &Encryption{Keys: keys, EncryptNames: true},
+	}
+	tbl, err := Create(option)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tbl.Put([]byte("secret-key"), []byte("secret-value1"))
+	tbl.Put([]byte("secret-key"), []byte("secret-value2"))
+	mfs.Walk("/test-table", func(path string, info os.FileInfo, err error) error {
+		if !info.IsDir() && bytes.Contains([]byte(path+readFile(t, mfs, path)), []byte("secret")) {
+			t.Errorf("%s reveals the key or the value", path)
+		}
+		return nil
+	})
+	var got []string
+	for key := range tbl.Keys() {
+		got = append(got, string(key))
+	}
+	if len(got) != 1 || got[0] != "secret-key" {
+		t.Errorf("Keys() = %q; want [secret-key]", got)
+	}
+	if value, err := tbl.Get([]byte("secret-key")); err != nil || string(value) != "secret-value2" {
+		t.Errorf("Get() = %q, %v; want secret-value2", value, err)
+	}
+
+	keys.current = "k2"
+	if _, err := tbl.Rekey(context.Background()); err != ErrNameKeyRotation {
+		t.Errorf("Rekey() under another key than the names = %v; want %v", err, ErrNameKeyRotation)
+	}
+	snapshots, err := tbl.readSnapshots(tbl.keyPath([]byte("secret-key")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, snapshot := range snapshots {
+		if snapshot.keyID != "k1" {
+			t.Errorf("snapshot %d is encrypted with %q after a refused Rekey(); want k1", i, snapshot.keyID)
+		}
+	}
+	if value, err := tbl.Get([]byte("secret-key")); err != nil || string(value) != "secret-value2" {
+		t.Errorf("Get() after Rekey() = %q, %v; want secret-value2", value, err)
+	}
+
+	// The names can't be read without the key.
+	tbl.Close()
+	option.Encryption = nil
+	if _, err := Open(option); err != ErrOptionMismatch {
+		t.Errorf("Open() without encryption = %v; want %v", err, ErrOptionMismatch)
+	}
+}
+
+func TestEncryptedValues(t *testing.T) {
+	keys := &staticKeys{"k1", map[string][]byte{"k1": bytes.Repeat([]byte{1}, 32)}}
+	mfs := filesystem.NewMemoryFileSystem()
+	option := TableOption{
+		BaseDirectory: "/test-table",
+		FileSystem:    mfs,
+		KeepSnapshots: true,
+	}
+	tbl, err := Create(option)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tbl.Put([]byte("key"), []byte("plain"))
+	tbl.Close()
+	option.Encryption = &Encryption{Keys: keys}
+	if tbl, err = Open(option); err != nil {
+		t.Fatal(err)
+	}
+	tbl.Put([]byte("key"), []byte("secret"))
+	path := filepath.Join("/test-table", string(encodeKey([]byte("key"))))
+	if content := readFile(t, mfs, path); bytes.Contains([]byte(content), []byte("secret")) {
+		t.Errorf("the key file reveals the value: %q", content)
+	}
+	if report, err := tbl.Rekey(context.Background()); err != nil || report.Snapshots != 1 {
+		t.Errorf("Rekey() = %+v, %v; want the plain snapshot encrypted", report, err)
+	}
+	if content := readFile(t, mfs, path); bytes.Contains([]byte(content), []byte("plain")) {
+		t.Errorf("the key file reveals the value after Rekey(): %q", content)
+	}
+	keys.keys["k2"] = bytes.Repeat([]byte{2}, 32)
+	keys.current = "k2"
+	report, err := tbl.Rekey(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *report != (RekeyReport{Keys: 1, Snapshots: 2}) {
+		t.Errorf("Rekey() = %+v; want 1 key and 2 snapshots", report)
+	}
+	snapshots, err := tbl.readSnapshots(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, snapshot := range snapshots {
+		if snapshot.keyID != "k2" {
+			t.Errorf("snapshot %d is encrypted with %q after Rekey(); want k2", i, snapshot.keyID)
+		}
+	}
+	if value, err := tbl.Get([]byte("key")); err != nil || string(value) != "secret" {
+		t.Errorf("Get() after Rekey() = %q, %v; want secret", value, err)
+	}
+	// The snapshots are bound to their key.
+	mfs.WriteFile(filepath.Join("/test-table", string(encodeKey([]byte("copy")))), []byte(readFile(t, mfs, path)), 0600)
+	if _, err := tbl.Get([]byte("copy")); err != ErrDecryption {
+		t.Errorf("Get() of a copied key file = %v; want %v", err, ErrDecryption)
+	}
+	tbl.Close()
+
+	option.Encryption = nil
+	if tbl, err = Open(option); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tbl.Get([]byte("key")); err != ErrNoKeyProvider {
+		t.Errorf("Get() without encryption = %v; want %v", err, ErrNoKeyProvider)
+	}
+	tbl.Close()
+	keys.keys["k2"] = bytes.Repeat([]byte{1}, 32)
+	option.Encryption = &Encryption{Keys: keys}
+	if tbl, err = Open(option); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tbl.Get([]byte("key")); err != ErrDecryption {
+		t.Errorf("Get() with a wrong key = %v; want %v", err, ErrDecryption)
+	}
+}
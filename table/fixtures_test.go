@@ -0,0 +1,18 @@
+package table
+
+import (
+	"testing"
+
+	"github.com/jaeyeom/gofiletable/filesystem"
+)
+
+// fileSystems has the makers of the options of a new table with snapshots on
+// each file system the tests run on.
+var fileSystems = map[string]func(t *testing.T) TableOption{
+	"OSFileSystem": func(t *testing.T) TableOption {
+		return TableOption{BaseDirectory: t.TempDir(), FileSystem: filesystem.OSFileSystem, KeepSnapshots: true}
+	},
+	"MemoryFileSystem": func(t *testing.T) TableOption {
+		return TableOption{BaseDirectory: "/test-table", FileSystem: filesystem.NewMemoryFileSystem(), KeepSnapshots: true}
+	},
+}
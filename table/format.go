@@ -0,0 +1,649 @@
+package table
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"math"
+)
+
+// Snapshot files come in two formats. Version 1 files start with a
+// Header listing all snapshots followed by the values, so adding a
+// snapshot rewrites the whole file. Version 2 files start with
+// formatMagic and a file header, followed by one record per snapshot:
+//
+//	file    := formatMagic header record*
+//	header  := uvarint(len(fields)) fields
+//	record  := uvarint(len(fields)) fields value trailer
+//	fields  := (uvarint(tag) uvarint(len(data)) data)*
+//	trailer := 8-byte big endian offset of the start of the record
+//
+// Records are appended to the end of the file, so adding a snapshot
+// is proportional to the size of the value. The trailer points back
+// to the start of the last record, so the latest snapshot can be read
+// without scanning the file. Unknown fields are ignored, so fields can
+// be added without changing the version.
+//
+// Records carry CRC-32C (Castagnoli) checksums of the value and of the
+// fields. The fields checksum is the last field and covers the fields
+// before it. Records written before checksums were added have neither
+// and are read without verification, as are version 1 files.
+//
+// The file header has the same fields format. It records the full
+// file name of a key whose file name is hashed because it is too long,
+// and the range of the sequence numbers of the snapshots dropped from
+// the history of the key, so that read views can tell that they are
+// gone. Removal markers are snapshot files without records whose
+// header records the removal of the key.
+//
+// The first byte of a version 1 file is the header size, which is
+// never zero, so the zero byte at the start of formatMagic tells the
+// versions apart.
+const formatMagic = "\x00gft\x02"
+
+// Tags of the fields of a record.
+const (
+	tagTimestamp = 1 // uvarint timestamp of the snapshot
+	tagValueSize = 2 // uvarint byte size of the value
+	tagValueCRC  = 3 // 4-byte big endian CRC-32C of the value
+	tagFieldsCRC = 4 // 4-byte big endian CRC-32C of the preceding fields
+	tagCodec     = 5 // name of the codec of the value, if encoded
+	tagKeyID     = 6 // ID of the encryption key, if encrypted
+	tagDataKey   = 7 // data key encrypted under the encryption key
+	tagSequence  = 8 // uvarint sequence number of the snapshot, if any
+)
+
+// Tags of the fields of the file header. The fields checksum has the
+// same tag as in records.
+const (
+	tagFileName         = 1 // full file name of the key, if the name is hashed
+	tagLostFirst        = 2 // uvarint first sequence number of the dropped snapshots
+	tagLostLast         = 3 // uvarint last sequence number of the dropped snapshots
+	tagRemovedSequence  = 5 // uvarint sequence number of the removal, in removal markers
+	tagRemovedTimestamp = 6 // uvarint timestamp of the removal, in removal markers
+)
+
+// castagnoli is the table of the CRC-32C checksums in records.
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// trailerSize is the byte size of the trailer of a record.
+const trailerSize = 8
+
+var (
+	// errInvalidRecord is returned when a record of a version 2
+	// file can't be parsed.
+	errInvalidRecord = errors.New("gofiletable: invalid snapshot record")
+
+	// errChecksumMismatch is returned when a checksum in a record
+	// doesn't match the data.
+	errChecksumMismatch = errors.New("gofiletable: checksum mismatch")
+
+	// errTrailingData is returned when a version 1 file has data
+	// after the last snapshot.
+	errTrailingData = errors.New("gofiletable: unexpected data after the last snapshot")
+)
+
+// appendField appends the field with the tag and the data to buf.
+func appendField(buf []byte, tag uint64, data []byte) []byte {
+	buf = binary.AppendUvarint(buf, tag)
+	buf = binary.AppendUvarint(buf, uint64(len(data)))
+	return append(buf, data...)
+}
+
+// appendUvarintField appends the field with the tag and the uvarint
+// encoding of v to buf.
+func appendUvarintField(buf []byte, tag uint64, v uint64) []byte {
+	return appendField(buf, tag, binary.AppendUvarint(nil, v))
+}
+
+// appendCRCField appends the field with the tag and the checksum of
+// data to buf.
+func appendCRCField(buf []byte, tag uint64, data []byte) []byte {
+	return appendField(buf, tag, binary.BigEndian.AppendUint32(nil, crc32.Checksum(data, castagnoli)))
+}
+
+// parseFields parses the fields in buf into a map from tags to data.
+// If there is a fields checksum, it is verified.
+func parseFields(buf []byte) (map[uint64][]byte, error) {
+	fields := map[uint64][]byte{}
+	for pos := 0; pos < len(buf); {
+		tag, n := binary.Uvarint(buf[pos:])
+		if n <= 0 {
+			return nil, errInvalidRecord
+		}
+		size, m := binary.Uvarint(buf[pos+n:])
+		if m <= 0 || size > uint64(len(buf)-pos-n-m) {
+			return nil, errInvalidRecord
+		}
+		data := buf[pos+n+m : pos+n+m+int(size)]
+		if tag == tagFieldsCRC && (len(data) != 4 || binary.BigEndian.Uint32(data) != crc32.Checksum(buf[:pos], castagnoli)) {
+			return nil, errChecksumMismatch
+		}
+		fields[tag] = data
+		pos += n + m + int(size)
+	}
+	return fields, nil
+}
+
+// uvarintField returns the uvarint value of the field with the tag.
+func uvarintField(fields map[uint64][]byte, tag uint64) (uint64, error) {
+	data, ok := fields[tag]
+	if !ok {
+		return 0, errInvalidRecord
+	}
+	v, n := binary.Uvarint(data)
+	if n != len(data) {
+		return 0, errInvalidRecord
+	}
+	return v, nil
+}
+
+// appendRecord appends the record of the snapshot to buf. The record
+// starts at the offset start of the file.
+func appendRecord(buf []byte, start int64, snapshot storedSnapshot) []byte {
+	var fields []byte
+	fields = appendUvarintField(fields, tagTimestamp, snapshot.Info.Timestamp)
+	fields = appendUvarintField(fields, tagValueSize, uint64(len(snapshot.data)))
+	fields = appendCRCField(fields, tagValueCRC, snapshot.data)
+	if snapshot.Info.Sequence != 0 {
+		fields = appendUvarintField(fields, tagSequence, snapshot.Info.Sequence)
+	}
+	if snapshot.codec != "" {
+		fields = appendField(fields, tagCodec, []byte(snapshot.codec))
+	}
+	if snapshot.keyID != "" {
+		fields = appendField(fields, tagKeyID, []byte(snapshot.keyID))
+		fields = appendField(fields, tagDataKey, snapshot.wrappedKey)
+	}
+	fields = appendCRCField(fields, tagFieldsCRC, fields)
+	buf = binary.AppendUvarint(buf, uint64(len(fields)))
+	buf = append(buf, fields...)
+	buf = append(buf, snapshot.data...)
+	return binary.BigEndian.AppendUint64(buf, uint64(start))
+}
+
+// seqRange is a range of sequence numbers from first to last
+// inclusive. It is empty if first is zero.
+type seqRange struct {
+	first, last uint64
+}
+
+// add returns the range extended to seq. Zero, which is not a
+// sequence number, is ignored.
+func (r seqRange) add(seq uint64) seqRange {
+	if seq == 0 {
+		return r
+	}
+	if r.first == 0 || seq < r.first {
+		r.first = seq
+	}
+	if seq > r.last {
+		r.last = seq
+	}
+	return r
+}
+
+// merge returns the smallest range covering r and other.
+func (r seqRange) merge(other seqRange) seqRange {
+	return r.add(other.first).add(other.last)
+}
+
+// fileHeader is the content of the file header of a version 2
+// snapshot file.
+type fileHeader struct {
+	name    string       // Full file name of the key, if the name is hashed
+	lost    seqRange     // Sequence numbers of the dropped snapshots
+	removed SnapshotInfo // Removal of the key, in removal markers
+}
+
+// writeSnapshotFile writes a version 2 snapshot file with the header
+// and the snapshots to w.
+func writeSnapshotFile(w io.Writer, header fileHeader, snapshots []storedSnapshot) error {
+	var fields []byte
+	if header.name != "" {
+		fields = appendField(fields, tagFileName, []byte(header.name))
+	}
+	if header.lost.first != 0 {
+		fields = appendUvarintField(fields, tagLostFirst, header.lost.first)
+		fields = appendUvarintField(fields, tagLostLast, header.lost.last)
+	}
+	if header.removed.Sequence != 0 {
+		fields = appendUvarintField(fields, tagRemovedSequence, header.removed.Sequence)
+		fields = appendUvarintField(fields, tagRemovedTimestamp, header.removed.Timestamp)
+	}
+	if len(fields) > 0 {
+		fields = appendCRCField(fields, tagFieldsCRC, fields)
+	}
+	buf := append([]byte(formatMagic), binary.AppendUvarint(nil, uint64(len(fields)))...)
+	buf = append(buf, fields...)
+	bw := bufio.NewWriter(w)
+	bw.Write(buf)
+	offset := int64(len(buf))
+	for _, snapshot := range snapshots {
+		buf = appendRecord(buf[:0], offset, snapshot)
+		bw.Write(buf)
+		offset += int64(len(buf))
+	}
+	return bw.Flush()
+}
+
+// record is the location of a snapshot in a snapshot file.
+type record struct {
+	Info     SnapshotInfo
+	index    int    // Index of the snapshot, or -1 if unknown
+	offset   int64  // Offset of the value
+	checksum []byte // Big endian CRC-32C of the value, if any
+	codec    string // Name of the codec of the value, if encoded
+	keyID    string // ID of the encryption key, if encrypted
+	// Data key encrypted under the encryption key
+	wrappedKey []byte
+}
+
+// snapshotFile reads the snapshots of an opened snapshot file of
+// either format. If the file is an io.ReaderAt, only the parts of the
+// file that are needed are read. Otherwise the file is read into
+// memory.
+type snapshotFile struct {
+	version int
+	at      io.ReaderAt
+	size    int64
+	start   int64      // Offset of the first value or record
+	v1      []record   // Records listed in the version 1 header
+	key     []byte     // Key of the file, for errors
+	header  fileHeader // File header of a version 2 file
+	closer  io.Closer
+}
+
+// openSnapshots opens the snapshot file at path for reading.
+func (tbl Table) openSnapshots(path string) (*snapshotFile, error) {
+	f, err := tbl.fileSystem.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	size, err := tbl.fileSize(path, f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	sf, err := openSnapshotFile(f, size, tbl.keyOfPath(path))
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if sf.key == nil && sf.header.name != "" {
+		sf.key, _ = tbl.nameKey(sf.header.name)
+	}
+	sf.closer = f
+	return sf, nil
+}
+
+// fileSize returns the size of the file at path, which is opened as f.
+func (tbl Table) fileSize(path string, f io.Reader) (int64, error) {
+	if seeker, ok := f.(io.Seeker); ok {
+		size, err := seeker.Seek(0, io.SeekEnd)
+		if err != nil {
+			return 0, err
+		}
+		_, err = seeker.Seek(0, io.SeekStart)
+		return size, err
+	}
+	info, err := tbl.fileSystem.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// Close closes the file opened by openSnapshots.
+func (sf *snapshotFile) Close() error {
+	if sf.closer == nil {
+		return nil
+	}
+	return sf.closer.Close()
+}
+
+// appendSnapshot appends the snapshot to the version 2 snapshot file
+// at path, which is opened as sf. If the append fails, the file is
+// restored to its previous content.
+func (tbl Table) appendSnapshot(path string, sf *snapshotFile, snapshot storedSnapshot) error {
+	err := tbl.appendToFile(path, appendRecord(nil, sf.size, snapshot))
+	if err == nil {
+		return nil
+	}
+	// Parts of the record may have been written, so the file is
+	// replaced with its old content.
+	if restoreErr := tbl.writeFile(path, func(w io.Writer) error {
+		_, err := io.Copy(w, io.NewSectionReader(sf.at, 0, sf.size))
+		return err
+	}); restoreErr != nil {
+		return restoreErr
+	}
+	return err
+}
+
+// appendToFile appends buf to the file at path and syncs it.
+func (tbl Table) appendToFile(path string, buf []byte) error {
+	w, err := tbl.fileSystem.Append(path)
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(buf); err != nil {
+		w.Close()
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return tbl.fileSystem.Sync(path)
+}
+
+// openSnapshotFile reads the header of the snapshot file f of the
+// key whose size is size. The file must not be read beyond size, which
+// may be smaller than the file if it is being appended.
+func openSnapshotFile(f io.Reader, size int64, key []byte) (*snapshotFile, error) {
+	at, ok := f.(io.ReaderAt)
+	if !ok {
+		buf, err := ioutil.ReadAll(io.LimitReader(f, size))
+		if err != nil {
+			return nil, err
+		}
+		at = bytes.NewReader(buf)
+	}
+	sf := &snapshotFile{at: at, size: size, key: key}
+	magic := make([]byte, len(formatMagic))
+	if n, _ := at.ReadAt(magic, 0); n == len(magic) && string(magic) == formatMagic {
+		sf.version = 2
+		buf := make([]byte, binary.MaxVarintLen64)
+		n, _ := at.ReadAt(buf, int64(len(magic)))
+		headerSize, m := binary.Uvarint(buf[:n])
+		if m <= 0 {
+			return nil, sf.corrupt(-1, int64(len(magic)), io.ErrUnexpectedEOF)
+		}
+		sf.start = int64(len(magic)+m) + int64(headerSize)
+		if headerSize > uint64(size) || sf.start > size {
+			return nil, sf.corrupt(-1, int64(len(magic)), io.ErrUnexpectedEOF)
+		}
+		if headerSize == 0 {
+			return sf, nil
+		}
+		header := make([]byte, headerSize)
+		if _, err := at.ReadAt(header, int64(len(magic)+m)); err != nil {
+			return nil, sf.corrupt(-1, int64(len(magic)), err)
+		}
+		fields, err := parseFields(header)
+		if err != nil {
+			return nil, sf.corrupt(-1, int64(len(magic)), err)
+		}
+		if sf.header, err = parseFileHeader(fields); err != nil {
+			return nil, sf.corrupt(-1, int64(len(magic)), err)
+		}
+		return sf, nil
+	}
+	sf.version = 1
+	header, err := readHeader(bufio.NewReader(io.NewSectionReader(at, 0, size)))
+	if err != nil {
+		return nil, sf.corrupt(-1, 0, err)
+	}
+	sf.start = int64(header.ByteSize)
+	offset := sf.start
+	sf.v1 = make([]record, len(header.Snapshots))
+	for i, info := range header.Snapshots {
+		sf.v1[i] = record{Info: info, index: i, offset: offset}
+		offset += int64(info.ByteSize)
+	}
+	return sf, nil
+}
+
+// parseFileHeader returns the file header with the parsed fields.
+func parseFileHeader(fields map[uint64][]byte) (fileHeader, error) {
+	header := fileHeader{name: string(fields[tagFileName])}
+	var err error
+	if _, ok := fields[tagLostFirst]; ok {
+		if header.lost.first, err = uvarintField(fields, tagLostFirst); err != nil {
+			return fileHeader{}, err
+		}
+		if header.lost.last, err = uvarintField(fields, tagLostLast); err != nil {
+			return fileHeader{}, err
+		}
+	}
+	if _, ok := fields[tagRemovedSequence]; ok {
+		if header.removed.Sequence, err = uvarintField(fields, tagRemovedSequence); err != nil {
+			return fileHeader{}, err
+		}
+		if header.removed.Timestamp, err = uvarintField(fields, tagRemovedTimestamp); err != nil {
+			return fileHeader{}, err
+		}
+	}
+	return header, nil
+}
+
+// corrupt returns a *CorruptError for err found at the offset of the
+// file, if err means that the file is corrupt. Other errors, such as
+// I/O errors, are returned as is. If index is -1 and the offset is
+// past the file header, the index is looked up. The header must be
+// read before that.
+func (sf *snapshotFile) corrupt(index int, offset int64, err error) error {
+	switch err {
+	case io.EOF, io.ErrUnexpectedEOF, errInvalidRecord, errChecksumMismatch, errTrailingData, ErrHeaderSizeMismatch:
+	default:
+		return err
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if index < 0 && sf.start > 0 && offset >= sf.start {
+		records, _, _ := sf.scan()
+		for i, rec := range records {
+			if rec.offset == offset {
+				index = i
+			}
+		}
+	}
+	return &CorruptError{Key: sf.key, Index: index, Offset: offset, Err: err}
+}
+
+// unexpectedEOF converts io.EOF to io.ErrUnexpectedEOF.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// readRecord reads the record of a version 2 file starting at offset
+// start. It returns the record and the offset where the record ends.
+// The index of the record is set to index.
+func (sf *snapshotFile) readRecord(start int64, index int) (record, int64, error) {
+	buf := make([]byte, 64)
+	n, err := sf.at.ReadAt(buf, start)
+	if n < len(buf) && err != nil && err != io.EOF {
+		return record{}, 0, err
+	}
+	buf = buf[:n]
+	if max := sf.size - start; int64(len(buf)) > max {
+		buf = buf[:max]
+	}
+	fieldsSize, m := binary.Uvarint(buf)
+	if m <= 0 {
+		return record{}, 0, io.ErrUnexpectedEOF
+	}
+	fieldsEnd := start + int64(m) + int64(fieldsSize)
+	if fieldsSize > uint64(sf.size) || fieldsEnd > sf.size {
+		return record{}, 0, io.ErrUnexpectedEOF
+	}
+	fields := buf[m:]
+	if uint64(len(fields)) >= fieldsSize {
+		fields = fields[:fieldsSize]
+	} else {
+		fields = make([]byte, fieldsSize)
+		if _, err := sf.at.ReadAt(fields, start+int64(m)); err != nil {
+			return record{}, 0, unexpectedEOF(err)
+		}
+	}
+	parsed, err := parseFields(fields)
+	if err != nil {
+		return record{}, 0, err
+	}
+	rec := record{index: index, offset: fieldsEnd}
+	if rec.Info.Timestamp, err = uvarintField(parsed, tagTimestamp); err != nil {
+		return record{}, 0, err
+	}
+	if rec.Info.ByteSize, err = uvarintField(parsed, tagValueSize); err != nil {
+		return record{}, 0, err
+	}
+	if _, ok := parsed[tagSequence]; ok {
+		if rec.Info.Sequence, err = uvarintField(parsed, tagSequence); err != nil {
+			return record{}, 0, err
+		}
+	}
+	if checksum, ok := parsed[tagValueCRC]; ok {
+		if len(checksum) != 4 {
+			return record{}, 0, errInvalidRecord
+		}
+		rec.checksum = checksum
+	}
+	rec.codec = string(parsed[tagCodec])
+	rec.keyID = string(parsed[tagKeyID])
+	rec.wrappedKey = parsed[tagDataKey]
+	if rec.Info.ByteSize > uint64(sf.size) {
+		return record{}, 0, io.ErrUnexpectedEOF
+	}
+	end := fieldsEnd + int64(rec.Info.ByteSize) + trailerSize
+	if end > sf.size {
+		return record{}, 0, io.ErrUnexpectedEOF
+	}
+	trailer := make([]byte, trailerSize)
+	if _, err := sf.at.ReadAt(trailer, end-trailerSize); err != nil {
+		return record{}, 0, unexpectedEOF(err)
+	}
+	if int64(binary.BigEndian.Uint64(trailer)) != start {
+		return record{}, 0, errInvalidRecord
+	}
+	return rec, end, nil
+}
+
+// scan returns the complete records of the file in the order they
+// were written, and the offset where the last of them ends. If the
+// file has an incomplete or corrupt record, the records before it are
+// returned with a *CorruptError. Only the values of version 1 files
+// are not checked.
+func (sf *snapshotFile) scan() ([]record, int64, error) {
+	if sf.version == 1 {
+		end := sf.start
+		for i, rec := range sf.v1 {
+			if !sf.fits(rec) {
+				return sf.v1[:i], end, sf.corrupt(i, rec.offset, io.ErrUnexpectedEOF)
+			}
+			end = rec.offset + int64(rec.Info.ByteSize)
+		}
+		return sf.v1, end, nil
+	}
+	var records []record
+	offset := sf.start
+	for offset < sf.size {
+		rec, end, err := sf.readRecord(offset, len(records))
+		if err != nil {
+			return records, offset, sf.corrupt(len(records), offset, err)
+		}
+		records = append(records, rec)
+		offset = end
+	}
+	return records, offset, nil
+}
+
+// Records returns all the records of the file in the order they were
+// written.
+func (sf *snapshotFile) Records() ([]record, error) {
+	records, _, err := sf.scan()
+	if err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// Last returns the record of the latest snapshot. ErrNoSnapshots is
+// returned if the file has no snapshots. Version 2 files are read
+// backward from the trailer of the last record. If that fails, the
+// file is scanned from the start to find what is wrong. The records
+// of version 1 files are all checked against the size of the file.
+func (sf *snapshotFile) Last() (record, error) {
+	if sf.version == 1 {
+		records, err := sf.Records()
+		if err != nil {
+			return record{}, err
+		}
+		if len(records) == 0 {
+			return record{}, ErrNoSnapshots
+		}
+		return records[len(records)-1], nil
+	}
+	if sf.size == sf.start {
+		return record{}, ErrNoSnapshots
+	}
+	if rec, err := sf.lastRecord(); err == nil {
+		return rec, nil
+	}
+	records, err := sf.Records()
+	if err != nil {
+		return record{}, err
+	}
+	return records[len(records)-1], nil
+}
+
+// lastRecord reads the last record of a version 2 file through its
+// trailer. The index of the record is unknown.
+func (sf *snapshotFile) lastRecord() (record, error) {
+	if sf.size-sf.start < trailerSize {
+		return record{}, io.ErrUnexpectedEOF
+	}
+	trailer := make([]byte, trailerSize)
+	if _, err := sf.at.ReadAt(trailer, sf.size-trailerSize); err != nil {
+		return record{}, unexpectedEOF(err)
+	}
+	start := binary.BigEndian.Uint64(trailer)
+	if start < uint64(sf.start) || start > math.MaxInt64 {
+		return record{}, errInvalidRecord
+	}
+	rec, end, err := sf.readRecord(int64(start), -1)
+	if err != nil {
+		return record{}, err
+	}
+	if end != sf.size {
+		return record{}, errInvalidRecord
+	}
+	return rec, nil
+}
+
+// end returns the offset where the record ends.
+func (sf *snapshotFile) end(rec record) int64 {
+	end := rec.offset + int64(rec.Info.ByteSize)
+	if sf.version == 2 {
+		end += trailerSize
+	}
+	return end
+}
+
+// fits reports whether the value of the record lies within the file.
+// It doesn't overflow on sizes read from a corrupt header.
+func (sf *snapshotFile) fits(rec record) bool {
+	return rec.offset >= 0 && rec.offset <= sf.size && rec.Info.ByteSize <= uint64(sf.size-rec.offset)
+}
+
+// Value reads the value of the record and verifies its checksum.
+func (sf *snapshotFile) Value(rec record) ([]byte, error) {
+	if !sf.fits(rec) {
+		return nil, sf.corrupt(rec.index, rec.offset, io.ErrUnexpectedEOF)
+	}
+	value := make([]byte, rec.Info.ByteSize)
+	if n, err := sf.at.ReadAt(value, rec.offset); n < len(value) {
+		return nil, sf.corrupt(rec.index, rec.offset, unexpectedEOF(err))
+	}
+	if rec.checksum != nil && binary.BigEndian.Uint32(rec.checksum) != crc32.Checksum(value, castagnoli) {
+		return nil, sf.corrupt(rec.index, rec.offset, errChecksumMismatch)
+	}
+	return value, nil
+}
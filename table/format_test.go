@@ -0,0 +1,277 @@
+package table
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jaeyeom/gofiletable/filesystem"
+)
+
+// countingFileSystem wraps a FileSystem and counts the bytes read from
+// the opened files.
+type countingFileSystem struct {
+	FileSystem
+	read *int64
+}
+
+type countingFile struct {
+	io.ReadCloser
+	read *int64
+}
+
+func (f countingFile) Read(p []byte) (int, error) {
+	n, err := f.ReadCloser.Read(p)
+	*f.read += int64(n)
+	return n, err
+}
+
+func (f countingFile) ReadAt(p []byte, off int64) (int, error) {
+	n, err := f.ReadCloser.(io.ReaderAt).ReadAt(p, off)
+	*f.read += int64(n)
+	return n, err
+}
+
+func (fs countingFileSystem) Open(name string) (io.ReadCloser, error) {
+	f, err := fs.FileSystem.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return countingFile{f, fs.read}, nil
+}
+
+func TestGetReadsOnlyTheLatestSnapshot(t *testing.T) {
+	const (
+		versions  = 1000
+		valueSize = 1000
+	)
+	var read int64
+	mfs := filesystem.NewMemoryFileSystem()
+	tbl, err := Create(TableOption{BaseDirectory: "/test-table", FileSystem: countingFileSystem{mfs, &read}, KeepSnapshots: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshots := make([]Snapshot, versions)
+	for i := range snapshots {
+		value := bytes.Repeat([]byte(fmt.Sprintf("%d", i%10)), valueSize)
+		snapshots[i] = Snapshot{SnapshotInfo{Timestamp: uint64(i + 1), ByteSize: valueSize}, value}
+	}
+	if err := tbl.PutSnapshots([]byte("key"), snapshots); err != nil {
+		t.Fatal(err)
+	}
+	read = 0
+	value, err := tbl.Get([]byte("key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(value, snapshots[versions-1].Value) {
+		t.Errorf("Get() returned a wrong value")
+	}
+	// Only the latest record is read, through the trailer at the
+	// end of the file.
+	if limit := int64(valueSize + 100); read > limit {
+		t.Errorf("Get() read %d bytes; want at most %d", read, limit)
+	}
+}
+
+func TestVersion1FileIsConvertedOnPut(t *testing.T) {
+	mfs := filesystem.NewMemoryFileSystem()
+	tbl, err := Create(TableOption{BaseDirectory: "/test-table", FileSystem: mfs, KeepSnapshots: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := tbl.keyPath([]byte("key"))
+	var buf bytes.Buffer
+	(&Header{16, []SnapshotInfo{{Timestamp: 100, ByteSize: 5}, {Timestamp: 200, ByteSize: 6}}}).WriteTo(&buf)
+	buf.WriteString("firstsecond")
+	mfs.WriteFile(path, buf.Bytes(), 0600)
+	if value, err := tbl.Get([]byte("key")); err != nil || string(value) != "second" {
+		t.Errorf(`Get() = %q, %v; want "second"`, value, err)
+	}
+	if err := tbl.Put([]byte("key"), []byte("third")); err != nil {
+		t.Fatal(err)
+	}
+	if content := readFile(t, mfs, path); !strings.HasPrefix(content, formatMagic) {
+		t.Errorf("Put() didn't convert the file to version 2: %q", content)
+	}
+	var values []string
+	c, cerr := tbl.GetSnapshots([]byte("key"))
+	for snapshot := range c {
+		values = append(values, string(snapshot.Value))
+	}
+	if err := <-cerr; err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"first", "second", "third"}; !reflect.DeepEqual(values, want) {
+		t.Errorf("GetSnapshots() = %q; want %q", values, want)
+	}
+}
+
+func TestPutAppends(t *testing.T) {
+	mfs := filesystem.NewMemoryFileSystem()
+	tbl, err := Create(TableOption{BaseDirectory: "/test-table", FileSystem: mfs, KeepSnapshots: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := tbl.keyPath([]byte("key"))
+	var previous string
+	for i := 0; i < 10; i++ {
+		value := fmt.Sprintf("value%d", i)
+		if err := tbl.Put([]byte("key"), []byte(value)); err != nil {
+			t.Fatal(err)
+		}
+		content := readFile(t, mfs, path)
+		if !strings.HasPrefix(content, previous) {
+			t.Fatalf("Put(%q) changed the existing records", value)
+		}
+		// The record has the fields, the checksums, the value and
+		// the trailer.
+		if grown := len(content) - len(previous); i > 0 && grown > len(value)+48 {
+			t.Errorf("Put(%q) grew the file by %d bytes", value, grown)
+		}
+		previous = content
+		if got, err := tbl.Get([]byte("key")); err != nil || string(got) != value {
+			t.Errorf("Get() = %q, %v; want %q", got, err, value)
+		}
+	}
+}
+
+func TestRecoverTornAppend(t *testing.T) {
+	mfs := filesystem.NewMemoryFileSystem()
+	tbl, err := Create(TableOption{BaseDirectory: "/test-table", FileSystem: mfs, KeepSnapshots: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tbl.Put([]byte("key"), []byte("first"))
+	tbl.Put([]byte("key"), []byte("second"))
+	path := tbl.keyPath([]byte("key"))
+	content := readFile(t, mfs, path)
+	// Append the first half of a record, as a crash would leave it.
+	record := appendRecord(nil, int64(len(content)), storedSnapshot{Info: SnapshotInfo{Timestamp: 300, ByteSize: 5}, data: []byte("third")})
+	mfs.WriteFile(path, []byte(content+string(record[:len(record)/2])), 0600)
+
+	report, err := tbl.Recover()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{path}; !reflect.DeepEqual(report.Repaired, want) {
+		t.Errorf("Recover() repaired %q; want %q", report.Repaired, want)
+	}
+	if got := readFile(t, mfs, path); got != content {
+		t.Errorf("Recover() left %q; want %q", got, content)
+	}
+	if value, err := tbl.Get([]byte("key")); err != nil || string(value) != "second" {
+		t.Errorf(`Get() = %q, %v; want "second"`, value, err)
+	}
+}
+
+// readFile returns the content of the file at path.
+func readFile(t *testing.T, fs FileSystem, path string) string {
+	f, err := fs.Open(filepath.Clean(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	content, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(content)
+}
+
+func TestCorruption(t *testing.T) {
+	mfs := filesystem.NewMemoryFileSystem()
+	tbl, err := Create(TableOption{BaseDirectory: "/test-table", FileSystem: mfs, KeepSnapshots: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := tbl.keyPath([]byte("key"))
+	values := []string{"first", "second", "third"}
+	for _, value := range values {
+		tbl.Put([]byte("key"), []byte(value))
+	}
+	content := readFile(t, mfs, path)
+	flip := func(offset int) {
+		corrupted := []byte(content)
+		corrupted[offset] ^= 0x01
+		mfs.WriteFile(path, corrupted, 0600)
+	}
+	checkCorrupt := func(name string, err error, index int, offset int) {
+		var corrupt *CorruptError
+		if !errors.Is(err, ErrCorrupt) || !errors.As(err, &corrupt) {
+			t.Errorf("%s: got %v; want a *CorruptError", name, err)
+			return
+		}
+		if string(corrupt.Key) != "key" || corrupt.Index != index || corrupt.Offset != int64(offset) {
+			t.Errorf("%s: got %+v; want key %q, index %d, offset %d", name, corrupt, "key", index, offset)
+		}
+	}
+
+	second := strings.Index(content, "second")
+	flip(second)
+	if value, err := tbl.Get([]byte("key")); err != nil || string(value) != "third" {
+		t.Errorf(`Get() = %q, %v; want "third"`, value, err)
+	}
+	c, cerr := tbl.GetSnapshots([]byte("key"))
+	var got []string
+	for snapshot := range c {
+		got = append(got, string(snapshot.Value))
+	}
+	if want := []string{"first"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("GetSnapshots() = %q; want %q", got, want)
+	}
+	checkCorrupt("GetSnapshots() with a flipped value", <-cerr, 1, second)
+
+	third := strings.Index(content, "third")
+	flip(third)
+	_, err = tbl.Get([]byte("key"))
+	checkCorrupt("Get() with a flipped value", err, 2, third)
+
+	// The timestamp of the third record is right after the value of
+	// the second one, its trailer and the record header.
+	recordStart := second + len("second") + trailerSize
+	flip(recordStart + 4)
+	_, err = tbl.Get([]byte("key"))
+	checkCorrupt("Get() with a flipped timestamp", err, 2, recordStart)
+
+	var buf bytes.Buffer
+	header := &Header{16, []SnapshotInfo{{Timestamp: 100, ByteSize: 5}, {Timestamp: 200, ByteSize: 6}}}
+	header.WriteTo(&buf)
+	buf.WriteString("firstsec")
+	mfs.WriteFile(path, buf.Bytes(), 0600)
+	_, err = tbl.Get([]byte("key"))
+	checkCorrupt("Get() with a short version 1 value", err, 1, int(header.ByteSize)+len("first"))
+}
+
+func TestVersion1FileWithHugeSize(t *testing.T) {
+	mfs := filesystem.NewMemoryFileSystem()
+	tbl, err := Create(TableOption{BaseDirectory: "/test-table", FileSystem: mfs, KeepSnapshots: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := tbl.keyPath([]byte("key"))
+	for _, sizes := range [][]uint64{{math.MaxUint64}, {math.MaxInt64}, {5, math.MaxUint64 - 4, 5}} {
+		header := &Header{Snapshots: []SnapshotInfo{}}
+		for i, size := range sizes {
+			header.Snapshots = append(header.Snapshots, SnapshotInfo{Timestamp: uint64(i + 1), ByteSize: size})
+		}
+		var buf bytes.Buffer
+		header.WriteTo(&buf)
+		buf.WriteString("value")
+		mfs.WriteFile(path, buf.Bytes(), 0600)
+		if _, err := tbl.Get([]byte("key")); !errors.Is(err, ErrCorrupt) {
+			t.Errorf("Get() with sizes %v: got %v; want ErrCorrupt", sizes, err)
+		}
+		if _, err := tbl.GetAt([]byte("key"), time.Unix(0, 10)); !errors.Is(err, ErrCorrupt) {
+			t.Errorf("GetAt() with sizes %v: got %v; want ErrCorrupt", sizes, err)
+		}
+	}
+}
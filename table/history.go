@@ -0,0 +1,57 @@
+package table
+
+import (
+	"context"
+	"time"
+)
+
+// timestamp converts t to a snapshot timestamp. Times before the Unix
+// epoch are clamped to zero.
+func timestamp(t time.Time) uint64 {
+	if t.Before(time.Unix(0, 0)) {
+		return 0
+	}
+	return uint64(t.UnixNano())
+}
+
+// GetAt gets the value of the key as of the time t, which is the
+// value of the latest snapshot, by sequence number, written at or
+// before t. ErrNoSnapshots is returned if the key had no value at t,
+// and ErrSnapshotsDisabled if the table doesn't keep snapshots.
+func (tbl Table) GetAt(key []byte, t time.Time) ([]byte, error) {
+	if !tbl.keepSnapshots {
+		return nil, ErrSnapshotsDisabled
+	}
+	sf, err := tbl.openKeySnapshots(key)
+	if err != nil {
+		return nil, err
+	}
+	defer sf.Close()
+	records, err := sf.Records()
+	if err != nil {
+		return nil, err
+	}
+	at := timestamp(t)
+	found := -1
+	for i, rec := range records {
+		if rec.Info.Timestamp <= at && (found < 0 || rec.Info.Sequence >= records[found].Info.Sequence) {
+			found = i
+		}
+	}
+	if found < 0 {
+		return nil, ErrNoSnapshots
+	}
+	return tbl.value(sf, records[found])
+}
+
+// GetSnapshotsBetween returns a channel of the snapshots of the key
+// written between from and to inclusive. Only the values of those
+// snapshots are read. ErrSnapshotsDisabled is sent to the error
+// channel if the table doesn't keep snapshots.
+func (tbl Table) GetSnapshotsBetween(key []byte, from, to time.Time) (<-chan *Snapshot, <-chan error) {
+	if to.Before(time.Unix(0, 0)) {
+		// Nothing can be found, but the key is still checked.
+		return snapshotChannels(tbl.iterSnapshots(context.Background(), key, 1, 0))
+	}
+	return snapshotChannels(tbl.iterSnapshots(context.Background(), key, timestamp(from), timestamp(to)))
+}
@@ -0,0 +1,59 @@
+package table
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jaeyeom/gofiletable/filesystem"
+)
+
+func TestGetAt(t *testing.T) {
+	tbl, err := Create(TableOption{BaseDirectory: "/test-table", FileSystem: filesystem.NewMemoryFileSystem(), KeepSnapshots: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tbl.PutSnapshots([]byte("key"), []Snapshot{
+		{SnapshotInfo{Timestamp: 100, ByteSize: 2}, []byte("v1")},
+		{SnapshotInfo{Timestamp: 200, ByteSize: 2}, []byte("v2")},
+		{SnapshotInfo{Timestamp: 300, ByteSize: 2}, []byte("v3")},
+	})
+	examples := []struct {
+		at    int64
+		value string
+		err   error
+	}{
+		{50, "", ErrNoSnapshots},
+		{100, "v1", nil},
+		{250, "v2", nil},
+		{1000, "v3", nil},
+	}
+	for _, e := range examples {
+		value, err := tbl.GetAt([]byte("key"), time.Unix(0, e.at))
+		if string(value) != e.value || err != e.err {
+			t.Errorf("GetAt(%d) = %q, %v; want %q, %v", e.at, value, err, e.value, e.err)
+		}
+	}
+}
+
+func ExampleTable_GetSnapshotsBetween() {
+	tbl, err := Create(TableOption{BaseDirectory: "/test-table", FileSystem: filesystem.NewMemoryFileSystem(), KeepSnapshots: true})
+	if err != nil {
+		fmt.Println(err)
+	}
+	tbl.PutSnapshots([]byte("key"), []Snapshot{
+		{SnapshotInfo{Timestamp: 100, ByteSize: 2}, []byte("v1")},
+		{SnapshotInfo{Timestamp: 200, ByteSize: 2}, []byte("v2")},
+		{SnapshotInfo{Timestamp: 300, ByteSize: 2}, []byte("v3")},
+		{SnapshotInfo{Timestamp: 400, ByteSize: 2}, []byte("v4")},
+	})
+	c, cerr := tbl.GetSnapshotsBetween([]byte("key"), time.Unix(0, 150), time.Unix(0, 300))
+	for snapshot := range c {
+		fmt.Println(snapshot.Info.Timestamp, string(snapshot.Value))
+	}
+	fmt.Println(<-cerr)
+	// Output:
+	// 200 v2
+	// 300 v3
+	// <nil>
+}
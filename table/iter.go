@@ -0,0 +1,116 @@
+package table
+
+import (
+	"context"
+	"iter"
+	"math"
+	"os"
+	"path/filepath"
+)
+
+// IterKeys returns an iterator over the keys of the table in no
+// particular order. Errors, such as a file whose name doesn't belong
+// to a key, are yielded with a nil key, and the iteration goes on if
+// the caller continues. Listing the table stops as soon as the caller
+// stops, or with the error of ctx once ctx is done.
+func (tbl Table) IterKeys(ctx context.Context) iter.Seq2[[]byte, error] {
+	return func(yield func([]byte, error) bool) {
+		// A FileSystem may go on walking after SkipAll, but yield
+		// must not be called after it returns false.
+		stopped := false
+		err := tbl.walkKeyFiles(func(path string, info os.FileInfo) error {
+			if stopped {
+				return filepath.SkipAll
+			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			key, err := tbl.pathKey(path)
+			if os.IsNotExist(err) {
+				// Removed since it was listed.
+				return nil
+			}
+			if !yield(key, err) {
+				stopped = true
+				return filepath.SkipAll
+			}
+			return nil
+		})
+		if err != nil && !stopped {
+			yield(nil, err)
+		}
+	}
+}
+
+// IterSnapshots returns an iterator over the snapshots of the key from
+// the oldest. ErrNoSnapshots is yielded if the key has none, and
+// ErrSnapshotsDisabled if the table doesn't keep snapshots. The
+// iteration stops after the first error, when the caller stops, or
+// with the error of ctx once ctx is done. Values are read one at a
+// time as the iteration goes.
+func (tbl Table) IterSnapshots(ctx context.Context, key []byte) iter.Seq2[Snapshot, error] {
+	return tbl.iterSnapshots(ctx, key, 0, math.MaxUint64)
+}
+
+// iterSnapshots returns an iterator over the snapshots whose
+// timestamps are between from and to inclusive. The values of the
+// other snapshots are skipped without being read into memory.
+func (tbl Table) iterSnapshots(ctx context.Context, key []byte, from, to uint64) iter.Seq2[Snapshot, error] {
+	return func(yield func(Snapshot, error) bool) {
+		if !tbl.keepSnapshots {
+			yield(Snapshot{}, ErrSnapshotsDisabled)
+			return
+		}
+		sf, err := tbl.openKeySnapshots(key)
+		if err != nil {
+			yield(Snapshot{}, err)
+			return
+		}
+		defer sf.Close()
+		records, err := sf.Records()
+		if err == nil && len(records) == 0 {
+			err = ErrNoSnapshots
+		}
+		if err != nil {
+			yield(Snapshot{}, err)
+			return
+		}
+		for _, rec := range records {
+			if rec.Info.Timestamp < from || rec.Info.Timestamp > to {
+				continue
+			}
+			if err := ctx.Err(); err != nil {
+				yield(Snapshot{}, err)
+				return
+			}
+			snapshot, err := tbl.snapshot(sf, rec)
+			if err != nil {
+				yield(Snapshot{}, err)
+				return
+			}
+			if !yield(*snapshot, nil) {
+				return
+			}
+		}
+	}
+}
+
+// snapshotChannels runs the iterator in a goroutine and sends its
+// snapshots to the returned channel and its error to the error
+// channel. The goroutine blocks until all the snapshots are received.
+func snapshotChannels(snapshots iter.Seq2[Snapshot, error]) (<-chan *Snapshot, <-chan error) {
+	c := make(chan *Snapshot)
+	cerr := make(chan error, 1)
+	go func() {
+		defer close(c)
+		defer close(cerr)
+		for snapshot, err := range snapshots {
+			if err != nil {
+				cerr <- err
+				return
+			}
+			c <- &snapshot
+		}
+	}()
+	return c, cerr
+}
@@ -0,0 +1,160 @@
+package table
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jaeyeom/gofiletable/filesystem"
+)
+
+// failingWalkFileSystem wraps a FileSystem and fails walks after
+// visiting the root.
+type failingWalkFileSystem struct {
+	*filesystem.MemoryFileSystem
+}
+
+var errWalk = errors.New("walk failed")
+
+func (fs failingWalkFileSystem) Walk(root string, walkFn filepath.WalkFunc) error {
+	info, err := fs.Stat(root)
+	if err != nil {
+		return err
+	}
+	if err := walkFn(root, info, nil); err != nil {
+		return err
+	}
+	return errWalk
+}
+
+// skipAllIgnoringFileSystem wraps a FileSystem whose walks go on
+// after SkipAll.
+type skipAllIgnoringFileSystem struct {
+	*filesystem.MemoryFileSystem
+}
+
+func (fs skipAllIgnoringFileSystem) Walk(root string, walkFn filepath.WalkFunc) error {
+	fs.MemoryFileSystem.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err := walkFn(path, info, err); err != filepath.SkipAll {
+			return err
+		}
+		return nil
+	})
+	return filepath.SkipAll
+}
+
+func TestIterKeys(t *testing.T) {
+	mfs := filesystem.NewMemoryFileSystem()
+	tbl, err := Create(TableOption{BaseDirectory: "/test-table", FileSystem: mfs, KeepSnapshots: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tbl.Close()
+	for _, key := range []string{"a", "b", "c"} {
+		tbl.Put([]byte(key), []byte("value"))
+	}
+	mfs.WriteFile("/test-table/invalid!", nil, 0600)
+
+	var keys []string
+	var errs []error
+	for key, err := range tbl.IterKeys(context.Background()) {
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		keys = append(keys, string(key))
+		if len(keys) == 2 {
+			break
+		}
+	}
+	if len(keys) != 2 || len(errs) != 0 {
+		t.Errorf("IterKeys() with break got %q, %v; want 2 keys", keys, errs)
+	}
+
+	errs = nil
+	for _, err := range tbl.IterKeys(context.Background()) {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) != 1 || !errors.Is(errs[0], ErrInvalidKeyName) {
+		t.Errorf("IterKeys() errors = %v; want ErrInvalidKeyName", errs)
+	}
+	mfs.Remove("/test-table/invalid!")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for key, err := range tbl.IterKeys(ctx) {
+		if err != context.Canceled {
+			t.Errorf("IterKeys() with a canceled context = %q, %v; want context.Canceled", key, err)
+		}
+	}
+
+	ignoring := *tbl
+	ignoring.fileSystem = skipAllIgnoringFileSystem{mfs}
+	keys = nil
+	for key, err := range ignoring.IterKeys(context.Background()) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, string(key))
+		break
+	}
+	if len(keys) != 1 {
+		t.Errorf("IterKeys() ignoring SkipAll with break got %q; want 1 key", keys)
+	}
+
+	failing := *tbl
+	failing.fileSystem = failingWalkFileSystem{mfs}
+	for _, err := range failing.IterKeys(context.Background()) {
+		if err != errWalk {
+			t.Errorf("IterKeys() error = %v; want %v", err, errWalk)
+		}
+	}
+}
+
+func TestIterSnapshots(t *testing.T) {
+	mfs := filesystem.NewMemoryFileSystem()
+	tbl, err := Create(TableOption{BaseDirectory: "/test-table", FileSystem: mfs, KeepSnapshots: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tbl.Close()
+	tbl.PutSnapshots([]byte("key"), []Snapshot{
+		{SnapshotInfo{Timestamp: 100, ByteSize: 6}, []byte("value1")},
+		{SnapshotInfo{Timestamp: 200, ByteSize: 6}, []byte("value2")},
+		{SnapshotInfo{Timestamp: 300, ByteSize: 6}, []byte("value3")},
+	})
+	var values []string
+	for snapshot, err := range tbl.IterSnapshots(context.Background(), []byte("key")) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		values = append(values, string(snapshot.Value))
+		if len(values) == 2 {
+			break
+		}
+	}
+	if len(values) != 2 || values[0] != "value1" || values[1] != "value2" {
+		t.Errorf("IterSnapshots() with break = %q; want [value1 value2]", values)
+	}
+	tbl.PutSnapshots([]byte("empty"), nil)
+	for _, err := range tbl.IterSnapshots(context.Background(), []byte("empty")) {
+		if err != ErrNoSnapshots {
+			t.Errorf("IterSnapshots() of a key without snapshots: got %v; want ErrNoSnapshots", err)
+		}
+	}
+
+	plain, err := Create(TableOption{BaseDirectory: "/plain-table", FileSystem: mfs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	for _, err := range plain.IterSnapshots(context.Background(), []byte("key")) {
+		if err != ErrSnapshotsDisabled {
+			t.Errorf("IterSnapshots() of a plain table: got %v; want ErrSnapshotsDisabled", err)
+		}
+	}
+}
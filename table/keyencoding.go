@@ -0,0 +1,140 @@
+package table
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// KeyEncoding is the encoding of keys into the names of their files.
+type KeyEncoding string
+
+// Key encodings. All of them but KeyEncodingBase64 and
+// KeyEncodingReadable produce names that differ in more than the case
+// of letters for different keys, so tables using them can be stored
+// on case-insensitive file systems.
+const (
+	// KeyEncodingBase64 encodes keys in URL base64. It is the
+	// default, and the encoding of tables created before the
+	// encoding could be selected.
+	KeyEncodingBase64 KeyEncoding = "base64"
+
+	// KeyEncodingBase32 encodes keys in lower case base32 without
+	// padding.
+	KeyEncodingBase32 KeyEncoding = "base32"
+
+	// KeyEncodingHex encodes keys in lower case hex.
+	KeyEncodingHex KeyEncoding = "hex"
+
+	// KeyEncodingPercent keeps lower case letters, digits, '-',
+	// '_' and '.' as they are, except for a leading '.', and
+	// escapes other bytes as '%' followed by two lower case hex
+	// digits.
+	KeyEncodingPercent KeyEncoding = "percent"
+
+	// KeyEncodingReadable is like KeyEncodingPercent, but keeps
+	// upper case letters as they are too, so that names are easy to
+	// read. Keys that differ only in case have names that differ
+	// only in case.
+	KeyEncodingReadable KeyEncoding = "readable"
+)
+
+// base32Encoding is the base32 encoding of KeyEncodingBase32, before
+// it is folded to lower case.
+var base32Encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// valid returns true if the encoding is known.
+func (e KeyEncoding) valid() bool {
+	switch e {
+	case KeyEncodingBase64, KeyEncodingBase32, KeyEncodingHex, KeyEncodingPercent, KeyEncodingReadable:
+		return true
+	}
+	return false
+}
+
+// EncodeKey returns the file name of the key. Names never start with
+// a '.', which is reserved for the files of the table itself.
+func (e KeyEncoding) EncodeKey(key []byte) string {
+	switch e {
+	case KeyEncodingBase32:
+		return strings.ToLower(base32Encoding.EncodeToString(key))
+	case KeyEncodingHex:
+		return hex.EncodeToString(key)
+	case KeyEncodingPercent:
+		return percentEncode(key, false)
+	case KeyEncodingReadable:
+		return percentEncode(key, true)
+	}
+	return string(encodeKey(key))
+}
+
+// DecodeKey returns the key of the file name. Only names returned by
+// EncodeKey are accepted, so a key has exactly one name.
+func (e KeyEncoding) DecodeKey(name string) ([]byte, error) {
+	var key []byte
+	var err error
+	switch e {
+	case KeyEncodingBase32:
+		key, err = base32Encoding.DecodeString(strings.ToUpper(name))
+	case KeyEncodingHex:
+		key, err = hex.DecodeString(name)
+	case KeyEncodingPercent, KeyEncodingReadable:
+		key, err = percentDecode(name)
+	default:
+		key, err = decodeKey([]byte(name))
+	}
+	if err != nil {
+		return nil, err
+	}
+	if e.EncodeKey(key) != name {
+		return nil, fmt.Errorf("gofiletable: %q is not a %s key name", name, e)
+	}
+	return key, nil
+}
+
+// isPercentSafe returns true if the byte at index i of a key is kept as
+// it is by KeyEncodingPercent, or by KeyEncodingReadable if upper is
+// true.
+func isPercentSafe(c byte, i int, upper bool) bool {
+	return 'a' <= c && c <= 'z' || upper && 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+		c == '-' || c == '_' || c == '.' && i > 0
+}
+
+// percentEncode encodes the key with KeyEncodingPercent, or with
+// KeyEncodingReadable if upper is true.
+func percentEncode(key []byte, upper bool) string {
+	const digits = "0123456789abcdef"
+	var b strings.Builder
+	for i, c := range key {
+		if isPercentSafe(c, i, upper) {
+			b.WriteByte(c)
+			continue
+		}
+		b.WriteByte('%')
+		b.WriteByte(digits[c>>4])
+		b.WriteByte(digits[c&15])
+	}
+	return b.String()
+}
+
+// percentDecode decodes the name encoded by percentEncode.
+func percentDecode(name string) ([]byte, error) {
+	key := make([]byte, 0, len(name))
+	for i := 0; i < len(name); i++ {
+		if name[i] != '%' {
+			key = append(key, name[i])
+			continue
+		}
+		if i+2 >= len(name) {
+			return nil, fmt.Errorf("gofiletable: truncated escape in %q", name)
+		}
+		c, err := hex.DecodeString(name[i+1 : i+3])
+		if err != nil {
+			return nil, err
+		}
+		key = append(key, c[0])
+		i += 2
+	}
+	return key, nil
+}
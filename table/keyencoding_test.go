@@ -0,0 +1,89 @@
+package table
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/jaeyeom/gofiletable/filesystem"
+)
+
+func TestKeyEncodings(t *testing.T) {
+	keys := []string{"", "a", "A", "\xca", ".hidden", "a.b", "x/y", "100%", "~"}
+	encodings := []KeyEncoding{KeyEncodingBase64, KeyEncodingBase32, KeyEncodingHex, KeyEncodingPercent, KeyEncodingReadable}
+	for _, e := range encodings {
+		names := map[string]string{}
+		for _, key := range keys {
+			name := e.EncodeKey([]byte(key))
+			if strings.HasPrefix(name, ".") || strings.HasPrefix(name, hashedNamePrefix) || strings.Contains(name, "/") {
+				t.Errorf("%s name of %q is %q", e, key, name)
+			}
+			if got, err := e.DecodeKey(name); err != nil || string(got) != key {
+				t.Errorf("%s DecodeKey(%q) = %q, %v; want %q", e, name, got, err, key)
+			}
+			if e == KeyEncodingBase64 || e == KeyEncodingReadable {
+				continue
+			}
+			folded := strings.ToLower(name)
+			if other, ok := names[folded]; ok {
+				t.Errorf("%s names of %q and %q differ only in case", e, key, other)
+			}
+			names[folded] = key
+		}
+	}
+	for _, tc := range []struct {
+		encoding KeyEncoding
+		name     string
+	}{
+		{KeyEncodingBase32, "MFRGG"},
+		{KeyEncodingHex, "AB"},
+		{KeyEncodingPercent, "%61"},
+		{KeyEncodingPercent, "A"},
+		{KeyEncodingPercent, "%6"},
+		{KeyEncodingReadable, "%41"},
+		{KeyEncodingReadable, "%2F"},
+	} {
+		if key, err := tc.encoding.DecodeKey(tc.name); err == nil {
+			t.Errorf("%s DecodeKey(%q) = %q; want an error", tc.encoding, tc.name, key)
+		}
+	}
+}
+
+func TestKeyEncodingOnCaseInsensitiveFileSystem(t *testing.T) {
+	for _, tc := range []struct {
+		encoding KeyEncoding
+		want     string
+	}{
+		// "abc" and "\xcb\x08\xe3" are "YWJj" and "ywjj" in base64.
+		{KeyEncodingBase64, "value2"},
+		{KeyEncodingHex, "value1"},
+	} {
+		option := TableOption{
+			BaseDirectory: "/test-table",
+			FileSystem:    filesystem.NewCaseInsensitiveMemoryFileSystem(),
+			KeyEncoding:   tc.encoding,
+		}
+		tbl, err := Create(option)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tbl.Put([]byte("abc"), []byte("value1"))
+		tbl.Put([]byte("\xcb\x08\xe3"), []byte("value2"))
+		if value, err := tbl.Get([]byte("abc")); err != nil || string(value) != tc.want {
+			t.Errorf("%s Get() = %q, %v; want %s", tc.encoding, value, err, tc.want)
+		}
+		tbl.Close()
+		option.KeyEncoding = KeyEncodingPercent
+		if _, err := Open(option); err != ErrOptionMismatch {
+			t.Errorf("Open() with another key encoding: got %v; want ErrOptionMismatch", err)
+		}
+	}
+}
+
+func ExampleKeyEncoding_EncodeKey() {
+	fmt.Println(KeyEncodingReadable.EncodeKey([]byte("user/Alice.json")))
+	fmt.Println(KeyEncodingReadable.EncodeKey([]byte(".profile")))
+	// Output:
+	// user%2fAlice.json
+	// %2eprofile
+}
@@ -0,0 +1,56 @@
+package table
+
+import "testing"
+
+func TestTableLock(t *testing.T) {
+	for name, newOption := range fileSystems {
+		t.Run(name, func(t *testing.T) {
+			option := newOption(t)
+			readOnlyOption := option
+			readOnlyOption.ReadOnly = true
+
+			writer, err := Create(option)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := Open(option); err != ErrTableLocked {
+				t.Errorf("second writer: got %v; want ErrTableLocked", err)
+			}
+			if _, err := Open(readOnlyOption); err != ErrTableLocked {
+				t.Errorf("reader while writing: got %v; want ErrTableLocked", err)
+			}
+			if err := writer.Put([]byte("key"), []byte("value")); err != nil {
+				t.Fatal(err)
+			}
+			if err := writer.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			reader1, err := Open(readOnlyOption)
+			if err != nil {
+				t.Fatal(err)
+			}
+			reader2, err := Open(readOnlyOption)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if value, err := reader2.Get([]byte("key")); err != nil || string(value) != "value" {
+				t.Errorf("Get() = %q, %v; want value", value, err)
+			}
+			if err := reader2.Put([]byte("key"), []byte("value2")); err != ErrReadOnly {
+				t.Errorf("Put() on read-only table: got %v; want ErrReadOnly", err)
+			}
+			if _, err := Open(option); err != ErrTableLocked {
+				t.Errorf("writer while reading: got %v; want ErrTableLocked", err)
+			}
+			reader1.Close()
+			reader2.Close()
+
+			writer, err = Open(option)
+			if err != nil {
+				t.Fatal(err)
+			}
+			writer.Close()
+		})
+	}
+}
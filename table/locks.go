@@ -0,0 +1,67 @@
+package table
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+// numKeyLocks is the number of lock stripes of a table. Keys are
+// hashed onto the stripes, so different keys rarely contend.
+const numKeyLocks = 256
+
+// keyLocks is a striped lock for the keys of a table. Writers of a
+// key hold the write lock of its stripe for the whole
+// read-modify-write cycle, so concurrent Puts of the same key are
+// serialized and no snapshot is lost.
+type keyLocks struct {
+	stripes [numKeyLocks]sync.RWMutex
+}
+
+// stripe returns the index of the stripe for the key.
+func stripe(key []byte) int {
+	h := fnv.New32a()
+	h.Write(key)
+	return int(h.Sum32() % numKeyLocks)
+}
+
+// of returns the lock of the stripe for the key.
+func (l *keyLocks) of(key []byte) *sync.RWMutex {
+	return &l.stripes[stripe(key)]
+}
+
+// lockKeys acquires the write locks of the stripes for the keys in the
+// order of the stripes, so that it can't deadlock with another
+// lockKeys, and returns a function releasing them.
+func (l *keyLocks) lockKeys(keys [][]byte) (unlock func()) {
+	var locked [numKeyLocks]bool
+	for _, key := range keys {
+		locked[stripe(key)] = true
+	}
+	for i := range l.stripes {
+		if locked[i] {
+			l.stripes[i].Lock()
+		}
+	}
+	return func() {
+		for i := range l.stripes {
+			if locked[i] {
+				l.stripes[i].Unlock()
+			}
+		}
+	}
+}
+
+// lockAll acquires the write locks of all stripes, excluding every
+// reader and writer of the table.
+func (l *keyLocks) lockAll() {
+	for i := range l.stripes {
+		l.stripes[i].Lock()
+	}
+}
+
+// unlockAll releases the locks acquired by lockAll.
+func (l *keyLocks) unlockAll() {
+	for i := range l.stripes {
+		l.stripes[i].Unlock()
+	}
+}
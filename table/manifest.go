@@ -0,0 +1,165 @@
+package table
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/jaeyeom/gofiletable/filesystem"
+)
+
+// manifestFileName is the name of the manifest file in the table
+// directory.
+const manifestFileName = ".manifest"
+
+// manifestFormatVersion is the latest format version of tables
+// written by this package.
+const manifestFormatVersion = 1
+
+// Manifest describes how a table is stored. It is written as JSON to
+// the table directory when the table is created, so the table is
+// always opened with the options it was created with.
+type Manifest struct {
+	FormatVersion int         `json:"format_version"`
+	KeepSnapshots bool        `json:"keep_snapshots"`
+	KeyEncoding   KeyEncoding `json:"key_encoding"`
+	CreatedAt     time.Time   `json:"created_at"`
+
+	// NameKeyID is the ID of the encryption key of the key file
+	// names, if they are encrypted.
+	NameKeyID string `json:"name_key_id,omitempty"`
+
+	// LongKeyNames is the scheme of the names of the key files
+	// whose names are too long, or empty if they are not shortened.
+	// Only "sha256" is supported, which names them by the hash of
+	// the name and records the name in the file header.
+	LongKeyNames string `json:"long_key_names,omitempty"`
+
+	// ShardLevels is the number of levels of subdirectories the key
+	// files are spread over. While Reshard moves the key files,
+	// Resharding is set and the files not moved yet are still in the
+	// layout with ReshardFrom levels.
+	ShardLevels int  `json:"shard_levels,omitempty"`
+	Resharding  bool `json:"resharding,omitempty"`
+	ReshardFrom int  `json:"reshard_from,omitempty"`
+}
+
+// ReadManifest reads the manifest of the table in baseDirectory. If
+// fileSystem is nil, the OS file system is used. An error satisfying
+// os.IsNotExist is returned if the table has no manifest.
+func ReadManifest(fileSystem FileSystem, baseDirectory string) (*Manifest, error) {
+	if fileSystem == nil {
+		fileSystem = filesystem.OSFileSystem
+	}
+	f, err := fileSystem.Open(filepath.Join(baseDirectory, manifestFileName))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	buf, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	manifest := &Manifest{}
+	if err := json.Unmarshal(buf, manifest); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// currentManifest reads the manifest of the table. For tables created
+// before manifests were introduced, the manifest describing them is
+// returned.
+func (tbl Table) currentManifest() (*Manifest, error) {
+	manifest, err := ReadManifest(tbl.fileSystem, tbl.baseDirectory)
+	if os.IsNotExist(err) {
+		return &Manifest{
+			FormatVersion: manifestFormatVersion,
+			KeepSnapshots: tbl.keepSnapshots,
+			KeyEncoding:   tbl.keyEncoding,
+			CreatedAt:     tbl.clock.Now(),
+		}, nil
+	}
+	return manifest, err
+}
+
+// manifestPath returns the path of the manifest file.
+func (tbl Table) manifestPath() string {
+	return filepath.Join(tbl.baseDirectory, manifestFileName)
+}
+
+// writeManifest atomically writes the manifest to path, which is
+// usually the manifest path of the table.
+func (tbl Table) writeManifest(path string, manifest *Manifest) error {
+	buf, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return tbl.writeFile(path, func(w io.Writer) error {
+		_, err := w.Write(append(buf, '\n'))
+		return err
+	})
+}
+
+// loadManifest reads the manifest of the table and applies it to
+// tbl. Tables without a manifest are left as they are, with the
+// base64 key encoding unless the option selects another one.
+func (tbl *Table) loadManifest() error {
+	manifest, err := ReadManifest(tbl.fileSystem, tbl.baseDirectory)
+	if os.IsNotExist(err) {
+		if tbl.keyEncoding == "" {
+			tbl.keyEncoding = KeyEncodingBase64
+		}
+		return tbl.checkSnapshotOptions()
+	}
+	if err != nil {
+		return err
+	}
+	if manifest.FormatVersion > manifestFormatVersion || !manifest.KeyEncoding.valid() {
+		return ErrUnsupportedFormat
+	}
+	if tbl.keyEncoding != "" && tbl.keyEncoding != manifest.KeyEncoding {
+		return ErrOptionMismatch
+	}
+	tbl.keyEncoding = manifest.KeyEncoding
+	switch manifest.LongKeyNames {
+	case "":
+	case longKeyNamesSHA256:
+		tbl.hashLongNames = true
+	default:
+		return ErrUnsupportedFormat
+	}
+	if manifest.ShardLevels < 0 || manifest.ShardLevels > maxShardLevels ||
+		manifest.ReshardFrom < 0 || manifest.ReshardFrom > maxShardLevels {
+		return ErrUnsupportedFormat
+	}
+	tbl.layout.set(manifest.ShardLevels, manifest.ReshardFrom, manifest.Resharding)
+	if tbl.adoptManifest {
+		tbl.keepSnapshots = manifest.KeepSnapshots
+	} else if manifest.KeepSnapshots != tbl.keepSnapshots {
+		return ErrOptionMismatch
+	}
+	if err := tbl.checkSnapshotOptions(); err != nil {
+		return err
+	}
+	encryptNames := tbl.encryption != nil && tbl.encryption.EncryptNames
+	if (manifest.NameKeyID != "") != encryptNames {
+		return ErrOptionMismatch
+	}
+	if encryptNames {
+		return tbl.loadNameCipher(manifest.NameKeyID)
+	}
+	return nil
+}
+
+// checkSnapshotOptions returns ErrSnapshotsDisabled if the table has a
+// codec or encryption but doesn't keep snapshots.
+func (tbl *Table) checkSnapshotOptions() error {
+	if (tbl.codec != nil || tbl.encryption != nil) && !tbl.keepSnapshots {
+		return ErrSnapshotsDisabled
+	}
+	return nil
+}
@@ -0,0 +1,296 @@
+package table
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// migrateDir is the directory in the table where Migrate stages the
+// converted key files.
+const migrateDir = ".migrate"
+
+// migrateStagedName is the name of the file in migrateDir that marks
+// the staging as complete. It is written after the staged manifest, so
+// a marked staging directory without a staged manifest means that the
+// manifest was switched.
+const migrateStagedName = ".staged"
+
+// Migrate converts the table described by option in place between the
+// plain and the snapshot layout. The table is stored as its manifest
+// records, and keepSnapshots is how it should be stored. The layout of
+// tables without a manifest is detected from their key files, and
+// KeepSnapshots of option is only used for those without any. Plain
+// values become a single snapshot stamped with the modification time
+// of their file, and snapshot histories are collapsed to their latest
+// value; keys without any snapshot become empty values.
+//
+// The table is opened exclusively for the migration, so it must not
+// be open elsewhere. The converted files are staged in the table
+// directory, the staging is marked complete, and the manifest is
+// switched in one step, after which they are moved into place. If the
+// migration is interrupted, Recover either rolls it back or completes
+// it. Tables with encrypted key file names can't be converted to the
+// plain layout, and neither can tables with keys stored under hashed
+// names, for which ErrKeyTooLong is returned.
+func Migrate(option TableOption, keepSnapshots bool) error {
+	current := newTable(option)
+	if _, err := ReadManifest(current.fileSystem, current.baseDirectory); os.IsNotExist(err) {
+		if option.KeepSnapshots, err = current.detectLayout(); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+	option.AdoptManifest = true
+	tbl, err := Open(option)
+	if err != nil {
+		return err
+	}
+	defer tbl.Close()
+	if tbl.keepSnapshots == keepSnapshots {
+		return nil
+	}
+	return tbl.migrate(keepSnapshots)
+}
+
+// migrate stages the converted key files, switches the manifest and
+// moves the staged files into place.
+func (tbl *Table) migrate(keepSnapshots bool) error {
+	if !keepSnapshots && tbl.names != nil {
+		// Plain tables can't be encrypted, so the names couldn't
+		// be decrypted anymore.
+		return ErrSnapshotsDisabled
+	}
+	tbl.locks.lockAll()
+	defer tbl.locks.unlockAll()
+	if err := tbl.batches.check(); err != nil {
+		return err
+	}
+	if !keepSnapshots && tbl.hashLongNames {
+		// Plain files have no header to record the long names in.
+		err := tbl.walkKeyFiles(func(path string, info os.FileInfo) error {
+			if strings.HasPrefix(info.Name(), hashedNamePrefix) {
+				return ErrKeyTooLong
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	staging := filepath.Join(tbl.baseDirectory, migrateDir)
+	if err := tbl.fileSystem.RemoveAll(staging); err != nil {
+		return err
+	}
+	if err := tbl.fileSystem.MkdirAll(staging, 0700); err != nil {
+		return err
+	}
+	err := tbl.walkKeyFiles(func(path string, info os.FileInfo) error {
+		rel, err := filepath.Rel(tbl.baseDirectory, path)
+		if err != nil {
+			return err
+		}
+		staged := filepath.Join(staging, rel)
+		if err := tbl.fileSystem.MkdirAll(filepath.Dir(staged), 0700); err != nil {
+			return err
+		}
+		if keepSnapshots {
+			return tbl.stageSnapshotFile(path, info.ModTime(), staged)
+		}
+		return tbl.stagePlainFile(path, staged)
+	})
+	if err != nil {
+		return err
+	}
+	manifest, err := tbl.currentManifest()
+	if err != nil {
+		return err
+	}
+	manifest.KeepSnapshots = keepSnapshots
+	stagedManifest := filepath.Join(staging, manifestFileName)
+	if err := tbl.writeManifest(stagedManifest, manifest); err != nil {
+		return err
+	}
+	err = tbl.writeFile(filepath.Join(staging, migrateStagedName), func(w io.Writer) error {
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// Switching the manifest commits the migration.
+	if err := tbl.fileSystem.Rename(stagedManifest, tbl.manifestPath()); err != nil {
+		return err
+	}
+	if err := tbl.fileSystem.Sync(tbl.baseDirectory); err != nil {
+		return err
+	}
+	tbl.keepSnapshots = keepSnapshots
+	return tbl.finishMigration()
+}
+
+// stageSnapshotFile writes the plain value at path to staged as a
+// snapshot file with a single snapshot stamped with modTime.
+func (tbl Table) stageSnapshotFile(path string, modTime time.Time, staged string) error {
+	f, err := tbl.fileSystem.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	value, err := ioutil.ReadAll(f)
+	if err != nil {
+		return err
+	}
+	key, err := tbl.pathKey(path)
+	if err != nil {
+		return err
+	}
+	info, err := tbl.stamp(modTime, len(value))
+	if err != nil {
+		return err
+	}
+	snapshot, err := tbl.encode(key, Snapshot{Info: info, Value: value})
+	if err != nil {
+		return err
+	}
+	// Plain tables have no long names.
+	return tbl.writeSnapshots(staged, fileHeader{}, []storedSnapshot{snapshot})
+}
+
+// stagePlainFile writes the latest value of the snapshot file at path
+// to staged as a plain file.
+func (tbl Table) stagePlainFile(path string, staged string) error {
+	sf, err := tbl.openSnapshots(path)
+	if err != nil {
+		return err
+	}
+	defer sf.Close()
+	var value []byte
+	last, err := sf.Last()
+	if err == nil {
+		value, err = tbl.value(sf, last)
+	}
+	if err != nil && err != ErrNoSnapshots {
+		return err
+	}
+	return tbl.writeFile(staged, func(w io.Writer) error {
+		_, err := w.Write(value)
+		return err
+	})
+}
+
+// finishMigration moves the files staged by a committed migration into
+// place and removes the staging directory.
+func (tbl Table) finishMigration() error {
+	staging := filepath.Join(tbl.baseDirectory, migrateDir)
+	var staged []string
+	walkFunc := func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && !isReservedName(info.Name()) {
+			staged = append(staged, path)
+		}
+		return nil
+	}
+	if err := tbl.fileSystem.Walk(staging, walkFunc); err != nil {
+		return err
+	}
+	for _, path := range staged {
+		rel, err := filepath.Rel(staging, path)
+		if err != nil {
+			return err
+		}
+		if err := tbl.fileSystem.Rename(path, filepath.Join(tbl.baseDirectory, rel)); err != nil {
+			return err
+		}
+	}
+	if err := tbl.fileSystem.Sync(tbl.baseDirectory); err != nil {
+		return err
+	}
+	return tbl.fileSystem.RemoveAll(staging)
+}
+
+// recoverMigration rolls back a migration that was interrupted before
+// the manifest was switched, including one whose staging wasn't
+// complete, and completes one that was interrupted after.
+func (tbl Table) recoverMigration() error {
+	staging := filepath.Join(tbl.baseDirectory, migrateDir)
+	if _, err := tbl.fileSystem.Stat(staging); os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	_, err := tbl.fileSystem.Stat(filepath.Join(staging, migrateStagedName))
+	if os.IsNotExist(err) {
+		return tbl.fileSystem.RemoveAll(staging)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = tbl.fileSystem.Stat(filepath.Join(staging, manifestFileName))
+	if err == nil {
+		return tbl.fileSystem.RemoveAll(staging)
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+	return tbl.finishMigration()
+}
+
+// detectLayout returns true if the key files of the table, which has
+// no manifest, are snapshot files. A plain value may happen to look
+// like a snapshot file, so all the key files must be well-formed
+// snapshot files. Tables without key files are taken to be stored as
+// the option of tbl tells.
+func (tbl Table) detectLayout() (bool, error) {
+	found := false
+	snapshots := true
+	err := tbl.walkKeyFiles(func(path string, info os.FileInfo) error {
+		found = true
+		ok, err := tbl.isSnapshotFile(path)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			snapshots = false
+			return filepath.SkipAll
+		}
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	if !found {
+		return tbl.keepSnapshots, nil
+	}
+	return snapshots, nil
+}
+
+// isSnapshotFile returns true if the file at path starts with the
+// magic of version 2 snapshot files, or is a version 1 snapshot file
+// whose values fill the rest of the file exactly.
+func (tbl Table) isSnapshotFile(path string) (bool, error) {
+	sf, err := tbl.openSnapshots(path)
+	if _, ok := err.(*CorruptError); ok {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer sf.Close()
+	if sf.version == 2 {
+		return true, nil
+	}
+	_, end, err := sf.scan()
+	if _, ok := err.(*CorruptError); ok {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return end == sf.size, nil
+}
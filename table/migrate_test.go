@@ -0,0 +1,141 @@
+package table
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jaeyeom/gofiletable/filesystem"
+)
+
+func TestMigrate(t *testing.T) {
+	mfs := filesystem.NewMemoryFileSystem()
+	plain := TableOption{BaseDirectory: "/test-table", FileSystem: mfs, KeepSnapshots: false}
+	snapshots := TableOption{BaseDirectory: "/test-table", FileSystem: mfs, KeepSnapshots: true}
+	tbl, err := Create(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tbl.Put([]byte("key1"), []byte("value1"))
+	tbl.Put([]byte("key2"), []byte("value2"))
+	tbl.Close()
+
+	if err := Migrate(plain, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(plain); err != ErrOptionMismatch {
+		t.Errorf("Open() as plain after migration: got %v; want ErrOptionMismatch", err)
+	}
+	tbl, err = Open(snapshots)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, cerr := tbl.GetSnapshots([]byte("key1"))
+	var history []*Snapshot
+	for snapshot := range c {
+		history = append(history, snapshot)
+	}
+	if err := <-cerr; err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 1 || string(history[0].Value) != "value1" || history[0].Info.Timestamp == 0 {
+		t.Errorf("unexpected history after migration: %v", history)
+	}
+	tbl.Put([]byte("key1"), []byte("value1-2"))
+	tbl.Close()
+
+	if err := Migrate(snapshots, false); err != nil {
+		t.Fatal(err)
+	}
+	tbl, err = Open(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tbl.Close()
+	for key, want := range map[string]string{"key1": "value1-2", "key2": "value2"} {
+		if value, err := tbl.Get([]byte(key)); err != nil || string(value) != want {
+			t.Errorf("Get(%s) = %q, %v; want %q", key, value, err, want)
+		}
+	}
+}
+
+func TestRecoverMigration(t *testing.T) {
+	examples := []struct {
+		name      string
+		staged    bool // Whether the staging was marked complete
+		committed bool // Whether the manifest was switched
+	}{
+		{"crash during staging", false, false},
+		{"crash before the switch", true, false},
+		{"crash after the switch", true, true},
+	}
+	for _, example := range examples {
+		mfs := filesystem.NewMemoryFileSystem()
+		tbl, err := Create(TableOption{BaseDirectory: "/test-table", FileSystem: mfs, KeepSnapshots: false})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tbl.Put([]byte("key"), []byte("value"))
+		// Simulate a crash after staging the converted file.
+		staging := filepath.Join("/test-table", migrateDir)
+		mfs.MkdirAll(staging, 0700)
+		snapshotTable := newTable(TableOption{BaseDirectory: "/test-table", FileSystem: mfs, KeepSnapshots: true})
+		snapshotTable.stageSnapshotFile(filepath.Join("/test-table", string(encodeKey([]byte("key")))), time.Unix(0, 1), filepath.Join(staging, string(encodeKey([]byte("key")))))
+		manifest, _ := ReadManifest(mfs, "/test-table")
+		manifest.KeepSnapshots = true
+		if example.committed {
+			tbl.writeManifest(tbl.manifestPath(), manifest)
+		} else if example.staged {
+			tbl.writeManifest(filepath.Join(staging, manifestFileName), manifest)
+		}
+		if example.staged {
+			mfs.WriteFile(filepath.Join(staging, migrateStagedName), nil, 0600)
+		}
+		tbl.Close()
+
+		tbl, err = Open(TableOption{BaseDirectory: "/test-table", FileSystem: mfs, AdoptManifest: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tbl.keepSnapshots != example.committed {
+			t.Errorf("%s: keepSnapshots = %v; want %v", example.name, tbl.keepSnapshots, example.committed)
+		}
+		if value, err := tbl.Get([]byte("key")); err != nil || string(value) != "value" {
+			t.Errorf("%s: Get() = %q, %v; want value", example.name, value, err)
+		}
+		if _, err := mfs.Stat(staging); err == nil {
+			t.Errorf("%s: staging directory is left behind", example.name)
+		}
+		tbl.Close()
+	}
+}
+
+func TestMigrateDetectsLayout(t *testing.T) {
+	for _, keepSnapshots := range []bool{false, true} {
+		mfs := filesystem.NewMemoryFileSystem()
+		tbl, err := Create(TableOption{BaseDirectory: "/test-table", FileSystem: mfs, KeepSnapshots: keepSnapshots})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tbl.Put([]byte("key"), []byte("value"))
+		tbl.Close()
+		// Tables created before manifests were introduced have none.
+		mfs.Remove("/test-table/" + manifestFileName)
+
+		// The option tells the target layout, not the current one.
+		if err := Migrate(TableOption{BaseDirectory: "/test-table", FileSystem: mfs, KeepSnapshots: !keepSnapshots}, !keepSnapshots); err != nil {
+			t.Fatal(err)
+		}
+		tbl, err = Open(TableOption{BaseDirectory: "/test-table", FileSystem: mfs, AdoptManifest: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tbl.keepSnapshots == keepSnapshots {
+			t.Errorf("keepSnapshots = %v after migrating from it", tbl.keepSnapshots)
+		}
+		if value, err := tbl.Get([]byte("key")); err != nil || string(value) != "value" {
+			t.Errorf("keepSnapshots=%v: Get() = %q, %v; want value", keepSnapshots, value, err)
+		}
+		tbl.Close()
+	}
+}
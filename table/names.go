@@ -0,0 +1,81 @@
+package table
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// longKeyNamesSHA256 is the name of the scheme that stores keys whose
+// file names are too long under the SHA-256 hash of the name.
+const longKeyNamesSHA256 = "sha256"
+
+// hashedNamePrefix starts the hashed file names and the names of the
+// shard subdirectories. No key encoding produces it, so these names
+// can't be mistaken for encoded keys.
+const hashedNamePrefix = "~"
+
+// maxNameLength is the longest file name that is used as it is. It is
+// the limit of most file systems.
+const maxNameLength = 255
+
+// hashedName returns the hashed file name for the long file name.
+func hashedName(name string) string {
+	sum := sha256.Sum256([]byte(name))
+	return hashedNamePrefix + hex.EncodeToString(sum[:])
+}
+
+// fileName returns the name of the file of the key. If the name of
+// the key is too long and the table hashes long names, the hashed name
+// is returned with the full name, which must be recorded in the file
+// header. Otherwise longName is empty.
+func (tbl Table) fileName(key []byte) (name, longName string) {
+	name = tbl.keyName(key)
+	if tbl.hashLongNames && len(name) > maxNameLength {
+		return hashedName(name), name
+	}
+	return name, ""
+}
+
+// pathKey returns the key of the key file at path. The key of a file
+// with a hashed name is read from the file header. An error matching
+// ErrInvalidKeyName is returned if the file name doesn't belong to a
+// key.
+func (tbl Table) pathKey(path string) ([]byte, error) {
+	name := filepath.Base(path)
+	if tbl.hashLongNames && strings.HasPrefix(name, hashedNamePrefix) {
+		var err error
+		if name, err = tbl.readLongName(path); err != nil {
+			return nil, err
+		}
+		if hashedName(name) != filepath.Base(path) {
+			return nil, fmt.Errorf("%w: header name %q doesn't match the hash", ErrInvalidKeyName, name)
+		}
+	}
+	key, err := tbl.nameKey(name)
+	if err != nil {
+		return nil, ErrInvalidKeyName
+	}
+	return key, nil
+}
+
+// readLongName reads the full file name recorded in the header of the
+// key file at path.
+func (tbl Table) readLongName(path string) (string, error) {
+	f, err := tbl.fileSystem.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	size, err := tbl.fileSize(path, f)
+	if err != nil {
+		return "", err
+	}
+	sf, err := openSnapshotFile(f, size, nil)
+	if err != nil {
+		return "", err
+	}
+	return sf.header.name, nil
+}
@@ -0,0 +1,101 @@
+package table
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jaeyeom/gofiletable/filesystem"
+)
+
+func TestLongKeys(t *testing.T) {
+	mfs := filesystem.NewMemoryFileSystem()
+	option := TableOption{BaseDirectory: "/test-table", FileSystem: mfs, KeepSnapshots: true}
+	tbl, err := Create(option)
+	if err != nil {
+		t.Fatal(err)
+	}
+	longKey := []byte(strings.Repeat("long key ", 100))
+	tbl.Put(longKey, []byte("value1"))
+	tbl.Put(longKey, []byte("value2"))
+	tbl.Put([]byte("short"), []byte("value"))
+	if value, err := tbl.Get(longKey); err != nil || string(value) != "value2" {
+		t.Errorf("Get() = %q, %v; want value2", value, err)
+	}
+	snapshots, errc := tbl.GetSnapshots(longKey)
+	n := 0
+	for range snapshots {
+		n++
+	}
+	if err := <-errc; err != nil || n != 2 {
+		t.Errorf("GetSnapshots() got %d snapshots, %v; want 2", n, err)
+	}
+	got := map[string]bool{}
+	for key := range tbl.Keys() {
+		got[string(key)] = true
+	}
+	if len(got) != 2 || !got[string(longKey)] || !got["short"] {
+		t.Errorf("Keys() = %v; want the long key and short", got)
+	}
+	tbl.walkKeyFiles(func(path string, info os.FileInfo) error {
+		if len(info.Name()) > maxNameLength {
+			t.Errorf("file name %s is too long", info.Name())
+		}
+		return nil
+	})
+	if name := filepath.Base(tbl.keyPath(longKey)); !strings.HasPrefix(name, hashedNamePrefix) {
+		t.Errorf("long key stored as %s; want a hashed name", name)
+	}
+	report, err := tbl.Verify(context.Background())
+	if err != nil || len(report.Problems) != 0 || report.Keys != 2 {
+		t.Errorf("Verify() = %+v, %v; want 2 keys without problems", report, err)
+	}
+	tbl.Close()
+	if err := Migrate(option, false); err != ErrKeyTooLong {
+		t.Errorf("Migrate() to plain: got %v; want ErrKeyTooLong", err)
+	}
+	if _, err := mfs.Stat(filepath.Join("/test-table", migrateDir)); !os.IsNotExist(err) {
+		t.Errorf("Migrate() left the staging directory: %v", err)
+	}
+}
+
+func TestLongKeysInLegacyTable(t *testing.T) {
+	mfs := filesystem.NewMemoryFileSystem()
+	option := TableOption{BaseDirectory: "/test-table", FileSystem: mfs, KeepSnapshots: true}
+	tbl, err := Create(option)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tbl.Close()
+	manifest, err := ReadManifest(mfs, "/test-table")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.LongKeyNames != longKeyNamesSHA256 {
+		t.Errorf("LongKeyNames = %q; want %q", manifest.LongKeyNames, longKeyNamesSHA256)
+	}
+	manifest.LongKeyNames = ""
+	tbl.writeManifest(tbl.manifestPath(), manifest)
+	tbl, err = Open(option)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tbl.Close()
+	longKey := []byte(strings.Repeat("long key ", 100))
+	if name := filepath.Base(tbl.keyPath(longKey)); name != string(encodeKey(longKey)) {
+		t.Errorf("long key of a legacy table stored as %s; want the encoded key", name)
+	}
+}
+
+func TestPlainTableRejectsLongKeys(t *testing.T) {
+	tbl, err := Create(TableOption{BaseDirectory: "/test-table", FileSystem: filesystem.NewMemoryFileSystem()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tbl.Close()
+	if err := tbl.Put([]byte(strings.Repeat("long key ", 100)), []byte("value")); err != ErrKeyTooLong {
+		t.Errorf("Put() = %v; want ErrKeyTooLong", err)
+	}
+}
@@ -0,0 +1,222 @@
+package table
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// lostAndFoundDir is the subdirectory of the table where Recover
+// moves key files that can't be repaired.
+const lostAndFoundDir = "lost+found"
+
+// RecoveryReport describes what Recover did to bring the table back
+// to a consistent state. All paths are the paths before the action.
+type RecoveryReport struct {
+	// RemovedTempFiles are temporary files of interrupted writes
+	// that were deleted.
+	RemovedTempFiles []string
+
+	// Repaired are key files truncated to the last complete
+	// snapshot.
+	Repaired []string
+
+	// Quarantined are key files moved into the lost+found
+	// subdirectory because no complete snapshot could be read.
+	Quarantined []string
+
+	// Corrupt are the errors of key files with a corrupt snapshot
+	// before their end, which are left as they are for Repair.
+	Corrupt []*CorruptError
+
+	// ReplayedBatches are directories of committed batches whose
+	// writes were finished.
+	ReplayedBatches []string
+
+	// DiscardedBatches are directories of batches interrupted before
+	// they were committed, which were removed.
+	DiscardedBatches []string
+}
+
+// Recover creates the table directory if it doesn't exist and scans
+// it for files left inconsistent by a crash. An interrupted Migrate
+// is rolled back, or completed if it got as far as switching the
+// manifest. The writes of an interrupted Batch commit are finished
+// if the batch was committed, and discarded otherwise. Temporary
+// files of interrupted writes are removed. If the table keeps
+// snapshots, key files whose last snapshot is incomplete, as left by
+// an interrupted append, are truncated to the last complete snapshot,
+// and key files without a readable header or complete snapshot are
+// moved into the lost+found subdirectory. Other corruption, such as a
+// checksum mismatch in the middle of a file, is only reported, since
+// truncating would drop the good snapshots after it. Recover waits
+// for ongoing reads and writes and blocks new ones until it finishes.
+func (tbl Table) Recover() (*RecoveryReport, error) {
+	if tbl.readOnly {
+		return nil, ErrReadOnly
+	}
+	tbl.locks.lockAll()
+	defer tbl.locks.unlockAll()
+	if err := tbl.fileSystem.MkdirAll(tbl.baseDirectory, 0700); err != nil {
+		return nil, err
+	}
+	if err := tbl.recoverMigration(); err != nil {
+		return nil, err
+	}
+	report := &RecoveryReport{}
+	var err error
+	report.ReplayedBatches, report.DiscardedBatches, err = tbl.recoverBatches()
+	if err != nil {
+		return nil, err
+	}
+	var temps []string
+	keyFiles := map[string]int64{}
+	// Removal markers are written like key files, so the temporary
+	// files of interrupted removals are in their directory.
+	markers := tbl.markerDirectory()
+	walkFunc := func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			name := info.Name()
+			if path != filepath.Clean(tbl.baseDirectory) && path != markers && (name == lostAndFoundDir || isReservedName(name)) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if strings.HasPrefix(info.Name(), tempFilePrefix) {
+			temps = append(temps, path)
+		} else if !isReservedName(info.Name()) && !strings.HasPrefix(path, markers+string(filepath.Separator)) {
+			keyFiles[path] = info.Size()
+		}
+		return nil
+	}
+	if err := tbl.fileSystem.Walk(tbl.baseDirectory, walkFunc); err != nil {
+		return nil, err
+	}
+	for _, path := range temps {
+		if err := tbl.fileSystem.Remove(path); err != nil {
+			return nil, err
+		}
+		report.RemovedTempFiles = append(report.RemovedTempFiles, path)
+	}
+	if !tbl.keepSnapshots {
+		return report, nil
+	}
+	paths := make([]string, 0, len(keyFiles))
+	for path := range keyFiles {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		if err := tbl.recoverKeyFile(path, keyFiles[path], report); err != nil {
+			return nil, err
+		}
+	}
+	return report, nil
+}
+
+// Recovery returns the report of the Recover run by Open, or nil if
+// the table was created or opened read-only.
+func (tbl Table) Recovery() *RecoveryReport {
+	return tbl.recovery
+}
+
+// recoverKeyFile checks the snapshot file at path, whose size is
+// size, and repairs or quarantines it if it is incomplete. Only the
+// headers of the snapshots are read.
+func (tbl Table) recoverKeyFile(path string, size int64, report *RecoveryReport) error {
+	f, err := tbl.fileSystem.Open(path)
+	if err != nil {
+		return err
+	}
+	sf, err := openSnapshotFile(f, size, tbl.keyOfPath(path))
+	var records []record
+	if err == nil {
+		records, _, err = sf.scan()
+	}
+	if err == nil {
+		return f.Close()
+	}
+	corrupt, ok := err.(*CorruptError)
+	if !ok {
+		f.Close()
+		return err
+	}
+	if sf != nil && corrupt.Err != io.ErrUnexpectedEOF {
+		// Not a torn tail.
+		report.Corrupt = append(report.Corrupt, corrupt)
+		return f.Close()
+	}
+	quarantined, err := tbl.fixKeyFile(path, f, sf, records)
+	if quarantined {
+		report.Quarantined = append(report.Quarantined, path)
+	} else {
+		report.Repaired = append(report.Repaired, path)
+	}
+	return err
+}
+
+// fixKeyFile rewrites the snapshot file at path, which is opened as f
+// and sf, keeping only the given records from its start. If there are
+// none, the file is moved into the lost+found subdirectory instead,
+// and true is returned. f is closed.
+func (tbl Table) fixKeyFile(path string, f io.Closer, sf *snapshotFile, records []record) (bool, error) {
+	if len(records) == 0 {
+		f.Close()
+		return true, tbl.quarantine(path)
+	}
+	defer f.Close()
+	return false, tbl.truncateSnapshots(path, sf, records)
+}
+
+// truncateSnapshots rewrites the snapshot file at path, which is
+// opened as sf, keeping only the given records from its start.
+func (tbl Table) truncateSnapshots(path string, sf *snapshotFile, records []record) error {
+	end := sf.end(records[len(records)-1])
+	return tbl.writeFile(path, func(w io.Writer) error {
+		if sf.version == 1 {
+			header := &Header{ByteSize: 16}
+			for _, rec := range records {
+				header.Snapshots = append(header.Snapshots, rec.Info)
+			}
+			if _, err := header.WriteTo(w); err != nil {
+				return err
+			}
+			_, err := io.Copy(w, io.NewSectionReader(sf.at, sf.start, end-sf.start))
+			return err
+		}
+		_, err := io.Copy(w, io.NewSectionReader(sf.at, 0, end))
+		return err
+	})
+}
+
+// quarantine moves the file at path into the lost+found
+// subdirectory, choosing a new name if the file name is taken there.
+func (tbl Table) quarantine(path string) error {
+	dir := filepath.Join(tbl.baseDirectory, lostAndFoundDir)
+	if err := tbl.fileSystem.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	name := filepath.Base(path)
+	target := filepath.Join(dir, name)
+	for i := 1; ; i++ {
+		f, err := tbl.fileSystem.Open(target)
+		if os.IsNotExist(err) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		f.Close()
+		target = filepath.Join(dir, fmt.Sprintf("%s.%d", name, i))
+	}
+	if err := tbl.fileSystem.Rename(path, target); err != nil {
+		return err
+	}
+	return tbl.fileSystem.Sync(dir)
+}
@@ -0,0 +1,98 @@
+package table
+
+import (
+	"bytes"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/jaeyeom/gofiletable/filesystem"
+)
+
+func TestRecover(t *testing.T) {
+	mfs := filesystem.NewMemoryFileSystem()
+	tbl, err := Create(TableOption{BaseDirectory: "/test-table", FileSystem: mfs, KeepSnapshots: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pathOf := func(key string) string {
+		return filepath.Join("/test-table", string(encodeKey([]byte(key))))
+	}
+	tbl.Put([]byte("good"), []byte("value"))
+	tbl.PutSnapshots([]byte("torn"), []Snapshot{{
+		Info:  SnapshotInfo{Timestamp: 100, ByteSize: 6},
+		Value: []byte("first!"),
+	}, {
+		Info:  SnapshotInfo{Timestamp: 200, ByteSize: 6},
+		Value: []byte("second"),
+	}})
+	// Cut the last snapshot of the torn file in half.
+	var buf bytes.Buffer
+	(&Header{16, []SnapshotInfo{{Timestamp: 100, ByteSize: 6}, {Timestamp: 200, ByteSize: 6}}}).WriteTo(&buf)
+	buf.WriteString("first!sec")
+	mfs.WriteFile(pathOf("torn"), buf.Bytes(), 0600)
+	mfs.WriteFile(pathOf("garbage"), []byte{0x7f}, 0600)
+	temp := filepath.Join("/test-table", tempFilePrefix+"0123456789abcdef")
+	mfs.WriteFile(temp, []byte("partial"), 0600)
+
+	report, err := tbl.Recover()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &RecoveryReport{
+		RemovedTempFiles: []string{temp},
+		Repaired:         []string{pathOf("torn")},
+		Quarantined:      []string{pathOf("garbage")},
+	}
+	if !reflect.DeepEqual(report, want) {
+		t.Errorf("Recover() = %+v; want %+v", report, want)
+	}
+	if value, err := tbl.Get([]byte("torn")); err != nil || string(value) != "first!" {
+		t.Errorf(`Get("torn") = %q, %v; want "first!"`, value, err)
+	}
+	if value, err := tbl.Get([]byte("good")); err != nil || string(value) != "value" {
+		t.Errorf(`Get("good") = %q, %v; want "value"`, value, err)
+	}
+	if _, err := mfs.Open(filepath.Join("/test-table", lostAndFoundDir, string(encodeKey([]byte("garbage"))))); err != nil {
+		t.Errorf("garbage is not in lost+found: %v", err)
+	}
+	var keys []string
+	for key := range tbl.Keys() {
+		keys = append(keys, string(key))
+	}
+	if want := []string{"good", "torn"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("Keys() = %v; want %v", keys, want)
+	}
+}
+
+func TestRecoverLeavesCorruption(t *testing.T) {
+	mfs := filesystem.NewMemoryFileSystem()
+	option := TableOption{BaseDirectory: "/test-table", FileSystem: mfs, KeepSnapshots: true}
+	tbl, err := Create(option)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, value := range []string{"first", "second", "third"} {
+		tbl.Put([]byte("flipped"), []byte(value))
+	}
+	tbl.Close()
+	// Break the fields checksum of the record in the middle, which is
+	// right before its value.
+	flipped := tbl.keyPath([]byte("flipped"))
+	content := []byte(readFile(t, mfs, flipped))
+	content[bytes.Index(content, []byte("second"))-1] ^= 0x01
+	mfs.WriteFile(flipped, content, 0600)
+
+	tbl, err = Open(option)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tbl.Close()
+	report := tbl.Recovery()
+	if report == nil || len(report.Corrupt) != 1 || report.Corrupt[0].Index != 1 || len(report.Repaired) != 0 {
+		t.Errorf("Recovery() = %+v; want snapshot 1 of flipped to be reported as corrupt", report)
+	}
+	if got := readFile(t, mfs, flipped); got != string(content) {
+		t.Errorf("flipped was changed by Open")
+	}
+}
@@ -0,0 +1,253 @@
+package table
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// removedDirName is the directory of the table holding the removal
+// markers of the keys removed from a table keeping snapshots. A marker
+// is named like the key file it replaces, laid out in the same shard
+// subdirectories, and records the last removal of the key and the
+// range of the sequence numbers of the snapshots removed with it, so
+// that read views created before the removal can tell that the key is
+// gone. Markers are kept when the key is written again, until Compact
+// prunes them.
+const removedDirName = ".removed"
+
+// prunedFileName is the name of the file in the removal marker
+// directory that records the latest removal of the markers pruned by
+// Compact, written like a marker.
+const prunedFileName = ".pruned"
+
+// markerDirectory returns the directory of the removal markers.
+func (tbl Table) markerDirectory() string {
+	return filepath.Join(tbl.baseDirectory, removedDirName)
+}
+
+// markerPath returns the path of the removal marker of the key file
+// with the name.
+func (tbl Table) markerPath(name string) string {
+	return tbl.locate(tbl.markerDirectory(), name)
+}
+
+// readMarker returns the header of the removal marker of the key file
+// with the name. It is zero if the key was never removed.
+func (tbl Table) readMarker(name string) (fileHeader, error) {
+	sf, err := tbl.openSnapshots(tbl.markerPath(name))
+	if os.IsNotExist(err) {
+		return fileHeader{}, nil
+	}
+	if err != nil {
+		return fileHeader{}, err
+	}
+	defer sf.Close()
+	return sf.header, nil
+}
+
+// removal returns the removal marker of the key file with the name for
+// a removal of the key now, whose removed snapshots have sequence
+// numbers from first on. The sequence numbers removed earlier are
+// kept.
+func (tbl Table) removal(name, longName string, first uint64) (fileHeader, error) {
+	old, err := tbl.readMarker(name)
+	if err != nil {
+		return fileHeader{}, err
+	}
+	info, err := tbl.stamp(tbl.clock.Now(), 0)
+	if err != nil {
+		return fileHeader{}, err
+	}
+	lost := old.lost
+	if first != 0 {
+		lost = lost.add(first).add(info.Sequence - 1)
+	}
+	return fileHeader{name: longName, lost: lost, removed: info}, nil
+}
+
+// firstSequence returns the first sequence number of the history of a
+// key file with the header and the records, or 1 if it is not known.
+func firstSequence(header fileHeader, records []record) uint64 {
+	first := header.lost.first
+	for _, rec := range records {
+		seq := rec.Info.Sequence
+		if seq == 0 {
+			// Written before sequence numbers, at any point.
+			return 1
+		}
+		if first == 0 || seq < first {
+			first = seq
+		}
+	}
+	if first == 0 {
+		return 1
+	}
+	return first
+}
+
+// writeMarker writes the removal marker to path.
+func (tbl Table) writeMarker(path string, marker fileHeader) error {
+	if err := tbl.fileSystem.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return tbl.writeSnapshots(path, marker, nil)
+}
+
+// removeKeyFile removes the file of the key at path. If the table
+// keeps snapshots, the removal marker of the key is written first. A
+// not exist error is returned if there is no file. The caller must
+// hold the lock of the key.
+func (tbl Table) removeKeyFile(key []byte, path string) error {
+	if !tbl.keepSnapshots {
+		return tbl.fileSystem.Remove(path)
+	}
+	first := uint64(1)
+	sf, err := tbl.openSnapshots(path)
+	if err == nil {
+		records, err := sf.Records()
+		sf.Close()
+		if err == nil {
+			first = firstSequence(sf.header, records)
+		} else if !errors.Is(err, ErrCorrupt) {
+			return err
+		}
+	} else if !errors.Is(err, ErrCorrupt) {
+		return err
+	}
+	name, longName := tbl.fileName(key)
+	marker, err := tbl.removal(name, longName, first)
+	if err != nil {
+		return err
+	}
+	if err := tbl.writeMarker(tbl.markerPath(name), marker); err != nil {
+		return err
+	}
+	return tbl.fileSystem.Remove(path)
+}
+
+// walkMarkers calls fn for each removal marker in the table.
+func (tbl Table) walkMarkers(fn func(path string) error) error {
+	dir := tbl.markerDirectory()
+	walkFunc := func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) && path == dir {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if path != dir && isReservedName(info.Name()) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if isReservedName(info.Name()) {
+			return nil
+		}
+		return fn(path)
+	}
+	return tbl.fileSystem.Walk(dir, walkFunc)
+}
+
+// prunedRemoval returns the latest removal of the markers pruned from
+// the table, which is zero if none was.
+func (tbl Table) prunedRemoval() (SnapshotInfo, error) {
+	sf, err := tbl.openSnapshots(filepath.Join(tbl.markerDirectory(), prunedFileName))
+	if os.IsNotExist(err) {
+		return SnapshotInfo{}, nil
+	}
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+	defer sf.Close()
+	return sf.header.removed, nil
+}
+
+// pruneMarkers removes the removal markers that no open read view of
+// the table needs, which are those of removals every view sees, and
+// returns how many there were. If dryRun is true, they are only
+// counted. The latest pruned removal is recorded first, so that views
+// behind it, such as views of other processes, report keys they don't
+// see as expired instead.
+func (tbl Table) pruneMarkers(dryRun bool) (int, error) {
+	horizon, err := tbl.stableSequence()
+	if err != nil {
+		return 0, err
+	}
+	if cut, ok := tbl.views.min(); ok && cut < horizon {
+		horizon = cut
+	}
+	var paths []string
+	var pruned SnapshotInfo
+	err = tbl.walkMarkers(func(path string) error {
+		sf, err := tbl.openSnapshots(path)
+		if os.IsNotExist(err) || errors.Is(err, ErrCorrupt) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		defer sf.Close()
+		if removed := sf.header.removed; removed.Sequence <= horizon {
+			paths = append(paths, path)
+			if removed.Sequence > pruned.Sequence {
+				pruned = removed
+			}
+		}
+		return nil
+	})
+	if err != nil || dryRun || len(paths) == 0 {
+		return len(paths), err
+	}
+	if old, err := tbl.prunedRemoval(); err != nil {
+		return 0, err
+	} else if pruned.Sequence > old.Sequence {
+		marker := fileHeader{removed: pruned}
+		if err := tbl.writeMarker(filepath.Join(tbl.markerDirectory(), prunedFileName), marker); err != nil {
+			return 0, err
+		}
+	}
+	count := 0
+	for _, path := range paths {
+		ok, err := tbl.pruneMarker(path, horizon)
+		if err != nil {
+			return count, err
+		}
+		if ok {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// pruneMarker removes the removal marker at path if its removal
+// sequence number is not after horizon, and returns true if it did.
+func (tbl Table) pruneMarker(path string, horizon uint64) (bool, error) {
+	key, err := tbl.pathKey(path)
+	if os.IsNotExist(err) || errors.Is(err, ErrInvalidKeyName) || errors.Is(err, ErrCorrupt) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	lock := tbl.locks.of(key)
+	lock.Lock()
+	defer lock.Unlock()
+	if err := tbl.batches.check(); err != nil {
+		return false, err
+	}
+	// The key may have been removed again since it was listed.
+	name, _ := tbl.fileName(key)
+	if tbl.markerPath(name) != path {
+		return false, nil
+	}
+	marker, err := tbl.readMarker(name)
+	if err != nil || marker.removed.Sequence == 0 || marker.removed.Sequence > horizon {
+		return false, err
+	}
+	if err := tbl.fileSystem.Remove(path); err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,218 @@
+package table
+
+import (
+	"context"
+	"os"
+	"sort"
+	"time"
+)
+
+// RetentionPolicy decides which snapshots of a key are kept.
+type RetentionPolicy interface {
+	// Retain returns whether each of the snapshots, which are in
+	// the order they were written, should be kept at time now.
+	// The latest snapshot is always kept regardless of the result.
+	Retain(snapshots []SnapshotInfo, now time.Time) []bool
+}
+
+// keepLast keeps the last n snapshots.
+type keepLast int
+
+// KeepLast returns a retention policy that keeps the last n snapshots
+// of each key.
+func KeepLast(n int) RetentionPolicy {
+	return keepLast(n)
+}
+
+func (n keepLast) Retain(snapshots []SnapshotInfo, now time.Time) []bool {
+	retain := make([]bool, len(snapshots))
+	for i := range snapshots {
+		retain[i] = i >= len(snapshots)-int(n)
+	}
+	return retain
+}
+
+// keepFor keeps snapshots younger than the duration.
+type keepFor time.Duration
+
+// KeepFor returns a retention policy that keeps the snapshots written
+// within d. The latest snapshot is kept however old it is.
+func KeepFor(d time.Duration) RetentionPolicy {
+	return keepFor(d)
+}
+
+func (d keepFor) Retain(snapshots []SnapshotInfo, now time.Time) []bool {
+	retain := make([]bool, len(snapshots))
+	for i, snapshot := range snapshots {
+		retain[i] = now.Sub(snapshotTime(snapshot)) < time.Duration(d)
+	}
+	return retain
+}
+
+// Tier is a tier of KeepTiered. One snapshot is kept per Interval
+// among the snapshots younger than Period.
+type Tier struct {
+	Interval time.Duration
+	Period   time.Duration
+}
+
+// keepTiered keeps snapshots thinned out by their age.
+type keepTiered []Tier
+
+// KeepTiered returns a retention policy that keeps fewer snapshots as
+// they get older. Each snapshot belongs to the tier with the shortest
+// Period longer than its age, and the latest snapshot in each
+// Interval of the tier is kept. Snapshots older than every Period are
+// dropped. For example, the tiers {time.Hour, 24 * time.Hour} and
+// {24 * time.Hour, 30 * 24 * time.Hour} keep one snapshot per hour for
+// a day and one per day for a month.
+func KeepTiered(tiers ...Tier) RetentionPolicy {
+	sorted := append(keepTiered(nil), tiers...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Period < sorted[j].Period
+	})
+	return sorted
+}
+
+func (tiers keepTiered) Retain(snapshots []SnapshotInfo, now time.Time) []bool {
+	type bucket struct {
+		tier   int
+		bucket int64
+	}
+	retain := make([]bool, len(snapshots))
+	seen := map[bucket]bool{}
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		t := snapshotTime(snapshots[i])
+		age := now.Sub(t)
+		for j, tier := range tiers {
+			if age >= tier.Period {
+				continue
+			}
+			b := bucket{j, t.UnixNano()}
+			if tier.Interval > 0 {
+				b.bucket = t.UnixNano() / int64(tier.Interval)
+			}
+			retain[i] = !seen[b]
+			seen[b] = true
+			break
+		}
+	}
+	return retain
+}
+
+// snapshotTime returns the time when the snapshot was written.
+func snapshotTime(info SnapshotInfo) time.Time {
+	return time.Unix(0, int64(info.Timestamp))
+}
+
+// retainInfos returns which of the snapshots described by infos are
+// kept by the policy, or nil if all of them are kept. The latest
+// snapshot is always kept.
+func retainInfos(policy RetentionPolicy, infos []SnapshotInfo, now time.Time) []bool {
+	if policy == nil || len(infos) == 0 {
+		return nil
+	}
+	retain := policy.Retain(infos, now)
+	retain[len(retain)-1] = true
+	for _, r := range retain {
+		if !r {
+			return retain
+		}
+	}
+	return nil
+}
+
+// CompactionReport describes what Compact did, or would do in a dry
+// run.
+type CompactionReport struct {
+	Keys             int    // Number of keys examined
+	CompactedKeys    int    // Number of keys that lost snapshots
+	RemovedSnapshots int    // Number of snapshots removed
+	ReclaimedBytes   uint64 // Total byte size of the removed values
+	PrunedMarkers    int    // Number of removal markers pruned
+}
+
+// Compact applies the retention policy of the table to all keys and
+// prunes the removal markers that no open read view needs. If dryRun
+// is true, nothing is written and the report tells what would be
+// removed; a dry run is allowed on a read-only table.
+// ErrSnapshotsDisabled is returned if the table doesn't keep
+// snapshots.
+func (tbl Table) Compact(dryRun bool) (*CompactionReport, error) {
+	if !tbl.keepSnapshots {
+		return nil, ErrSnapshotsDisabled
+	}
+	if tbl.readOnly && !dryRun {
+		return nil, ErrReadOnly
+	}
+	report := &CompactionReport{}
+	now := tbl.clock.Now()
+	var keys [][]byte
+	for key, err := range tbl.IterKeys(context.Background()) {
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	for _, key := range keys {
+		if err := tbl.compactKey(key, now, dryRun, report); err != nil {
+			return nil, err
+		}
+	}
+	var err error
+	if report.PrunedMarkers, err = tbl.pruneMarkers(dryRun); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// compactKey applies the retention policy to the key.
+func (tbl Table) compactKey(key []byte, now time.Time, dryRun bool, report *CompactionReport) error {
+	lock := tbl.locks.of(key)
+	lock.Lock()
+	defer lock.Unlock()
+	if !dryRun {
+		if err := tbl.batches.check(); err != nil {
+			return err
+		}
+	}
+	path := tbl.keyPath(key)
+	header, snapshots, err := tbl.readKeyFile(path)
+	if os.IsNotExist(err) {
+		// Removed since it was listed.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	report.Keys++
+	infos := make([]SnapshotInfo, len(snapshots))
+	for i, snapshot := range snapshots {
+		infos[i] = snapshot.Info
+	}
+	retain := retainInfos(tbl.retention, infos, now)
+	if retain == nil {
+		return nil
+	}
+	var kept []storedSnapshot
+	for i, snapshot := range snapshots {
+		if retain[i] {
+			kept = append(kept, snapshot)
+		} else {
+			header.lost = header.lost.add(snapshot.Info.Sequence)
+		}
+	}
+	report.CompactedKeys++
+	report.RemovedSnapshots += len(snapshots) - len(kept)
+	for _, snapshot := range snapshots {
+		report.ReclaimedBytes += snapshot.Info.ByteSize
+	}
+	for _, snapshot := range kept {
+		report.ReclaimedBytes -= snapshot.Info.ByteSize
+	}
+	if dryRun {
+		return nil
+	}
+	_, header.name = tbl.fileName(key)
+	return tbl.writeSnapshots(path, header, kept)
+}
@@ -0,0 +1,93 @@
+package table
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jaeyeom/gofiletable/filesystem"
+)
+
+func TestRetentionPolicies(t *testing.T) {
+	now := time.Date(2020, 1, 31, 12, 0, 0, 0, time.UTC)
+	ago := func(d time.Duration) SnapshotInfo {
+		return SnapshotInfo{Timestamp: uint64(now.Add(-d).UnixNano()), ByteSize: 1}
+	}
+	snapshots := []SnapshotInfo{
+		ago(40 * 24 * time.Hour),
+		ago(3*24*time.Hour + time.Hour),
+		ago(3 * 24 * time.Hour),
+		ago(2 * 24 * time.Hour),
+		ago(5 * time.Hour),
+		ago(2*time.Hour + 20*time.Minute),
+		ago(2*time.Hour + 10*time.Minute),
+		ago(30 * time.Minute),
+	}
+	examples := []struct {
+		policy RetentionPolicy
+		want   []bool
+	}{{
+		KeepLast(3),
+		[]bool{false, false, false, false, false, true, true, true},
+	}, {
+		KeepFor(24 * time.Hour),
+		[]bool{false, false, false, false, true, true, true, true},
+	}, {
+		KeepTiered(Tier{24 * time.Hour, 30 * 24 * time.Hour}, Tier{time.Hour, 24 * time.Hour}),
+		[]bool{false, false, true, true, true, false, true, true},
+	}}
+	for i, e := range examples {
+		if got := e.policy.Retain(snapshots, now); !reflect.DeepEqual(got, e.want) {
+			t.Errorf("%d. Retain() = %v; want %v", i, got, e.want)
+		}
+	}
+}
+
+func TestCompact(t *testing.T) {
+	mfs := filesystem.NewMemoryFileSystem()
+	tbl, err := Create(TableOption{BaseDirectory: "/test-table", FileSystem: mfs, KeepSnapshots: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"key1", "key2"} {
+		for _, value := range []string{"a", "bb", "ccc", "dddd"} {
+			tbl.Put([]byte(key), []byte(value))
+		}
+	}
+	tbl.Close()
+	tbl, err = Open(TableOption{BaseDirectory: "/test-table", FileSystem: mfs, KeepSnapshots: true, Retention: KeepLast(2)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tbl.Close()
+	want := &CompactionReport{Keys: 2, CompactedKeys: 2, RemovedSnapshots: 4, ReclaimedBytes: 6}
+	for _, dryRun := range []bool{true, false} {
+		report, err := tbl.Compact(dryRun)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(report, want) {
+			t.Errorf("Compact(%v) = %+v; want %+v", dryRun, report, want)
+		}
+	}
+	var values []string
+	c, cerr := tbl.GetSnapshots([]byte("key1"))
+	for snapshot := range c {
+		values = append(values, string(snapshot.Value))
+	}
+	if err := <-cerr; err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"ccc", "dddd"}; !reflect.DeepEqual(values, want) {
+		t.Errorf("snapshots after Compact() = %v; want %v", values, want)
+	}
+	tbl.Put([]byte("key1"), []byte("eeeee"))
+	values = nil
+	c, cerr = tbl.GetSnapshots([]byte("key1"))
+	for snapshot := range c {
+		values = append(values, string(snapshot.Value))
+	}
+	if want := []string{"dddd", "eeeee"}; !reflect.DeepEqual(values, want) {
+		t.Errorf("snapshots after Put() = %v; want %v", values, want)
+	}
+}
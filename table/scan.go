@@ -0,0 +1,124 @@
+package table
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"sort"
+)
+
+// ScanOption stores options for scanning keys.
+type ScanOption struct {
+	// Reverse returns the keys in descending order.
+	Reverse bool
+
+	// Limit is the most keys returned. If it is zero, all keys in
+	// the range are returned.
+	Limit int
+
+	// Values reads the latest value of each key.
+	Values bool
+}
+
+// ScanItem is a key found by a scan.
+type ScanItem struct {
+	Key []byte
+
+	// Value is the latest value of the key if the values are read.
+	// It is nil if the key has no snapshots.
+	Value []byte
+}
+
+// Scan returns the keys from start inclusive to end exclusive in
+// lexicographic byte order. A nil start or end leaves the range
+// unbounded on that side. The file names don't keep the order of the
+// keys, so all key files are listed on each scan, and files whose
+// names don't belong to keys are skipped; Verify reports them. Keys
+// removed during the scan may be left out.
+func (tbl Table) Scan(start, end []byte, option ScanOption) ([]ScanItem, error) {
+	var get func(key []byte) ([]byte, error)
+	if option.Values {
+		get = tbl.Get
+	}
+	return tbl.scan(start, end, option, false, get)
+}
+
+// scan returns the keys in the range like Scan, along with the keys
+// with removal markers if removed is true. If get is not nil, it reads
+// the value of each key, and keys for which it returns a not exist
+// error are left out.
+func (tbl Table) scan(start, end []byte, option ScanOption, removed bool, get func(key []byte) ([]byte, error)) ([]ScanItem, error) {
+	var keys [][]byte
+	addKey := func(path string) error {
+		key, err := tbl.pathKey(path)
+		if os.IsNotExist(err) || errors.Is(err, ErrInvalidKeyName) || errors.Is(err, ErrCorrupt) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if bytes.Compare(key, start) >= 0 && (end == nil || bytes.Compare(key, end) < 0) {
+			keys = append(keys, key)
+		}
+		return nil
+	}
+	err := tbl.walkKeyFiles(func(path string, info os.FileInfo) error {
+		return addKey(path)
+	})
+	if err == nil && removed {
+		err = tbl.walkMarkers(addKey)
+	}
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return (bytes.Compare(keys[i], keys[j]) < 0) != option.Reverse
+	})
+	var items []ScanItem
+	for i, key := range keys {
+		if i > 0 && bytes.Equal(key, keys[i-1]) {
+			// Both removed and written again.
+			continue
+		}
+		if option.Limit > 0 && len(items) == option.Limit {
+			break
+		}
+		item := ScanItem{Key: key}
+		if get != nil {
+			value, err := get(key)
+			if os.IsNotExist(err) {
+				// Removed since it was listed.
+				continue
+			}
+			if err != nil && err != ErrNoSnapshots {
+				return nil, err
+			}
+			if option.Values {
+				item.Value = value
+			}
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// ScanPrefix returns the keys starting with the prefix in
+// lexicographic byte order, like Scan.
+func (tbl Table) ScanPrefix(prefix []byte, option ScanOption) ([]ScanItem, error) {
+	return tbl.Scan(prefix, PrefixEnd(prefix), option)
+}
+
+// PrefixEnd returns the end of the Scan range of the keys starting
+// with the prefix, which is the first key after all of them, or nil if
+// there is none. The next page of a scan in ascending order starts
+// right after its last key, at the key with a zero byte appended.
+func PrefixEnd(prefix []byte) []byte {
+	end := append([]byte(nil), prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package table
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/jaeyeom/gofiletable/filesystem"
+)
+
+func TestScan(t *testing.T) {
+	tbl, err := Create(TableOption{
+		BaseDirectory: "/test-table",
+		FileSystem:    filesystem.NewMemoryFileSystem(),
+		KeepSnapshots: true,
+		KeyEncoding:   KeyEncodingReadable,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tbl.Close()
+	for _, key := range []string{"b", "a/2", "a/10", "a/1", "a\xff", "c"} {
+		tbl.Put([]byte(key), []byte("value-"+key))
+	}
+	keysOf := func(items []ScanItem) []string {
+		var keys []string
+		for _, item := range items {
+			keys = append(keys, string(item.Key))
+		}
+		return keys
+	}
+	examples := []struct {
+		start, end []byte
+		option     ScanOption
+		want       []string
+	}{
+		{nil, nil, ScanOption{}, []string{"a/1", "a/10", "a/2", "a\xff", "b", "c"}},
+		{[]byte("a/10"), []byte("b"), ScanOption{}, []string{"a/10", "a/2", "a\xff"}},
+		{[]byte("b"), nil, ScanOption{Reverse: true}, []string{"c", "b"}},
+		{nil, nil, ScanOption{Reverse: true, Limit: 2}, []string{"c", "b"}},
+	}
+	for i, e := range examples {
+		items, err := tbl.Scan(e.start, e.end, e.option)
+		if err != nil || !reflect.DeepEqual(keysOf(items), e.want) {
+			t.Errorf("example %d: Scan() = %q, %v; want %q", i, keysOf(items), err, e.want)
+		}
+	}
+	items, err := tbl.ScanPrefix([]byte("a/"), ScanOption{Limit: 2, Values: true})
+	if err != nil || !reflect.DeepEqual(keysOf(items), []string{"a/1", "a/10"}) {
+		t.Errorf("ScanPrefix() = %q, %v; want [a/1 a/10]", keysOf(items), err)
+	}
+	for _, item := range items {
+		if string(item.Value) != "value-"+string(item.Key) {
+			t.Errorf("value of %q = %q", item.Key, item.Value)
+		}
+	}
+	items, err = tbl.ScanPrefix([]byte("a\xff"), ScanOption{})
+	if err != nil || !reflect.DeepEqual(keysOf(items), []string{"a\xff"}) {
+		t.Errorf("ScanPrefix(a\\xff) = %q, %v; want [a\\xff]", keysOf(items), err)
+	}
+}
@@ -0,0 +1,222 @@
+package table
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sequenceFileName is the name of the file in the table directory
+// recording the end of the sequence numbers leased to writers.
+const sequenceFileName = ".sequence"
+
+// sequenceLease is how many sequence numbers are leased at a time, so
+// that the sequence file is written once per that many snapshots.
+// Numbers leased but not used before the table is closed are skipped.
+const sequenceLease = 1024
+
+// Clock tells the wall time of new snapshots.
+type Clock interface {
+	Now() time.Time
+}
+
+// systemClock is the Clock of the system.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// sequencer hands out the sequence numbers of the table. It is shared
+// by the copies of a Table.
+type sequencer struct {
+	mu     sync.Mutex
+	loaded bool   // Whether the sequence file has been read
+	next   uint64 // Next sequence number
+	leased uint64 // End of the leased sequence numbers
+}
+
+// sequencePath returns the path of the sequence file.
+func (tbl Table) sequencePath() string {
+	return filepath.Join(tbl.baseDirectory, sequenceFileName)
+}
+
+// loadSequence reads the sequence file, unless it was read already.
+// Tables without one, such as those written before sequence numbers
+// were introduced or whose sequence file was lost, start after the
+// greatest sequence number stored in the key files, so that numbers
+// are not reused. The caller must hold the lock of the sequencer.
+func (tbl Table) loadSequence() error {
+	s := tbl.sequences
+	if s.loaded {
+		return nil
+	}
+	f, err := tbl.fileSystem.Open(tbl.sequencePath())
+	if os.IsNotExist(err) {
+		stored, err := tbl.storedSequence()
+		if err != nil {
+			return err
+		}
+		s.next, s.leased, s.loaded = stored+1, stored+1, true
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	buf, err := ioutil.ReadAll(f)
+	if err != nil {
+		return err
+	}
+	leased, err := strconv.ParseUint(strings.TrimSpace(string(buf)), 10, 64)
+	if err != nil {
+		return fmt.Errorf("gofiletable: invalid sequence file: %v", err)
+	}
+	s.next, s.leased, s.loaded = leased, leased, true
+	return nil
+}
+
+// storedSequence returns the greatest sequence number stored in the
+// key files and the removal markers of the table, including the
+// record of the pruned markers. Corrupt key files are skipped, since
+// Recover deals with them.
+func (tbl Table) storedSequence() (uint64, error) {
+	var stored uint64
+	observe := func(seq uint64) {
+		if seq > stored {
+			stored = seq
+		}
+	}
+	readFile := func(path string) error {
+		sf, err := tbl.openSnapshots(path)
+		if err == nil {
+			defer sf.Close()
+			observe(sf.header.lost.last)
+			observe(sf.header.removed.Sequence)
+			var records []record
+			if records, err = sf.Records(); err == nil {
+				for _, rec := range records {
+					observe(rec.Info.Sequence)
+				}
+			}
+		}
+		if _, ok := err.(*CorruptError); ok || os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	err := tbl.walkKeyFiles(func(path string, info os.FileInfo) error {
+		return readFile(path)
+	})
+	if err == nil {
+		err = tbl.walkMarkers(readFile)
+	}
+	if err == nil {
+		err = readFile(filepath.Join(tbl.markerDirectory(), prunedFileName))
+	}
+	return stored, err
+}
+
+// nextSequence returns the next sequence number of the table. A new
+// lease is recorded in the sequence file before the number is handed
+// out, so numbers are never reused, even after a crash.
+func (tbl Table) nextSequence() (uint64, error) {
+	s := tbl.sequences
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := tbl.loadSequence(); err != nil {
+		return 0, err
+	}
+	if err := tbl.renewLease(); err != nil {
+		return 0, err
+	}
+	seq := s.next
+	s.next++
+	return seq, nil
+}
+
+// observeSequence makes sure that the sequence numbers handed out
+// from now on, even after the table is opened again, are greater than
+// seq, which is stored in the table.
+func (tbl Table) observeSequence(seq uint64) error {
+	s := tbl.sequences
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := tbl.loadSequence(); err != nil {
+		return err
+	}
+	if seq >= s.next {
+		s.next = seq + 1
+	}
+	return tbl.renewLease()
+}
+
+// renewLease records a new lease in the sequence file if the next
+// sequence number is not leased. The caller must hold the lock of the
+// sequencer.
+func (tbl Table) renewLease() error {
+	s := tbl.sequences
+	if s.next < s.leased {
+		return nil
+	}
+	leased := s.next + sequenceLease
+	err := tbl.writeFile(tbl.sequencePath(), func(w io.Writer) error {
+		_, err := fmt.Fprintln(w, leased)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	s.leased = leased
+	return nil
+}
+
+// stamp returns the info of a new snapshot of the value size written
+// at now, with the next sequence number.
+func (tbl Table) stamp(now time.Time, size int) (SnapshotInfo, error) {
+	seq, err := tbl.nextSequence()
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+	return SnapshotInfo{Timestamp: timestamp(now), ByteSize: uint64(size), Sequence: seq}, nil
+}
+
+// sequenceSnapshots gives new sequence numbers to the snapshots
+// without one, in order. The sequence numbers of the others are kept
+// and observed.
+func (tbl Table) sequenceSnapshots(snapshots []Snapshot) error {
+	for i := range snapshots {
+		var err error
+		if seq := snapshots[i].Info.Sequence; seq != 0 {
+			err = tbl.observeSequence(seq)
+		} else {
+			snapshots[i].Info.Sequence, err = tbl.nextSequence()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stableSequence returns the greatest sequence number such that all
+// the snapshots with sequence numbers up to it have been written or
+// will never be. Sequence numbers are handed out under the locks of
+// the keys, so the ongoing writes are waited for.
+func (tbl Table) stableSequence() (uint64, error) {
+	tbl.locks.lockAll()
+	defer tbl.locks.unlockAll()
+	s := tbl.sequences
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := tbl.loadSequence(); err != nil {
+		return 0, err
+	}
+	return s.next - 1, nil
+}
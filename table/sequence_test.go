@@ -0,0 +1,139 @@
+package table
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jaeyeom/gofiletable/filesystem"
+)
+
+// fakeClock is a Clock that tells the time it is set to.
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+// infos returns the infos of the snapshots of the key.
+func infos(t *testing.T, tbl *Table, key string) []SnapshotInfo {
+	var infos []SnapshotInfo
+	for snapshot, err := range tbl.IterSnapshots(context.Background(), []byte(key)) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		infos = append(infos, snapshot.Info)
+	}
+	return infos
+}
+
+func TestSequenceClockStepsBack(t *testing.T) {
+	clock := &fakeClock{time.Unix(0, 200)}
+	tbl, err := Create(TableOption{BaseDirectory: "/test-table", FileSystem: filesystem.NewMemoryFileSystem(), KeepSnapshots: true, Clock: clock})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tbl.Put([]byte("key"), []byte("first"))
+	clock.now = time.Unix(0, 100)
+	tbl.Put([]byte("key"), []byte("second"))
+	tbl.Put([]byte("other"), []byte("third"))
+
+	got := infos(t, tbl, "key")
+	if len(got) != 2 || got[0].Timestamp != 200 || got[1].Timestamp != 100 || got[1].Sequence <= got[0].Sequence {
+		t.Errorf("snapshots = %+v, want in the order written with increasing sequences", got)
+	}
+	if other := infos(t, tbl, "other"); other[0].Sequence <= got[1].Sequence {
+		t.Errorf("sequence of another key = %d, want after %d", other[0].Sequence, got[1].Sequence)
+	}
+	for _, at := range []int64{100, 200, 300} {
+		value, err := tbl.GetAt([]byte("key"), time.Unix(0, at))
+		if err != nil || string(value) != "second" {
+			t.Errorf("GetAt(%d) = %s, %v, want second", at, value, err)
+		}
+	}
+	report, err := tbl.Verify(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Problems) != 0 {
+		t.Errorf("Verify() found %v, want no problems", report.Problems)
+	}
+}
+
+func TestSequenceSameInstant(t *testing.T) {
+	clock := &fakeClock{time.Unix(0, 100)}
+	tbl, err := Create(TableOption{BaseDirectory: "/test-table", FileSystem: filesystem.NewMemoryFileSystem(), KeepSnapshots: true, Clock: clock})
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, _ := tbl.PutVersion([]byte("key"), []byte("first"))
+	tbl.Put([]byte("key"), []byte("second"))
+	if _, err := tbl.PutIf([]byte("key"), []byte("stale"), first); !errors.Is(err, ErrVersionMismatch) {
+		t.Errorf("PutIf() with the version of a write at the same instant error = %v, want %v", err, ErrVersionMismatch)
+	}
+}
+
+func TestSequencePersisted(t *testing.T) {
+	mfs := filesystem.NewMemoryFileSystem()
+	option := TableOption{BaseDirectory: "/test-table", FileSystem: mfs, KeepSnapshots: true}
+	tbl, err := Create(option)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tbl.Put([]byte("key"), []byte("first"))
+	tbl.PutSnapshots([]byte("imported"), []Snapshot{{Info: SnapshotInfo{Timestamp: 100, Sequence: 5000}, Value: []byte("old")}})
+	tbl.Close()
+
+	tbl, err = Open(option)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tbl.Close()
+	tbl.Put([]byte("key"), []byte("second"))
+	got := infos(t, tbl, "key")
+	if got[0].Sequence == 0 || got[1].Sequence <= 5000 {
+		t.Errorf("sequences = %d, %d, want after the imported 5000 across Open", got[0].Sequence, got[1].Sequence)
+	}
+}
+
+func TestSequenceFileLost(t *testing.T) {
+	mfs := filesystem.NewMemoryFileSystem()
+	option := TableOption{BaseDirectory: "/test-table", FileSystem: mfs, KeepSnapshots: true}
+	tbl, err := Create(option)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tbl.Put([]byte("key"), []byte("first"))
+	tbl.PutSnapshots([]byte("imported"), []Snapshot{{Info: SnapshotInfo{Timestamp: 100, Sequence: 5000}, Value: []byte("old")}})
+	tbl.Close()
+	if err := mfs.Remove("/test-table/" + sequenceFileName); err != nil {
+		t.Fatal(err)
+	}
+
+	tbl, err = Open(option)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tbl.Close()
+	tbl.Put([]byte("key"), []byte("second"))
+	if got := infos(t, tbl, "key"); got[1].Sequence <= 5000 {
+		t.Errorf("sequence after the sequence file was lost = %d, want after the stored 5000", got[1].Sequence)
+	}
+}
+
+func TestSequenceBeforeEpoch(t *testing.T) {
+	clock := &fakeClock{time.Unix(-100, 0)}
+	tbl, err := Create(TableOption{BaseDirectory: "/test-table", FileSystem: filesystem.NewMemoryFileSystem(), KeepSnapshots: true, Clock: clock})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tbl.Put([]byte("key"), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if got := infos(t, tbl, "key"); got[0].Timestamp != 0 {
+		t.Errorf("timestamp of a write before the epoch = %d, want 0", got[0].Timestamp)
+	}
+}
@@ -0,0 +1,252 @@
+package table
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// maxShardLevels is the most levels of subdirectories the key files
+// can be spread over. Each level has up to 256 subdirectories.
+const maxShardLevels = 3
+
+// shardLayout is the layout of the key files in subdirectories. It is
+// shared by the copies of a Table, since Reshard changes it.
+type shardLayout struct {
+	mu         sync.RWMutex
+	levels     int  // Levels of subdirectories of new key files
+	from       int  // Levels of the key files not moved yet
+	resharding bool // Whether key files are being moved
+}
+
+// get returns the layout.
+func (l *shardLayout) get() (levels, from int, resharding bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.levels, l.from, l.resharding
+}
+
+// set changes the layout.
+func (l *shardLayout) set(levels, from int, resharding bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.levels, l.from, l.resharding = levels, from, resharding
+}
+
+// isShardDir returns true if name is the name of a shard
+// subdirectory.
+func isShardDir(name string) bool {
+	if len(name) != 3 || !strings.HasPrefix(name, hashedNamePrefix) {
+		return false
+	}
+	_, err := hex.DecodeString(name[1:])
+	return err == nil
+}
+
+// shardPath returns the path of the file with the name in dir in the
+// layout with the levels of subdirectories, which are named after the
+// leading bytes of the SHA-256 hash of the name in hex, prefixed with
+// hashedNamePrefix.
+func shardPath(dir, name string, levels int) string {
+	sum := sha256.Sum256([]byte(name))
+	elems := []string{dir}
+	for i := 0; i < levels; i++ {
+		elems = append(elems, hashedNamePrefix+hex.EncodeToString(sum[i:i+1]))
+	}
+	return filepath.Join(append(elems, name)...)
+}
+
+// Reshard moves the key files and the removal markers of the table
+// into the layout with the levels of subdirectories, up to 3. The table stays usable while the
+// files are moved: new keys are written in the new layout, and keys
+// that haven't been moved yet are found in the old one. The layout is
+// recorded in the manifest before any file is moved, so if Reshard is
+// interrupted, the table keeps working with both layouts and running
+// Reshard again finishes the move. It stops early with the error of
+// ctx if ctx is done. Subdirectories left empty are removed.
+func (tbl Table) Reshard(ctx context.Context, levels int) error {
+	if tbl.readOnly {
+		return ErrReadOnly
+	}
+	if levels < 0 || levels > maxShardLevels {
+		return ErrInvalidShardLevels
+	}
+	current, _, resharding := tbl.layout.get()
+	if resharding && current != levels {
+		// The files may only be in two layouts at a time.
+		if err := tbl.Reshard(ctx, current); err != nil {
+			return err
+		}
+		resharding = false
+	}
+	if !resharding {
+		if current == levels {
+			return nil
+		}
+		if err := tbl.setLayout(levels, current, true); err != nil {
+			return err
+		}
+	}
+	// Files are moved while resharding, so they are listed first.
+	var paths, markers []string
+	err := tbl.walkKeyFiles(func(path string, info os.FileInfo) error {
+		paths = append(paths, path)
+		return nil
+	})
+	if err == nil {
+		err = tbl.walkMarkers(func(path string) error {
+			markers = append(markers, path)
+			return nil
+		})
+	}
+	if err != nil {
+		return err
+	}
+	for _, move := range []struct {
+		dir   string
+		paths []string
+	}{{tbl.baseDirectory, paths}, {tbl.markerDirectory(), markers}} {
+		for _, path := range move.paths {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := tbl.moveKeyFile(move.dir, path, levels); err != nil {
+				return err
+			}
+		}
+	}
+	if err := tbl.setLayout(levels, 0, false); err != nil {
+		return err
+	}
+	if err := tbl.removeEmptyShardDirs(tbl.baseDirectory, levels); err != nil {
+		return err
+	}
+	return tbl.removeEmptyShardDirs(tbl.markerDirectory(), levels)
+}
+
+// setLayout records the layout in the manifest and switches the table
+// to it. Ongoing reads and writes are waited for.
+func (tbl Table) setLayout(levels, from int, resharding bool) error {
+	tbl.locks.lockAll()
+	defer tbl.locks.unlockAll()
+	if err := tbl.batches.check(); err != nil {
+		return err
+	}
+	manifest, err := tbl.currentManifest()
+	if err != nil {
+		return err
+	}
+	manifest.ShardLevels = levels
+	manifest.ReshardFrom = from
+	manifest.Resharding = resharding
+	if err := tbl.writeManifest(tbl.manifestPath(), manifest); err != nil {
+		return err
+	}
+	tbl.layout.set(levels, from, resharding)
+	return nil
+}
+
+// reloadLayout reads the layout from the manifest again, since
+// another process may have resharded the table, and returns true if
+// it changed.
+func (tbl Table) reloadLayout() bool {
+	manifest, err := ReadManifest(tbl.fileSystem, tbl.baseDirectory)
+	if err != nil || manifest.ShardLevels < 0 || manifest.ShardLevels > maxShardLevels ||
+		manifest.ReshardFrom < 0 || manifest.ReshardFrom > maxShardLevels {
+		return false
+	}
+	levels, from, resharding := tbl.layout.get()
+	if manifest.ShardLevels == levels && manifest.ReshardFrom == from && manifest.Resharding == resharding {
+		return false
+	}
+	tbl.layout.set(manifest.ShardLevels, manifest.ReshardFrom, manifest.Resharding)
+	return true
+}
+
+// moveKeyFile moves the key file or removal marker at path in dir
+// into the layout with the levels of subdirectories. Files that don't
+// belong to a key are left for Verify to find.
+func (tbl Table) moveKeyFile(dir, path string, levels int) error {
+	key, err := tbl.pathKey(path)
+	if os.IsNotExist(err) {
+		// Removed since it was listed.
+		return nil
+	}
+	if errors.Is(err, ErrInvalidKeyName) || errors.Is(err, ErrCorrupt) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	lock := tbl.locks.of(key)
+	lock.Lock()
+	defer lock.Unlock()
+	if err := tbl.batches.check(); err != nil {
+		return err
+	}
+	dest := shardPath(dir, filepath.Base(path), levels)
+	if dest == path {
+		return nil
+	}
+	if err := tbl.fileSystem.MkdirAll(filepath.Dir(dest), 0700); err != nil {
+		return err
+	}
+	if _, err := tbl.fileSystem.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+	if err := tbl.fileSystem.Rename(path, dest); err != nil {
+		return err
+	}
+	if err := tbl.fileSystem.Sync(filepath.Dir(dest)); err != nil {
+		return err
+	}
+	return tbl.fileSystem.Sync(filepath.Dir(path))
+}
+
+// removeEmptyShardDirs removes the empty shard subdirectories of dir
+// deeper than the levels, which are not used by the layout.
+func (tbl Table) removeEmptyShardDirs(dir string, levels int) error {
+	base := filepath.Clean(dir)
+	var dirs []string
+	entries := map[string]int{}
+	walkFunc := func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) && path == base {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if path == base {
+			return nil
+		}
+		entries[filepath.Dir(path)]++
+		if info.IsDir() && !isShardDir(info.Name()) {
+			return filepath.SkipDir
+		}
+		if info.IsDir() && strings.Count(strings.TrimPrefix(path, base), string(filepath.Separator)) > levels {
+			dirs = append(dirs, path)
+		}
+		return nil
+	}
+	if err := tbl.fileSystem.Walk(base, walkFunc); err != nil {
+		return err
+	}
+	// Deeper directories first, so their parents may become empty.
+	sort.Slice(dirs, func(i, j int) bool { return len(dirs[i]) > len(dirs[j]) })
+	for _, dir := range dirs {
+		if entries[dir] > 0 {
+			continue
+		}
+		if err := tbl.fileSystem.Remove(dir); err != nil {
+			return err
+		}
+		entries[filepath.Dir(dir)]--
+	}
+	return nil
+}
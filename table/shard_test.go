@@ -0,0 +1,183 @@
+package table
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jaeyeom/gofiletable/filesystem"
+)
+
+// keyFileDepths returns the number of key files of the table at each
+// depth of subdirectories.
+func keyFileDepths(tbl *Table) map[int]int {
+	depths := map[int]int{}
+	tbl.walkKeyFiles(func(path string, info os.FileInfo) error {
+		rel, _ := filepath.Rel(tbl.baseDirectory, path)
+		depths[strings.Count(rel, string(filepath.Separator))]++
+		return nil
+	})
+	return depths
+}
+
+func TestShardLevels(t *testing.T) {
+	option := TableOption{
+		BaseDirectory: "/test-table",
+		FileSystem:    filesystem.NewMemoryFileSystem(),
+		KeepSnapshots: true,
+		ShardLevels:   2,
+	}
+	tbl, err := Create(option)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := []string{"a", "b", "c", "d"}
+	for _, key := range keys {
+		tbl.Put([]byte(key), []byte("value-"+key))
+	}
+	tbl.Remove([]byte("d"))
+	if depths := keyFileDepths(tbl); len(depths) != 1 || depths[2] != 3 {
+		t.Errorf("key files at depths %v; want 3 at depth 2", depths)
+	}
+	tbl.Close()
+	option.ShardLevels = 0
+	tbl, err = Open(option)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tbl.Close()
+	n := 0
+	for range tbl.Keys() {
+		n++
+	}
+	if n != 3 {
+		t.Errorf("Keys() returned %d keys; want 3", n)
+	}
+	for _, key := range keys[:3] {
+		if value, err := tbl.Get([]byte(key)); err != nil || string(value) != "value-"+key {
+			t.Errorf("Get(%q) = %q, %v; want value-%s", key, value, err, key)
+		}
+	}
+	if _, err := Create(TableOption{BaseDirectory: "/other", FileSystem: option.FileSystem, ShardLevels: 4}); err != ErrInvalidShardLevels {
+		t.Errorf("Create() with 4 levels: got %v; want ErrInvalidShardLevels", err)
+	}
+}
+
+func TestReshard(t *testing.T) {
+	mfs := filesystem.NewMemoryFileSystem()
+	option := TableOption{BaseDirectory: "/test-table", FileSystem: mfs, KeepSnapshots: true}
+	tbl, err := Create(option)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a", "b", "c"} {
+		tbl.Put([]byte(key), []byte("value1"))
+	}
+
+	// Interrupt resharding after moving a single file.
+	if err := tbl.setLayout(2, 0, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := tbl.moveKeyFile(tbl.baseDirectory, shardPath(tbl.baseDirectory, tbl.keyName([]byte("a")), 0), 2); err != nil {
+		t.Fatal(err)
+	}
+	tbl.Close()
+	tbl, err = Open(option)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tbl.Close()
+	tbl.Put([]byte("b"), []byte("value2"))
+	tbl.Put([]byte("d"), []byte("value2"))
+	if depths := keyFileDepths(tbl); depths[0] != 2 || depths[2] != 2 {
+		t.Errorf("key files at depths %v; want 2 flat and 2 at depth 2", depths)
+	}
+	want := map[string]string{"a": "value1", "b": "value2", "c": "value1", "d": "value2"}
+	for key, value := range want {
+		if got, err := tbl.Get([]byte(key)); err != nil || string(got) != value {
+			t.Errorf("Get(%q) while resharding = %q, %v; want %s", key, got, err, value)
+		}
+	}
+
+	if err := tbl.Reshard(context.Background(), 2); err != nil {
+		t.Fatal(err)
+	}
+	if depths := keyFileDepths(tbl); len(depths) != 1 || depths[2] != 4 {
+		t.Errorf("key files at depths %v; want 4 at depth 2", depths)
+	}
+	if snapshots, err := tbl.readSnapshots(tbl.keyPath([]byte("b"))); err != nil || len(snapshots) != 2 {
+		t.Errorf("b has %d snapshots, %v; want 2", len(snapshots), err)
+	}
+	manifest, err := ReadManifest(mfs, "/test-table")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.ShardLevels != 2 || manifest.Resharding {
+		t.Errorf("unexpected manifest %+v", manifest)
+	}
+
+	if err := tbl.Reshard(context.Background(), 0); err != nil {
+		t.Fatal(err)
+	}
+	if depths := keyFileDepths(tbl); len(depths) != 1 || depths[0] != 4 {
+		t.Errorf("key files at depths %v; want 4 flat", depths)
+	}
+	mfs.Walk("/test-table", func(path string, info os.FileInfo, err error) error {
+		if info.IsDir() && isShardDir(info.Name()) {
+			t.Errorf("shard directory %s is left", path)
+		}
+		return nil
+	})
+	for key, value := range want {
+		if got, err := tbl.Get([]byte(key)); err != nil || string(got) != value {
+			t.Errorf("Get(%q) = %q, %v; want %s", key, got, err, value)
+		}
+	}
+}
+
+func TestReshardShared(t *testing.T) {
+	for name, newOption := range fileSystems {
+		t.Run(name, func(t *testing.T) {
+			option := newOption(t)
+			tbl, err := Create(option)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, key := range []string{"a", "b", "c"} {
+				tbl.Put([]byte(key), []byte("value-"+key))
+			}
+			tbl.Close()
+
+			readOnlyOption := option
+			readOnlyOption.ReadOnly = true
+			reader, err := Open(readOnlyOption)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer reader.Close()
+			sharedOption := option
+			sharedOption.Shared = true
+			resharder, err := Open(sharedOption)
+			if err != nil {
+				t.Fatalf("Open() shared while read-only elsewhere: %v", err)
+			}
+			defer resharder.Close()
+			if _, err := Open(option); err != ErrTableLocked {
+				t.Errorf("Open() while shared: got %v; want ErrTableLocked", err)
+			}
+			if _, err := Open(sharedOption); err != ErrTableLocked {
+				t.Errorf("Open() shared while shared: got %v; want ErrTableLocked", err)
+			}
+			if err := resharder.Reshard(context.Background(), 2); err != nil {
+				t.Fatal(err)
+			}
+			for _, key := range []string{"a", "b", "c"} {
+				if value, err := reader.Get([]byte(key)); err != nil || string(value) != "value-"+key {
+					t.Errorf("Get(%s) by a reader opened before Reshard = %q, %v", key, value, err)
+				}
+			}
+		})
+	}
+}
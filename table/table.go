@@ -4,13 +4,17 @@ package table
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"math/rand"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/jaeyeom/gofiletable/filesystem"
@@ -23,8 +27,13 @@ type FileSystem interface {
 	RemoveAll(path string) error
 	Open(name string) (io.ReadCloser, error)
 	Create(name string) (io.ReadWriteCloser, error)
+	Append(name string) (io.WriteCloser, error)
 	Remove(name string) error
+	Rename(oldpath, newpath string) error
+	Sync(name string) error
 	Walk(root string, walkFn filepath.WalkFunc) error
+	Lock(name string, exclusive bool) (io.Closer, error)
+	Stat(name string) (os.FileInfo, error)
 }
 
 // TableOption stores options for opening a table.
@@ -32,13 +41,86 @@ type TableOption struct {
 	BaseDirectory string
 	FileSystem    FileSystem
 	KeepSnapshots bool
+
+	// AdoptManifest opens an existing table with the storage mode
+	// recorded in its manifest, whatever KeepSnapshots says. Without
+	// it, Open returns ErrOptionMismatch if KeepSnapshots contradicts
+	// the manifest. Tables without a manifest are opened as
+	// KeepSnapshots says either way.
+	AdoptManifest bool
+
+	// ReadOnly opens the table for reading only. Many processes
+	// can open a table read-only at the same time, but not while
+	// another process has it open for writing.
+	ReadOnly bool
+
+	// Shared opens the table for writing with a shared lock, like
+	// ReadOnly, so that other processes can keep the table open
+	// read-only while it is written, for example while Reshard
+	// moves the key files. Writes in the process are coordinated by
+	// the locks of the keys, so no other process may write to the
+	// table at the same time: processes opening it exclusively or
+	// shared are locked out, and only read-only ones are not.
+	Shared bool
+
+	// Retention decides which snapshots are kept when a key is
+	// written and when the table is compacted. If it is nil, all
+	// snapshots are kept.
+	Retention RetentionPolicy
+
+	// Codec encodes the values of new snapshots, for example to
+	// compress them. If it is nil, values are stored as they are.
+	// Since the codec is recorded per snapshot, it can only be used
+	// on tables that keep snapshots.
+	Codec Codec
+
+	// Encryption encrypts the values of new snapshots, and the names
+	// of the key files if the table was created so. Like Codec, it
+	// can only be used on tables that keep snapshots.
+	Encryption *Encryption
+
+	// KeyEncoding is the encoding of keys into the names of their
+	// files. If it is empty, KeyEncodingBase64 is used when the
+	// table is created, and the encoding recorded in the manifest
+	// when it is opened.
+	KeyEncoding KeyEncoding
+
+	// ShardLevels spreads the key files over this many levels of
+	// subdirectories, up to 3, which keeps directories small in
+	// tables with millions of keys. It is only used when the table
+	// is created. Tables are opened with the layout recorded in
+	// their manifest, which Reshard changes.
+	ShardLevels int
+
+	// Clock tells the wall time of new snapshots. If it is nil, the
+	// system clock is used.
+	Clock Clock
 }
 
-// Table stores state of the table. The actual data isn't stored in the struct.
+// Table stores state of the table. The actual data isn't stored in
+// the struct. A Table is safe for concurrent use by multiple
+// goroutines.
 type Table struct {
 	baseDirectory string
 	fileSystem    FileSystem
 	keepSnapshots bool
+	adoptManifest bool // Takes the storage mode from the manifest
+	readOnly      bool
+	shared        bool // Holds a shared lock while writing
+	retention     RetentionPolicy
+	codec         Codec
+	encryption    *Encryption
+	names         *nameCipher // Encrypts key file names, if set
+	keyEncoding   KeyEncoding
+	hashLongNames bool // Hashes file names that are too long
+	layout        *shardLayout
+	clock         Clock
+	sequences     *sequencer
+	batches       *batchState
+	views         *viewSet
+	locks         *keyLocks
+	fileLock      io.Closer
+	recovery      *RecoveryReport // Report of the Recover run by Open
 }
 
 var (
@@ -49,8 +131,133 @@ var (
 	// ErrNoSnapshots is returned when there is no snapshots with
 	// a given key.
 	ErrNoSnapshots = errors.New("gofiletable: no snapshots")
+
+	// ErrTableLocked is returned when the table is opened by
+	// another writer, or by readers when opening it for writing.
+	ErrTableLocked = errors.New("gofiletable: table is locked by another process")
+
+	// ErrReadOnly is returned when modifying a table opened with
+	// the ReadOnly option.
+	ErrReadOnly = errors.New("gofiletable: table is read-only")
+
+	// ErrTableExists is returned by Create when the table already
+	// exists.
+	ErrTableExists = errors.New("gofiletable: table already exists")
+
+	// ErrTableNotFound is returned by Open when the table doesn't
+	// exist.
+	ErrTableNotFound = errors.New("gofiletable: table not found")
+
+	// ErrOptionMismatch is returned by Open when the option
+	// contradicts the manifest of the table.
+	ErrOptionMismatch = errors.New("gofiletable: option contradicts the table manifest")
+
+	// ErrNotTable is returned by Open when the directory has neither
+	// a manifest nor the key files of a table created before
+	// manifests were introduced.
+	ErrNotTable = errors.New("gofiletable: directory is not a table")
+
+	// ErrSnapshotsDisabled is returned by operations that need the
+	// history of keys on a table that doesn't keep snapshots.
+	ErrSnapshotsDisabled = errors.New("gofiletable: table does not keep snapshots")
+
+	// ErrUnsupportedFormat is returned by Open when the table was
+	// written in a format this package doesn't know, and by Create
+	// and Open for an unknown key encoding.
+	ErrUnsupportedFormat = errors.New("gofiletable: unsupported table format")
+
+	// ErrUnknownCodec is returned when reading a snapshot encoded
+	// with a codec that is neither the codec of the table nor
+	// registered with RegisterCodec.
+	ErrUnknownCodec = errors.New("gofiletable: unknown codec")
+
+	// ErrNoKeyProvider is returned when reading an encrypted
+	// snapshot, or rekeying, without an encryption option.
+	ErrNoKeyProvider = errors.New("gofiletable: table has no key provider")
+
+	// ErrInvalidEncryptionKey is returned when a KeyProvider returns
+	// a key that is not 32 bytes long.
+	ErrInvalidEncryptionKey = errors.New("gofiletable: invalid encryption key")
+
+	// ErrDecryption is returned when an encrypted snapshot or key
+	// file name can't be decrypted, because the key is wrong or the
+	// data was tampered with.
+	ErrDecryption = errors.New("gofiletable: decryption failed")
+
+	// ErrNameKeyRotation is returned by Rekey when the current key
+	// is not the key the key file names are encrypted with.
+	ErrNameKeyRotation = errors.New("gofiletable: the key of encrypted names can't be rotated")
+
+	// ErrBatchPending is returned by writes after the key files of
+	// a committed batch couldn't be replaced, until Recover finishes
+	// the batch, and by Open for reading only a table with such a
+	// batch.
+	ErrBatchPending = errors.New("gofiletable: a committed batch is unfinished")
+
+	// ErrCorrupt is matched by the *CorruptError returned when a key
+	// file is corrupt.
+	ErrCorrupt = errors.New("gofiletable: key file is corrupt")
+
+	// ErrInvalidKeyName is reported by Verify for a file in the
+	// table whose name is not an encoded key.
+	ErrInvalidKeyName = errors.New("gofiletable: file name is not an encoded key")
+
+	// ErrTimestampOrder is reported by Verify for a key whose
+	// snapshots are not in the order of their sequence numbers, or
+	// of their timestamps if they have none.
+	ErrTimestampOrder = errors.New("gofiletable: snapshot timestamps are out of order")
+
+	// ErrKeyTooLong is returned when writing a key whose file name
+	// is too long to a table that can't store it under a hashed
+	// name, because the table doesn't keep snapshots.
+	ErrKeyTooLong = errors.New("gofiletable: key is too long for a plain table")
+
+	// ErrInvalidShardLevels is returned by Create and Reshard for
+	// shard levels out of range.
+	ErrInvalidShardLevels = errors.New("gofiletable: invalid shard levels")
+
+	// ErrConflict is returned by Update when a key read by the
+	// transaction kept being written by others until it gave up.
+	ErrConflict = errors.New("gofiletable: transaction conflict")
+
+	// ErrVersionMismatch is matched by the *VersionMismatchError
+	// returned when a conditional write finds another version of the
+	// key.
+	ErrVersionMismatch = errors.New("gofiletable: version mismatch")
+
+	// ErrSnapshotExpired is matched by the *SnapshotExpiredError
+	// returned when a read view can't tell the value of a key because
+	// snapshots it may see are gone.
+	ErrSnapshotExpired = errors.New("gofiletable: snapshot expired")
 )
 
+// CorruptError is returned when a key file is corrupt, for example
+// when a checksum doesn't match or a snapshot is cut short. It
+// matches ErrCorrupt with errors.Is.
+type CorruptError struct {
+	Key    []byte // Key of the file, or nil if unknown
+	Index  int    // Index of the snapshot, or -1 for the file header
+	Offset int64  // Offset in the file where the corruption was found
+	Err    error  // What is wrong
+}
+
+func (e *CorruptError) Error() string {
+	if e.Index < 0 {
+		return fmt.Sprintf("gofiletable: corrupt header of key %q at offset %d: %v", e.Key, e.Offset, e.Err)
+	}
+	return fmt.Sprintf("gofiletable: corrupt snapshot %d of key %q at offset %d: %v", e.Index, e.Key, e.Offset, e.Err)
+}
+
+// Is returns true if target is ErrCorrupt.
+func (e *CorruptError) Is(target error) bool {
+	return target == ErrCorrupt
+}
+
+// Unwrap returns the underlying error.
+func (e *CorruptError) Unwrap() error {
+	return e.Err
+}
+
 // Header is a struct for the header of the table. It has the size of
 // header and also indexing of the snapshots.
 type Header struct {
@@ -64,6 +271,12 @@ type Header struct {
 type SnapshotInfo struct {
 	Timestamp uint64
 	ByteSize  uint64
+
+	// Sequence orders the snapshots of the table. It increases with
+	// every snapshot written to any key, even if the clock steps
+	// backwards, and is zero for snapshots written before sequence
+	// numbers were introduced.
+	Sequence uint64
 }
 
 // Snapshot has the SnapshotInfo and the actual value.
@@ -92,6 +305,26 @@ func (brc *ByteReadCounter) ReadByte() (c byte, err error) {
 	return brc.Reader.ReadByte()
 }
 
+// lockFileName is the name of the file in the table directory that
+// holds the advisory lock of the table.
+const lockFileName = ".lock"
+
+// writeLockFileName is the name of the file in the table directory
+// that tables opened with TableOption.Shared lock exclusively, so that
+// only one of them writes at a time.
+const writeLockFileName = ".writelock"
+
+// tempFilePrefix is the prefix of temporary files written by Put
+// before they are renamed over the key file. Encoded keys never start
+// with a dot, so these files can't be mistaken for keys.
+const tempFilePrefix = ".tmp-"
+
+// isReservedName returns true if the file name is not a key file but
+// a file used by the table itself.
+func isReservedName(name string) bool {
+	return strings.HasPrefix(name, ".")
+}
+
 // encodeKey encodes key to base64 URL encoder to avoid illegal
 // characters in the filename.
 func encodeKey(key []byte) []byte {
@@ -109,27 +342,262 @@ func decodeKey(encoded []byte) ([]byte, error) {
 	return key[0:n], err
 }
 
-// Create creates a table. Actually it just creates an empty
-// directory.
-func Create(option TableOption) (*Table, error) {
-	// TODO: Produce error if the table already exists.
+// newTable returns a table for the option without touching the file
+// system.
+func newTable(option TableOption) Table {
 	tbl := Table{
 		baseDirectory: option.BaseDirectory,
 		fileSystem:    option.FileSystem,
 		keepSnapshots: option.KeepSnapshots,
+		adoptManifest: option.AdoptManifest,
+		readOnly:      option.ReadOnly,
+		shared:        option.Shared,
+		retention:     option.Retention,
+		codec:         option.Codec,
+		encryption:    option.Encryption,
+		keyEncoding:   option.KeyEncoding,
+		locks:         &keyLocks{},
+		layout:        &shardLayout{},
+		clock:         option.Clock,
+		sequences:     &sequencer{},
+		batches:       &batchState{},
+		views:         &viewSet{},
 	}
 	if tbl.fileSystem == nil {
 		tbl.fileSystem = filesystem.OSFileSystem
 	}
-	if err := tbl.Recover(); err != nil {
+	if tbl.clock == nil {
+		tbl.clock = systemClock{}
+	}
+	return tbl
+}
+
+// lockDirectory acquires the lock on the table directory. Unless the
+// table is opened read-only or shared, the lock is exclusive. A table
+// opened shared also locks the write lock file exclusively.
+// ErrTableLocked is returned if another process holds a conflicting
+// lock.
+func (tbl *Table) lockDirectory() error {
+	fileLock, err := tbl.lockFile(lockFileName, !tbl.readOnly && !tbl.shared)
+	if err != nil {
+		return err
+	}
+	if tbl.shared && !tbl.readOnly {
+		writeLock, err := tbl.lockFile(writeLockFileName, true)
+		if err != nil {
+			fileLock.Close()
+			return err
+		}
+		fileLock = lockClosers{writeLock, fileLock}
+	}
+	tbl.fileLock = fileLock
+	return nil
+}
+
+// lockFile locks the file with the name in the table directory.
+// ErrTableLocked is returned if another process holds a conflicting
+// lock.
+func (tbl *Table) lockFile(name string, exclusive bool) (io.Closer, error) {
+	fileLock, err := tbl.fileSystem.Lock(filepath.Join(tbl.baseDirectory, name), exclusive)
+	if err == filesystem.ErrLocked {
+		return nil, ErrTableLocked
+	}
+	return fileLock, err
+}
+
+// lockClosers releases several locks in order.
+type lockClosers []io.Closer
+
+// Close releases all the locks and returns the first error.
+func (locks lockClosers) Close() error {
+	var err error
+	for _, lock := range locks {
+		if closeErr := lock.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// Create creates a new table in the base directory, creating the
+// directory if necessary, and writes its manifest. ErrTableExists is
+// returned if the directory already has a table. The table is locked
+// exclusively until it is closed.
+func Create(option TableOption) (*Table, error) {
+	if option.ReadOnly {
+		return nil, ErrReadOnly
+	}
+	if (option.Codec != nil || option.Encryption != nil) && !option.KeepSnapshots {
+		return nil, ErrSnapshotsDisabled
+	}
+	if option.ShardLevels < 0 || option.ShardLevels > maxShardLevels {
+		return nil, ErrInvalidShardLevels
+	}
+	if option.KeyEncoding == "" {
+		option.KeyEncoding = KeyEncodingBase64
+	}
+	if !option.KeyEncoding.valid() {
+		return nil, ErrUnsupportedFormat
+	}
+	tbl := newTable(option)
+	manifest := &Manifest{
+		FormatVersion: manifestFormatVersion,
+		KeepSnapshots: tbl.keepSnapshots,
+		KeyEncoding:   tbl.keyEncoding,
+		LongKeyNames:  longKeyNamesSHA256,
+		ShardLevels:   option.ShardLevels,
+		CreatedAt:     tbl.clock.Now(),
+	}
+	tbl.hashLongNames = true
+	tbl.layout.set(option.ShardLevels, 0, false)
+	if option.Encryption != nil && option.Encryption.EncryptNames {
+		id, err := option.Encryption.Keys.CurrentKeyID()
+		if err != nil {
+			return nil, err
+		}
+		if err := tbl.loadNameCipher(id); err != nil {
+			return nil, err
+		}
+		manifest.NameKeyID = id
+	}
+	if err := tbl.fileSystem.MkdirAll(tbl.baseDirectory, 0700); err != nil {
+		return nil, err
+	}
+	if err := tbl.lockDirectory(); err != nil {
+		return nil, err
+	}
+	exists, err := tbl.exists()
+	if err == nil && exists {
+		err = ErrTableExists
+	}
+	if err == nil {
+		err = tbl.writeManifest(tbl.manifestPath(), manifest)
+	}
+	if err != nil {
+		tbl.fileLock.Close()
 		return nil, err
 	}
 	return &tbl, nil
 }
 
-// Open opens a table in the baseDirectory.
+// Open opens an existing table in the base directory. ErrTableNotFound
+// is returned if the directory doesn't exist. The options stored in
+// the manifest of the table are used, and ErrOptionMismatch is returned
+// if the option contradicts them, unless AdoptManifest takes the
+// storage mode from the manifest. Tables created before manifests were
+// introduced are opened with the given option as is, but only if all
+// the files in the directory are named like key files and there is at
+// least one; ErrNotTable is returned otherwise, before anything is
+// written to the directory. Unless the table is opened read-only or
+// shared, an exclusive lock on the table directory is acquired, and
+// ErrTableLocked is returned if another process has the table open.
+// The lock is held until the table is closed. Tables opened for
+// writing are recovered, and the report is kept for Recovery. Tables
+// with a committed batch that isn't finished can't be opened
+// read-only, and ErrBatchPending is returned for them.
 func Open(option TableOption) (*Table, error) {
-	return Create(option)
+	if option.KeyEncoding != "" && !option.KeyEncoding.valid() {
+		return nil, ErrUnsupportedFormat
+	}
+	tbl := newTable(option)
+	info, err := tbl.fileSystem.Stat(tbl.baseDirectory)
+	if os.IsNotExist(err) || (err == nil && !info.IsDir()) {
+		return nil, ErrTableNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := tbl.checkTable(); err != nil {
+		return nil, err
+	}
+	if err := tbl.lockDirectory(); err != nil {
+		return nil, err
+	}
+	if err = tbl.loadManifest(); err == nil && !tbl.readOnly {
+		tbl.recovery, err = tbl.Recover()
+	} else if err == nil {
+		// Readers would see a part of the batch.
+		err = tbl.checkCommittedBatches()
+	}
+	if err != nil {
+		tbl.fileLock.Close()
+		return nil, err
+	}
+	return &tbl, nil
+}
+
+// exists returns true if the base directory already has a table,
+// either with a manifest or with key files.
+func (tbl Table) exists() (bool, error) {
+	if _, err := tbl.fileSystem.Stat(tbl.manifestPath()); err == nil {
+		return true, nil
+	} else if !os.IsNotExist(err) {
+		return false, err
+	}
+	errFound := errors.New("key file found")
+	err := tbl.walkKeyFiles(func(path string, info os.FileInfo) error {
+		return errFound
+	})
+	if err == errFound {
+		return true, nil
+	}
+	return false, err
+}
+
+// checkTable returns ErrNotTable unless the base directory has a
+// manifest, or looks like a table created before manifests were
+// introduced: it has key files, and all the other files and
+// directories in it are reserved by the table.
+func (tbl Table) checkTable() error {
+	if _, err := tbl.fileSystem.Stat(tbl.manifestPath()); err == nil {
+		return nil
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	keyEncoding := tbl.keyEncoding
+	if keyEncoding == "" {
+		keyEncoding = KeyEncodingBase64
+	}
+	base := filepath.Clean(tbl.baseDirectory)
+	found := false
+	walkFunc := func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		name := info.Name()
+		switch {
+		case path == base:
+			return nil
+		case info.IsDir() && (name == lostAndFoundDir || isReservedName(name)):
+			return filepath.SkipDir
+		case isReservedName(name):
+			return nil
+		case info.IsDir():
+			return ErrNotTable
+		}
+		if tbl.hashLongNames && strings.HasPrefix(name, hashedNamePrefix) {
+			found = true
+			return nil
+		}
+		if _, err := keyEncoding.DecodeKey(name); err != nil {
+			return ErrNotTable
+		}
+		found = true
+		return nil
+	}
+	if err := tbl.fileSystem.Walk(base, walkFunc); err != nil {
+		return err
+	}
+	if !found {
+		return ErrNotTable
+	}
+	return nil
+}
+
+// Close releases the lock on the table directory. The table must not
+// be used after it is closed.
+func (tbl Table) Close() error {
+	return tbl.fileLock.Close()
 }
 
 // readHeader reads header from the reader r and returns the header
@@ -148,6 +616,11 @@ func readHeader(r *bufio.Reader) (*Header, error) {
 	if err != nil {
 		return nil, err
 	}
+	// Each snapshot takes at least 9 bytes, so a corrupted count can
+	// be detected before allocating for it.
+	if snapshotSize > headerSize {
+		return nil, ErrHeaderSizeMismatch
+	}
 	snapshots := make([]SnapshotInfo, snapshotSize)
 	for i := uint64(0); i < snapshotSize; i++ {
 		err = binary.Read(brc, binary.BigEndian, &snapshots[i].Timestamp)
@@ -163,12 +636,12 @@ func readHeader(r *bufio.Reader) (*Header, error) {
 	if brc.Count > headerSize {
 		return nil, ErrHeaderSizeMismatch
 	}
-	// TODO: Remove this when Seek() function is implemented.
-	for brc.Count < headerSize {
-		if _, err = brc.ReadByte(); err != nil {
-			return nil, err
+	// Skip the padding, so r is positioned at the first value.
+	if _, err = r.Discard(int(headerSize - brc.Count)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
 		}
-
+		return nil, err
 	}
 	return &Header{
 		ByteSize:  headerSize,
@@ -216,174 +689,416 @@ func (header *Header) WriteTo(w io.Writer) (n int64, err error) {
 // Drop drops the table tbl. It removes all the data in the table and
 // the directory.
 func (tbl Table) Drop() error {
+	if tbl.readOnly {
+		return ErrReadOnly
+	}
 	return tbl.fileSystem.RemoveAll(tbl.baseDirectory)
 }
 
-// Recover creates the table directory.
-func (tbl Table) Recover() error {
-	return tbl.fileSystem.MkdirAll(tbl.baseDirectory, 0700)
+// writeFile atomically replaces the file at path with the content
+// produced by write. The content is written to a temporary sibling
+// file first, which is synced and then renamed over path, so a crash
+// leaves either the old or the new content but never a truncated
+// file.
+func (tbl Table) writeFile(path string, write func(w io.Writer) error) error {
+	dir := filepath.Dir(path)
+	if dir != filepath.Clean(tbl.baseDirectory) {
+		// Shard subdirectories are created on demand.
+		if err := tbl.fileSystem.MkdirAll(dir, 0700); err != nil {
+			return err
+		}
+	}
+	temp := filepath.Join(dir, fmt.Sprintf("%s%016x", tempFilePrefix, rand.Uint64()))
+	f, err := tbl.fileSystem.Create(temp)
+	if err != nil {
+		return err
+	}
+	if err = write(f); err != nil {
+		f.Close()
+		tbl.fileSystem.Remove(temp)
+		return err
+	}
+	if err = f.Close(); err != nil {
+		tbl.fileSystem.Remove(temp)
+		return err
+	}
+	if err = tbl.fileSystem.Sync(temp); err != nil {
+		tbl.fileSystem.Remove(temp)
+		return err
+	}
+	if err = tbl.fileSystem.Rename(temp, path); err != nil {
+		tbl.fileSystem.Remove(temp)
+		return err
+	}
+	return tbl.fileSystem.Sync(dir)
 }
 
 // Get gets the value of the key in the table.
 func (tbl Table) Get(key []byte) ([]byte, error) {
 	if !tbl.keepSnapshots {
-		filename := string(encodeKey(key))
-		path := filepath.Join(tbl.baseDirectory, filename)
-		f, err := tbl.fileSystem.Open(path)
+		f, err := tbl.openKey(key)
 		if err != nil {
 			return nil, err
 		}
 		defer f.Close()
 		return ioutil.ReadAll(f)
 	}
-	var value []byte
-	c, cerr := tbl.GetSnapshots(key)
-	for snapshot := range c {
-		value = snapshot.Value
+	sf, err := tbl.openKeySnapshots(key)
+	if err != nil {
+		return nil, err
 	}
-	return value, <-cerr
+	defer sf.Close()
+	last, err := sf.Last()
+	if err != nil {
+		return nil, err
+	}
+	return tbl.value(sf, last)
+}
+
+// openKey opens the file of the key for reading. Since writers
+// replace key files atomically, the opened file stays consistent
+// after the lock is released even if the key is written again.
+func (tbl Table) openKey(key []byte) (io.ReadCloser, error) {
+	lock := tbl.locks.of(key)
+	lock.RLock()
+	defer lock.RUnlock()
+	return tbl.fileSystem.Open(tbl.keyPath(key))
+}
+
+// openKeySnapshots opens the snapshot file of the key for reading.
+// Writers either replace snapshot files atomically or append to them,
+// and the size of the file is taken under the lock, so the opened file
+// stays consistent after the lock is released even if the key is
+// written again.
+func (tbl Table) openKeySnapshots(key []byte) (*snapshotFile, error) {
+	lock := tbl.locks.of(key)
+	lock.RLock()
+	defer lock.RUnlock()
+	return tbl.openSnapshots(tbl.keyPath(key))
 }
 
-// GetSnapshots returns a channel of snapshot.
+// GetSnapshots returns a channel of snapshot. The goroutine sending
+// them blocks until all of them are received; IterSnapshots doesn't.
 func (tbl Table) GetSnapshots(key []byte) (<-chan *Snapshot, <-chan error) {
-	c := make(chan *Snapshot)
-	cerr := make(chan error, 1)
-	go func() {
-		defer close(c)
-		defer close(cerr)
-		filename := string(encodeKey(key))
-		path := filepath.Join(tbl.baseDirectory, filename)
-		f, err := tbl.fileSystem.Open(path)
-		if err != nil {
-			cerr <- err
-			return
-		}
-		defer f.Close()
-		r := bufio.NewReader(f)
-		h, err := readHeader(r)
-		if err != nil {
-			cerr <- err
-			return
-		}
-		if len(h.Snapshots) == 0 {
-			cerr <- ErrNoSnapshots
-			return
-		}
-		for _, snapshot := range h.Snapshots {
-			value := make([]byte, snapshot.ByteSize)
-			_, err = io.ReadFull(r, value)
-			if err != nil {
-				cerr <- err
-				break
-			}
-			c <- &Snapshot{snapshot, value}
-		}
-		return
-	}()
-	return c, cerr
+	return snapshotChannels(tbl.IterSnapshots(context.Background(), key))
 }
 
-// PutSnapshots rewrites the whole snapshots of the key with the given snapshots.
+// PutSnapshots rewrites the whole snapshots of the key with the given
+// snapshots. The key file is replaced atomically. The values are
+// encoded with the codec of the table. Snapshots without a sequence
+// number are given new ones in order, and those with one keep it.
 func (tbl Table) PutSnapshots(key []byte, snapshots []Snapshot) error {
-	filename := string(encodeKey(key))
-	path := filepath.Join(tbl.baseDirectory, filename)
-	f, err := tbl.fileSystem.Create(path)
-	if err != nil {
+	if tbl.readOnly {
+		return ErrReadOnly
+	}
+	lock := tbl.locks.of(key)
+	lock.Lock()
+	defer lock.Unlock()
+	if err := tbl.batches.check(); err != nil {
+		return err
+	}
+	// Sequence numbers are handed out under the lock, so that
+	// ReadView knows when they are written.
+	snapshots = append([]Snapshot(nil), snapshots...)
+	if err := tbl.sequenceSnapshots(snapshots); err != nil {
 		return err
 	}
-	defer f.Close()
+	stored := make([]storedSnapshot, len(snapshots))
+	for i, snapshot := range snapshots {
+		var err error
+		if stored[i], err = tbl.encode(key, snapshot); err != nil {
+			return err
+		}
+	}
+	path := tbl.keyPath(key)
+	_, longName := tbl.fileName(key)
+	header, old, err := tbl.readKeyFile(path)
+	if errors.Is(err, ErrCorrupt) {
+		// A corrupt history is replaced as a whole.
+		header, old = fileHeader{lost: corruptHistory(stored)}, nil
+	} else if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	header = fileHeader{name: longName, lost: replacedSequences(header.lost, old, stored)}
+	return tbl.writeSnapshots(path, header, stored)
+}
 
-	header := &Header{
-		ByteSize:  16,
-		Snapshots: []SnapshotInfo{},
+// corruptHistory returns the range of the sequence numbers lost with
+// a corrupt history replaced by the stored snapshots. The history is
+// unknown, so it is taken to have had all the sequence numbers before
+// the last new one.
+func corruptHistory(stored []storedSnapshot) seqRange {
+	lost := seqRange{}.add(1)
+	for _, snapshot := range stored {
+		if seq := snapshot.Info.Sequence; seq > 1 {
+			lost = lost.add(seq - 1)
+		}
 	}
-	for _, snapshot := range snapshots {
-		header.Snapshots = append(header.Snapshots, snapshot.Info)
+	return lost
+}
+
+// replacedSequences returns the range lost extended to the sequence
+// numbers of the old snapshots of a key that are not among the new
+// ones replacing them.
+func replacedSequences(lost seqRange, old, new []storedSnapshot) seqRange {
+	kept := map[uint64]bool{}
+	for _, snapshot := range new {
+		kept[snapshot.Info.Sequence] = true
 	}
-	header.WriteTo(f)
-	for _, snapshot := range snapshots {
-		_, err = f.Write(snapshot.Value)
-		if err != nil {
-			return err
+	for _, snapshot := range old {
+		if !kept[snapshot.Info.Sequence] {
+			lost = lost.add(snapshot.Info.Sequence)
 		}
 	}
-	return nil
+	return lost
 }
 
-// Put writes the data into the table.
+// Put writes the data into the table. The key file is replaced
+// atomically, so the old value survives if the write fails. If the
+// table keeps snapshots, the value is appended to the key file as a
+// new snapshot and the retention policy of the table is applied to
+// the history. The key file is rewritten only when the policy removes
+// snapshots or the file is in the version 1 format.
 func (tbl Table) Put(key []byte, value []byte) error {
-	filename := string(encodeKey(key))
-	path := filepath.Join(tbl.baseDirectory, filename)
-	var header *Header
-	var valueArea []byte
-	if tbl.keepSnapshots {
-		f, err := tbl.fileSystem.Open(path)
-		if err == nil {
-			defer f.Close()
-			r := bufio.NewReader(f)
-			header, err = readHeader(r)
-			if err != nil {
-				return err
-			}
-			valueArea, err = ioutil.ReadAll(r)
-			if err != nil {
-				return err
-			}
-		} else {
-			header = &Header{
-				ByteSize:  16,
-				Snapshots: nil,
-			}
+	_, err := tbl.PutVersion(key, value)
+	return err
+}
+
+// put writes the data into the table like Put and returns the version
+// it wrote, which is zero if the table doesn't keep snapshots. The
+// caller must hold the lock of the key.
+func (tbl Table) put(key []byte, value []byte) (Version, error) {
+	path := tbl.keyPath(key)
+	_, longName := tbl.fileName(key)
+	if !tbl.keepSnapshots {
+		if longName != "" {
+			return 0, ErrKeyTooLong
 		}
+		return 0, tbl.writeFile(path, func(w io.Writer) error {
+			_, err := w.Write(value)
+			return err
+		})
 	}
-	f, err := tbl.fileSystem.Create(path)
+	now := tbl.clock.Now()
+	info, err := tbl.stamp(now, len(value))
 	if err != nil {
-		return err
+		return 0, err
+	}
+	snapshot, err := tbl.encode(key, Snapshot{Info: info, Value: value})
+	if err != nil {
+		return 0, err
 	}
-	defer f.Close()
-	if header != nil {
-		header.Snapshots = append(header.Snapshots, SnapshotInfo{uint64(time.Now().UnixNano()), uint64(len(value))})
-		header.WriteTo(f)
+	if err := tbl.putStored(path, longName, snapshot, now); err != nil {
+		return 0, err
 	}
+	return infoVersion(info), nil
+}
 
-	if valueArea != nil {
-		_, err = f.Write(valueArea)
+// putStored appends the stored snapshot written at now to the key file
+// at the path and applies the retention policy of the table. The
+// caller must hold the lock of the key.
+func (tbl Table) putStored(path, longName string, snapshot storedSnapshot, now time.Time) error {
+	sf, err := tbl.openSnapshots(path)
+	if os.IsNotExist(err) {
+		return tbl.writeSnapshots(path, fileHeader{name: longName}, []storedSnapshot{snapshot})
+	}
+	if err != nil {
+		return err
+	}
+	defer sf.Close()
+	var records []record
+	if sf.version == 1 || tbl.retention != nil {
+		if records, err = sf.Records(); err != nil {
+			return err
+		}
+	}
+	infos := make([]SnapshotInfo, 0, len(records)+1)
+	for _, rec := range records {
+		infos = append(infos, rec.Info)
+	}
+	retain := retainInfos(tbl.retention, append(infos, snapshot.Info), now)
+	if sf.version == 2 && retain == nil {
+		return tbl.appendSnapshot(path, sf, snapshot)
+	}
+	var snapshots []storedSnapshot
+	header := fileHeader{name: longName, lost: sf.header.lost}
+	for i, rec := range records {
+		if retain != nil && !retain[i] {
+			header.lost = header.lost.add(rec.Info.Sequence)
+			continue
+		}
+		stored, err := readStored(sf, rec)
 		if err != nil {
 			return err
 		}
+		snapshots = append(snapshots, stored)
+	}
+	return tbl.writeSnapshots(path, header, append(snapshots, snapshot))
+}
+
+// KeyEncoding returns the encoding of keys into the names of their
+// files.
+func (tbl Table) KeyEncoding() KeyEncoding {
+	return tbl.keyEncoding
+}
+
+// keyName returns the name of the file of the key, which is the
+// encoded key, encrypted first if the table encrypts names.
+func (tbl Table) keyName(key []byte) string {
+	if tbl.names != nil {
+		key = tbl.names.encrypt(key)
+	}
+	return tbl.keyEncoding.EncodeKey(key)
+}
+
+// nameKey returns the key of the key file with the name.
+func (tbl Table) nameKey(name string) ([]byte, error) {
+	key, err := tbl.keyEncoding.DecodeKey(name)
+	if err != nil || tbl.names == nil {
+		return key, err
+	}
+	return tbl.names.decrypt(key)
+}
+
+// keyPath returns the path of the file of the key.
+func (tbl Table) keyPath(key []byte) string {
+	name, _ := tbl.fileName(key)
+	return tbl.locate(tbl.baseDirectory, name)
+}
+
+// locate returns the path of the file with the name in dir, which is
+// laid out like the key files. While the table is resharded, the path
+// in the old layout is returned if the file is still there. Since
+// another process may reshard a table opened read-only, the layout of
+// such a table is read again from the manifest if the file is not
+// found.
+func (tbl Table) locate(dir, name string) string {
+	path, found := tbl.findFile(dir, name)
+	if !found && tbl.readOnly && tbl.reloadLayout() {
+		path, _ = tbl.findFile(dir, name)
+	}
+	return path
+}
+
+// findFile returns the path of the file with the name in dir in the
+// layout of the table, and whether the file was found there. Files
+// are only looked for if the table is read-only or resharded.
+func (tbl Table) findFile(dir, name string) (string, bool) {
+	levels, from, resharding := tbl.layout.get()
+	path := shardPath(dir, name, levels)
+	if !tbl.readOnly && (!resharding || from == levels) {
+		return path, true
+	}
+	if _, err := tbl.fileSystem.Stat(path); !os.IsNotExist(err) {
+		return path, true
+	}
+	if resharding && from != levels {
+		old := shardPath(dir, name, from)
+		if _, err := tbl.fileSystem.Stat(old); err == nil {
+			return old, true
+		}
 	}
-	_, err = f.Write(value)
+	return path, false
+}
+
+// keyOfPath returns the key of the key file at path, or nil if the
+// file name isn't an encoded key. The file is not read, so the key of
+// a file with a hashed name is nil too.
+func (tbl Table) keyOfPath(path string) []byte {
+	key, err := tbl.nameKey(filepath.Base(path))
 	if err != nil {
-		return err
+		return nil
 	}
-	return err
+	return key
 }
 
-// Remove removes an item in the table.
+// readSnapshots reads all the snapshots in the snapshot file at path
+// as they are stored.
+func (tbl Table) readSnapshots(path string) ([]storedSnapshot, error) {
+	_, snapshots, err := tbl.readKeyFile(path)
+	return snapshots, err
+}
+
+// readKeyFile reads the file header and all the snapshots in the
+// snapshot file at path as they are stored.
+func (tbl Table) readKeyFile(path string) (fileHeader, []storedSnapshot, error) {
+	sf, err := tbl.openSnapshots(path)
+	if err != nil {
+		return fileHeader{}, nil, err
+	}
+	defer sf.Close()
+	records, err := sf.Records()
+	if err != nil {
+		return fileHeader{}, nil, err
+	}
+	snapshots := make([]storedSnapshot, len(records))
+	for i, rec := range records {
+		if snapshots[i], err = readStored(sf, rec); err != nil {
+			return fileHeader{}, nil, err
+		}
+	}
+	return sf.header, snapshots, nil
+}
+
+// writeSnapshots atomically replaces the snapshot file at path with
+// the header and the stored snapshots in the version 2 format.
+func (tbl Table) writeSnapshots(path string, header fileHeader, snapshots []storedSnapshot) error {
+	return tbl.writeFile(path, func(w io.Writer) error {
+		return writeSnapshotFile(w, header, snapshots)
+	})
+}
+
+// Remove removes an item in the table. If the table keeps snapshots,
+// the removal is recorded for read views created before it.
 func (tbl Table) Remove(key []byte) error {
-	filename := string(encodeKey(key))
-	path := filepath.Join(tbl.baseDirectory, filename)
-	return tbl.fileSystem.Remove(path)
+	if tbl.readOnly {
+		return ErrReadOnly
+	}
+	lock := tbl.locks.of(key)
+	lock.Lock()
+	defer lock.Unlock()
+	if err := tbl.batches.check(); err != nil {
+		return err
+	}
+	return tbl.removeKeyFile(key, tbl.keyPath(key))
 }
 
-// Keys returns a channel of keys.
-func (tbl Table) Keys() (c chan []byte) {
-	c = make(chan []byte)
+// walkKeyFiles calls fn for each key file in the table. Directories
+// and files reserved by the table, such as temporary files and the
+// lost+found directory, are skipped.
+func (tbl Table) walkKeyFiles(fn func(path string, info os.FileInfo) error) error {
 	walkFunc := func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		name := info.Name()
 		if info.IsDir() {
+			if path != filepath.Clean(tbl.baseDirectory) && (name == lostAndFoundDir || isReservedName(name)) {
+				return filepath.SkipDir
+			}
 			return nil
 		}
-		name := info.Name()
-		key, err := decodeKey([]byte(name))
-		if err != nil {
-			return err
+		if isReservedName(name) {
+			return nil
 		}
-		c <- key
-		return nil
+		return fn(path, info)
 	}
+	return tbl.fileSystem.Walk(tbl.baseDirectory, walkFunc)
+}
+
+// Keys returns a channel of keys. The goroutine sending them blocks
+// until all of them are received, and it stops at the first error,
+// which is dropped. IterKeys has neither problem.
+func (tbl Table) Keys() (c chan []byte) {
+	c = make(chan []byte)
 	go func() {
 		defer close(c)
-		tbl.fileSystem.Walk(tbl.baseDirectory, walkFunc)
+		for key, err := range tbl.IterKeys(context.Background()) {
+			if err != nil {
+				return
+			}
+			c <- key
+		}
 	}()
 	return c
 }
@@ -1,8 +1,11 @@
 package table
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/jaeyeom/gofiletable/filesystem"
@@ -23,13 +26,13 @@ func TestPutAndGet(t *testing.T) {
 		tableOption TableOption
 		operations  []Operation
 	}{{
-		TableOption{"/test-table-0001", filesystem.NewMemoryFileSystem(), false},
+		TableOption{BaseDirectory: "/test-table-0001", FileSystem: filesystem.NewMemoryFileSystem(), KeepSnapshots: false},
 		[]Operation{},
 	}, {
-		TableOption{"/test-table-0002", filesystem.NewMemoryFileSystem(), true},
+		TableOption{BaseDirectory: "/test-table-0002", FileSystem: filesystem.NewMemoryFileSystem(), KeepSnapshots: true},
 		[]Operation{},
 	}, {
-		TableOption{"/test-table-0003", filesystem.NewMemoryFileSystem(), false},
+		TableOption{BaseDirectory: "/test-table-0003", FileSystem: filesystem.NewMemoryFileSystem(), KeepSnapshots: false},
 		[]Operation{
 			{putOp, "hello", "world", nil},
 			{putOp, "hello", "world2", nil},
@@ -37,7 +40,7 @@ func TestPutAndGet(t *testing.T) {
 			{getOp, "hello", "world2", nil},
 		},
 	}, {
-		TableOption{"/test-table-0004", filesystem.NewMemoryFileSystem(), true},
+		TableOption{BaseDirectory: "/test-table-0004", FileSystem: filesystem.NewMemoryFileSystem(), KeepSnapshots: true},
 		[]Operation{
 			{putOp, "hello", "world", nil},
 			{putOp, "hello", "world2", nil},
@@ -45,7 +48,7 @@ func TestPutAndGet(t *testing.T) {
 			{getOp, "hello", "world2", nil},
 		},
 	}, {
-		TableOption{"/test-table-0005", filesystem.NewMemoryFileSystem(), true},
+		TableOption{BaseDirectory: "/test-table-0005", FileSystem: filesystem.NewMemoryFileSystem(), KeepSnapshots: true},
 		[]Operation{
 			{putOp, "hello", "world", nil},
 			{putOp, "hello", "world1", nil},
@@ -85,7 +88,7 @@ func TestPutAndGet(t *testing.T) {
 }
 
 func ExampleGetSnapshots() {
-	tbl, err := Create(TableOption{"/test-table-0000", filesystem.NewMemoryFileSystem(), true})
+	tbl, err := Create(TableOption{BaseDirectory: "/test-table-0000", FileSystem: filesystem.NewMemoryFileSystem(), KeepSnapshots: true})
 	if err != nil {
 		fmt.Println(err)
 	}
@@ -129,18 +132,18 @@ func ExampleGetSnapshots() {
 }
 
 func ExamplePutSnapshots() {
-	tbl, err := Create(TableOption{"/test-table-0000", filesystem.NewMemoryFileSystem(), true})
+	tbl, err := Create(TableOption{BaseDirectory: "/test-table-0000", FileSystem: filesystem.NewMemoryFileSystem(), KeepSnapshots: true})
 	if err != nil {
 		fmt.Println(err)
 	}
 	tbl.PutSnapshots([]byte("key"), []Snapshot{{
-		Info:  SnapshotInfo{100, 7},
+		Info:  SnapshotInfo{Timestamp: 100, ByteSize: 7},
 		Value: []byte("history"),
 	}, {
-		Info:  SnapshotInfo{200, 8},
+		Info:  SnapshotInfo{Timestamp: 200, ByteSize: 8},
 		Value: []byte("history2"),
 	}, {
-		Info:  SnapshotInfo{300, 5},
+		Info:  SnapshotInfo{Timestamp: 300, ByteSize: 5},
 		Value: []byte("test0"),
 	}})
 	c, cerr := tbl.GetSnapshots([]byte("key"))
@@ -154,3 +157,146 @@ func ExamplePutSnapshots() {
 	// test0
 	// <nil>
 }
+
+// failingFileSystem wraps a FileSystem and fails every write to a
+// created or appended file.
+type failingFileSystem struct {
+	FileSystem
+}
+
+type failingWriter struct {
+	io.ReadWriteCloser
+}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+func (fs failingFileSystem) Create(name string) (io.ReadWriteCloser, error) {
+	f, err := fs.FileSystem.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return failingWriter{f}, nil
+}
+
+type failingAppender struct {
+	io.WriteCloser
+}
+
+func (failingAppender) Write(p []byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+func (fs failingFileSystem) Append(name string) (io.WriteCloser, error) {
+	f, err := fs.FileSystem.Append(name)
+	if err != nil {
+		return nil, err
+	}
+	return failingAppender{f}, nil
+}
+
+func TestPutKeepsOldValueOnFailure(t *testing.T) {
+	for _, keepSnapshots := range []bool{false, true} {
+		mfs := filesystem.NewMemoryFileSystem()
+		tbl, err := Create(TableOption{BaseDirectory: "/test-table", FileSystem: mfs, KeepSnapshots: keepSnapshots})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := tbl.Put([]byte("key"), []byte("old")); err != nil {
+			t.Fatal(err)
+		}
+		failing := *tbl
+		failing.fileSystem = failingFileSystem{mfs}
+		if err := failing.Put([]byte("key"), []byte("new")); err == nil {
+			t.Errorf("keepSnapshots=%v: Put succeeded on a failing file system", keepSnapshots)
+		}
+		value, err := tbl.Get([]byte("key"))
+		if err != nil || string(value) != "old" {
+			t.Errorf("keepSnapshots=%v: Get() = %q, %v; want old", keepSnapshots, value, err)
+		}
+	}
+}
+
+func TestCreateAndOpen(t *testing.T) {
+	mfs := filesystem.NewMemoryFileSystem()
+	option := TableOption{BaseDirectory: "/test-table", FileSystem: mfs, KeepSnapshots: true}
+	if _, err := Open(option); err != ErrTableNotFound {
+		t.Errorf("Open() of a missing table: got %v; want ErrTableNotFound", err)
+	}
+	tbl, err := Create(option)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tbl.Put([]byte("key"), []byte("value"))
+	tbl.Close()
+	if _, err := Create(option); err != ErrTableExists {
+		t.Errorf("Create() of an existing table: got %v; want ErrTableExists", err)
+	}
+	manifest, err := ReadManifest(mfs, "/test-table")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.FormatVersion != manifestFormatVersion || !manifest.KeepSnapshots || manifest.KeyEncoding != KeyEncodingBase64 {
+		t.Errorf("unexpected manifest %+v", manifest)
+	}
+	plainOption := option
+	plainOption.KeepSnapshots = false
+	if _, err := Open(plainOption); err != ErrOptionMismatch {
+		t.Errorf("Open() with a contradicting option: got %v; want ErrOptionMismatch", err)
+	}
+	plainOption.AdoptManifest = true
+	adopted, err := Open(plainOption)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !adopted.keepSnapshots {
+		t.Error("Open() with AdoptManifest didn't adopt the storage mode of the manifest")
+	}
+	adopted.Close()
+	tbl, err = Open(option)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tbl.Close()
+	if value, err := tbl.Get([]byte("key")); err != nil || string(value) != "value" {
+		t.Errorf("Get() = %q, %v; want value", value, err)
+	}
+}
+
+func TestOpenLegacyTable(t *testing.T) {
+	mfs := filesystem.NewMemoryFileSystem()
+	mfs.MkdirAll("/test-table", 0700)
+	mfs.WriteFile("/test-table/"+string(encodeKey([]byte("key"))), []byte("value"), 0600)
+	option := TableOption{BaseDirectory: "/test-table", FileSystem: mfs}
+	if _, err := Create(option); err != ErrTableExists {
+		t.Errorf("Create() over a legacy table: got %v; want ErrTableExists", err)
+	}
+	tbl, err := Open(option)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tbl.Close()
+	if value, err := tbl.Get([]byte("key")); err != nil || string(value) != "value" {
+		t.Errorf("Get() = %q, %v; want value", value, err)
+	}
+}
+
+func TestOpenNotTable(t *testing.T) {
+	for _, files := range [][]string{nil, {"notes.txt"}, {"docs/README"}} {
+		mfs := filesystem.NewMemoryFileSystem()
+		mfs.MkdirAll("/dir", 0700)
+		for _, file := range files {
+			mfs.MkdirAll(filepath.Dir("/dir/"+file), 0700)
+			mfs.WriteFile("/dir/"+file, []byte("not a table"), 0600)
+		}
+		if _, err := Open(TableOption{BaseDirectory: "/dir", FileSystem: mfs}); err != ErrNotTable {
+			t.Errorf("Open() with files %q: got %v; want ErrNotTable", files, err)
+		}
+		for _, name := range []string{lockFileName, lostAndFoundDir} {
+			if _, err := mfs.Stat(filepath.Join("/dir", name)); !os.IsNotExist(err) {
+				t.Errorf("Open() with files %q wrote %s", files, name)
+			}
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package table
+
+import (
+	"errors"
+	"math/rand"
+	"os"
+	"time"
+)
+
+// Backoff between the attempts of Update. The wait doubles after each
+// conflict, up to maxTxBackoff, and is randomized so that conflicting
+// writers don't retry in step.
+const (
+	minTxBackoff  = time.Millisecond
+	maxTxBackoff  = 100 * time.Millisecond
+	maxTxAttempts = 100
+)
+
+// Tx is a read-modify-write transaction on a table, run by Update. The
+// writes are staged in memory and committed atomically like a Batch,
+// and only if none of the keys read by the transaction has been
+// written since it was read. A Tx is not safe for concurrent use, and
+// must not be used after the function given to Update returns.
+type Tx struct {
+	batch  *Batch
+	reads  map[string]Version // Versions of the keys read
+	writes map[string][]byte  // Staged values of the keys written, nil if removed
+}
+
+// Update runs fn in a transaction and commits its writes if fn returns
+// nil. The keys read with Tx.Get are checked when the transaction
+// commits, and if any of them has been written since, including by a
+// Put outside any transaction, the writes are discarded and fn is run
+// again in a new transaction after a randomized backoff. Since the
+// writes of a key are told apart by their versions, the table must
+// keep snapshots; ErrSnapshotsDisabled is returned otherwise.
+// ErrConflict is returned if the transaction still conflicts after
+// 100 attempts. Errors returned by fn are returned as they are, and
+// nothing is written.
+func (tbl Table) Update(fn func(tx *Tx) error) error {
+	if tbl.readOnly {
+		return ErrReadOnly
+	}
+	if !tbl.keepSnapshots {
+		return ErrSnapshotsDisabled
+	}
+	backoff := minTxBackoff
+	for attempt := 1; ; attempt++ {
+		tx := &Tx{
+			batch:  tbl.NewBatch(),
+			reads:  map[string]Version{},
+			writes: map[string][]byte{},
+		}
+		err := fn(tx)
+		if err == nil {
+			err = tx.commit()
+		}
+		if !errors.Is(err, ErrConflict) || attempt == maxTxAttempts {
+			return err
+		}
+		time.Sleep(backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1)))
+		if backoff *= 2; backoff > maxTxBackoff {
+			backoff = maxTxBackoff
+		}
+	}
+}
+
+// Get gets the latest value of the key like Table.Get, or the value
+// written by the transaction if the key was written by it. The key is
+// checked for writes by others when the transaction commits, whether
+// or not it exists.
+func (tx *Tx) Get(key []byte) ([]byte, error) {
+	if value, ok := tx.writes[string(key)]; ok {
+		if value == nil {
+			return nil, os.ErrNotExist
+		}
+		return append([]byte(nil), value...), nil
+	}
+	value, version, err := tx.batch.tbl.getLatest(key)
+	if _, ok := tx.reads[string(key)]; !ok && (err == nil || os.IsNotExist(err) || err == ErrNoSnapshots) {
+		tx.reads[string(key)] = version
+	}
+	return value, err
+}
+
+// Put stages writing the value to the key.
+func (tx *Tx) Put(key, value []byte) {
+	tx.batch.Put(key, value)
+	tx.writes[string(key)] = append([]byte{}, value...)
+}
+
+// Remove stages removing the key.
+func (tx *Tx) Remove(key []byte) {
+	tx.batch.Remove(key)
+	tx.writes[string(key)] = nil
+}
+
+// commit commits the writes of the transaction if the keys it read
+// haven't been written since. ErrConflict is returned otherwise.
+func (tx *Tx) commit() error {
+	tbl := tx.batch.tbl
+	keys := make([][]byte, 0, len(tx.reads))
+	for key := range tx.reads {
+		keys = append(keys, []byte(key))
+	}
+	return tx.batch.commit(keys, func() error {
+		for key, read := range tx.reads {
+			version, err := tbl.latestVersion(tbl.keyPath([]byte(key)))
+			if err != nil {
+				return err
+			}
+			if version != read {
+				return ErrConflict
+			}
+		}
+		return nil
+	})
+}
+
+// getLatest gets the latest value of the key and its version. The
+// version is zero if the key doesn't exist or has no snapshots.
+func (tbl Table) getLatest(key []byte) ([]byte, Version, error) {
+	sf, err := tbl.openKeySnapshots(key)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer sf.Close()
+	last, err := sf.Last()
+	if err != nil {
+		return nil, 0, err
+	}
+	value, err := tbl.value(sf, last)
+	return value, infoVersion(last.Info), err
+}
+
+// latestVersion returns the version of the key file at path, which
+// is zero if the file doesn't exist or has no snapshots. The caller
+// must hold the lock of the key.
+func (tbl Table) latestVersion(path string) (Version, error) {
+	sf, err := tbl.openSnapshots(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer sf.Close()
+	last, err := sf.Last()
+	if err == ErrNoSnapshots {
+		return 0, nil
+	}
+	return infoVersion(last.Info), err
+}
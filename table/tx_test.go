@@ -0,0 +1,124 @@
+package table
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/jaeyeom/gofiletable/filesystem"
+)
+
+// increment adds one to the counter stored in the key.
+func increment(tx *Tx, key []byte) error {
+	value, err := tx.Get(key)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	n := 0
+	if value != nil {
+		if n, err = strconv.Atoi(string(value)); err != nil {
+			return err
+		}
+	}
+	tx.Put(key, []byte(strconv.Itoa(n+1)))
+	return nil
+}
+
+func TestUpdateConcurrentCounters(t *testing.T) {
+	const (
+		writers    = 8
+		increments = 20
+	)
+	tbl, err := Create(TableOption{BaseDirectory: "/test-table", FileSystem: filesystem.NewMemoryFileSystem(), KeepSnapshots: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < increments; j++ {
+				err := tbl.Update(func(tx *Tx) error {
+					if err := increment(tx, []byte("a")); err != nil {
+						return err
+					}
+					return increment(tx, []byte("b"))
+				})
+				if err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	for _, key := range []string{"a", "b"} {
+		value, err := tbl.Get([]byte(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := strconv.Itoa(writers * increments); string(value) != want {
+			t.Errorf("Get(%s) = %s, want %s", key, value, want)
+		}
+	}
+}
+
+func TestUpdateConflict(t *testing.T) {
+	tbl, err := Create(TableOption{BaseDirectory: "/test-table", FileSystem: filesystem.NewMemoryFileSystem(), KeepSnapshots: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tbl.Put([]byte("counter"), []byte("1"))
+	attempts := 0
+	err = tbl.Update(func(tx *Tx) error {
+		attempts++
+		if err := increment(tx, []byte("counter")); err != nil {
+			return err
+		}
+		if attempts == 1 {
+			// Written by another writer after the transaction read it.
+			tbl.Put([]byte("counter"), []byte("10"))
+		}
+		if value, err := tx.Get([]byte("counter")); err != nil || string(value) == "10" {
+			t.Errorf("Get() in the transaction = %s, %v, want its own write", value, err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 2 {
+		t.Errorf("attempts = %d, want 2", attempts)
+	}
+	if value, _ := tbl.Get([]byte("counter")); string(value) != "11" {
+		t.Errorf("Get() = %s, want 11", value)
+	}
+}
+
+func TestUpdateErrors(t *testing.T) {
+	tbl, err := Create(TableOption{BaseDirectory: "/test-table", FileSystem: filesystem.NewMemoryFileSystem(), KeepSnapshots: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	errAbort := errors.New("abort")
+	err = tbl.Update(func(tx *Tx) error {
+		tx.Put([]byte("a"), []byte("value"))
+		return errAbort
+	})
+	if err != errAbort {
+		t.Errorf("Update() error = %v, want %v", err, errAbort)
+	}
+	if _, err := tbl.Get([]byte("a")); !os.IsNotExist(err) {
+		t.Errorf("Get() after an aborted transaction error = %v, want not exist", err)
+	}
+
+	plain, err := Create(TableOption{BaseDirectory: "/plain-table", FileSystem: filesystem.NewMemoryFileSystem()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := plain.Update(func(tx *Tx) error { return nil }); err != ErrSnapshotsDisabled {
+		t.Errorf("Update() on a plain table error = %v, want %v", err, ErrSnapshotsDisabled)
+	}
+}
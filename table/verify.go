@@ -0,0 +1,185 @@
+package table
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Problem is a problem found by Verify in a file of the table.
+type Problem struct {
+	Path string // Path of the file
+	Err  error  // What is wrong, a *CorruptError for corrupt data
+}
+
+// VerifyReport describes what Verify found, and what Repair did about
+// it.
+type VerifyReport struct {
+	Keys      int // Number of key files checked
+	Snapshots int // Number of snapshots checked
+	Problems  []Problem
+
+	// Repaired are key files truncated to the last good snapshot.
+	Repaired []string
+
+	// Quarantined are key files moved into the lost+found
+	// subdirectory because they had no good snapshot or their
+	// names were not encoded keys.
+	Quarantined []string
+}
+
+// Verify checks every key file of the table and reports the problems
+// it finds. The names of the files must be encoded keys. If the table
+// keeps snapshots, the headers must parse, the byte sizes of the
+// snapshots must add up to the file size, the timestamps must not
+// decrease, and the checksums, if the file has them, must match, so
+// every value is read. Verify stops early with the error of ctx if
+// ctx is done.
+func (tbl Table) Verify(ctx context.Context) (*VerifyReport, error) {
+	return tbl.verify(ctx, false)
+}
+
+// Repair verifies the table like Verify and fixes the problems it can.
+// Key files are truncated to the last good snapshot before the first
+// corrupt one, and files without a good snapshot or whose names are
+// not encoded keys are moved into the lost+found subdirectory. Out of
+// order timestamps are reported but left as they are. Repair waits
+// for ongoing reads and writes and blocks new ones until it finishes.
+func (tbl Table) Repair(ctx context.Context) (*VerifyReport, error) {
+	if tbl.readOnly {
+		return nil, ErrReadOnly
+	}
+	tbl.locks.lockAll()
+	defer tbl.locks.unlockAll()
+	if err := tbl.batches.check(); err != nil {
+		return nil, err
+	}
+	return tbl.verify(ctx, true)
+}
+
+// verify implements Verify, and Repair if repair is true.
+func (tbl Table) verify(ctx context.Context, repair bool) (*VerifyReport, error) {
+	// Files are moved while repairing, so they are listed first.
+	var paths []string
+	err := tbl.walkKeyFiles(func(path string, info os.FileInfo) error {
+		paths = append(paths, path)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	report := &VerifyReport{}
+	for _, path := range paths {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if err := tbl.verifyKeyFile(path, repair, report); err != nil {
+			return nil, err
+		}
+	}
+	return report, nil
+}
+
+// verifyKeyFile checks the key file at path and adds what it finds to
+// report. If repair is true, the file is fixed and the caller must
+// hold all the key locks.
+func (tbl Table) verifyKeyFile(path string, repair bool, report *VerifyReport) error {
+	key, err := tbl.pathKey(path)
+	if os.IsNotExist(err) {
+		// Removed since it was listed.
+		return nil
+	}
+	if errors.Is(err, ErrInvalidKeyName) || errors.Is(err, ErrCorrupt) {
+		report.Problems = append(report.Problems, Problem{path, err})
+		if !repair {
+			return nil
+		}
+		report.Quarantined = append(report.Quarantined, path)
+		return tbl.quarantine(path)
+	}
+	if err != nil {
+		return err
+	}
+	lock := tbl.locks.of(key)
+	if !repair {
+		lock.RLock()
+	}
+	f, err := tbl.fileSystem.Open(path)
+	var size int64
+	if err == nil {
+		if size, err = tbl.fileSize(path, f); err != nil {
+			f.Close()
+		}
+	}
+	if !repair {
+		lock.RUnlock()
+	}
+	if os.IsNotExist(err) {
+		// Removed since it was listed.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	report.Keys++
+	if !tbl.keepSnapshots {
+		return f.Close()
+	}
+	sf, good, err := verifySnapshots(path, f, size, key, report)
+	if _, ok := err.(*CorruptError); !ok {
+		f.Close()
+		return err
+	}
+	report.Problems = append(report.Problems, Problem{path, err})
+	if !repair {
+		return f.Close()
+	}
+	quarantined, err := tbl.fixKeyFile(path, f, sf, good)
+	if quarantined {
+		report.Quarantined = append(report.Quarantined, path)
+	} else {
+		report.Repaired = append(report.Repaired, path)
+	}
+	return err
+}
+
+// verifySnapshots checks the snapshot file at path, which is opened as
+// f, of the key. The size of the file is size. The checked snapshots
+// and the snapshots out of order are added to report. If the file is
+// corrupt, the *CorruptError is returned with the good records before
+// the corruption.
+func verifySnapshots(path string, f io.Reader, size int64, key []byte, report *VerifyReport) (*snapshotFile, []record, error) {
+	sf, err := openSnapshotFile(f, size, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	records, end, err := sf.scan()
+	if err == nil && end < size {
+		err = sf.corrupt(len(records), end, errTrailingData)
+	}
+	for i, rec := range records {
+		if _, valueErr := sf.Value(rec); valueErr != nil {
+			return sf, records[:i], valueErr
+		}
+		if i > 0 && outOfOrder(records[i-1].Info, rec.Info) {
+			report.Problems = append(report.Problems, Problem{
+				Path: path,
+				Err:  fmt.Errorf("%w: snapshot %d of key %q", ErrTimestampOrder, i, key),
+			})
+		}
+		report.Snapshots++
+	}
+	return sf, records, err
+}
+
+// outOfOrder returns true if the snapshot next can't follow prev. They
+// are ordered by their sequence numbers, or by their timestamps if
+// either has none.
+func outOfOrder(prev, next SnapshotInfo) bool {
+	if prev.Sequence != 0 && next.Sequence != 0 {
+		return next.Sequence <= prev.Sequence
+	}
+	return next.Timestamp < prev.Timestamp
+}
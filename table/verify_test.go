@@ -0,0 +1,99 @@
+package table
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/jaeyeom/gofiletable/filesystem"
+)
+
+func TestVerifyAndRepair(t *testing.T) {
+	mfs := filesystem.NewMemoryFileSystem()
+	tbl, err := Create(TableOption{BaseDirectory: "/test-table", FileSystem: mfs, KeepSnapshots: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tbl.Put([]byte("good"), []byte("value"))
+	for _, value := range []string{"first", "second", "third"} {
+		tbl.Put([]byte("flipped"), []byte(value))
+	}
+	flipped := tbl.keyPath([]byte("flipped"))
+	content := []byte(readFile(t, mfs, flipped))
+	second := bytes.Index(content, []byte("second"))
+	content[second] ^= 0x01
+	mfs.WriteFile(flipped, content, 0600)
+	garbage := tbl.keyPath([]byte("garbage"))
+	mfs.WriteFile(garbage, []byte{0x7f}, 0600)
+	invalid := filepath.Join("/test-table", "not*a*key")
+	mfs.WriteFile(invalid, []byte("value"), 0600)
+	tbl.PutSnapshots([]byte("unordered"), []Snapshot{
+		{SnapshotInfo{Timestamp: 200, ByteSize: 5, Sequence: 2}, []byte("later")},
+		{SnapshotInfo{Timestamp: 100, ByteSize: 7, Sequence: 1}, []byte("earlier")},
+	})
+
+	errorsOf := func(report *VerifyReport) map[string]error {
+		errs := map[string]error{}
+		for _, problem := range report.Problems {
+			errs[problem.Path] = problem.Err
+		}
+		return errs
+	}
+	report, err := tbl.Verify(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs := errorsOf(report)
+	if len(errs) != 4 {
+		t.Errorf("Verify() found %v; want 4 problems", report.Problems)
+	}
+	var corrupt *CorruptError
+	if !errors.As(errs[flipped], &corrupt) || corrupt.Index != 1 || corrupt.Offset != int64(second) {
+		t.Errorf("Verify() found %v in flipped; want snapshot 1 at offset %d to be corrupt", errs[flipped], second)
+	}
+	if !errors.As(errs[garbage], &corrupt) || corrupt.Index != -1 {
+		t.Errorf("Verify() found %v in garbage; want the header to be corrupt", errs[garbage])
+	}
+	if errs[invalid] != ErrInvalidKeyName {
+		t.Errorf("Verify() found %v in %s; want %v", errs[invalid], invalid, ErrInvalidKeyName)
+	}
+	if unordered := tbl.keyPath([]byte("unordered")); !errors.Is(errs[unordered], ErrTimestampOrder) {
+		t.Errorf("Verify() found %v in unordered; want %v", errs[unordered], ErrTimestampOrder)
+	}
+	if report.Keys != 4 || report.Snapshots != 4 {
+		t.Errorf("Verify() checked %d keys and %d snapshots; want 4 and 4", report.Keys, report.Snapshots)
+	}
+	if report.Repaired != nil || report.Quarantined != nil {
+		t.Errorf("Verify() changed files: %+v", report)
+	}
+
+	report, err = tbl.Repair(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{flipped}; !reflect.DeepEqual(report.Repaired, want) {
+		t.Errorf("Repair() repaired %q; want %q", report.Repaired, want)
+	}
+	if want := []string{garbage, invalid}; !reflect.DeepEqual(report.Quarantined, want) {
+		t.Errorf("Repair() quarantined %q; want %q", report.Quarantined, want)
+	}
+	if value, err := tbl.Get([]byte("flipped")); err != nil || string(value) != "first" {
+		t.Errorf(`Get("flipped") = %q, %v; want "first"`, value, err)
+	}
+	report, err = tbl.Verify(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Problems) != 1 || !errors.Is(report.Problems[0].Err, ErrTimestampOrder) {
+		t.Errorf("Verify() after Repair() found %v; want only the timestamp order", report.Problems)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := tbl.Verify(ctx); err != context.Canceled {
+		t.Errorf("Verify() with a canceled context = %v; want %v", err, context.Canceled)
+	}
+}
@@ -0,0 +1,138 @@
+package table
+
+import (
+	"fmt"
+	"os"
+)
+
+// Version identifies the latest value of a key, for writes
+// conditioned on it. It is the sequence number of the latest snapshot,
+// or its timestamp if it has none, and zero if the key doesn't exist
+// or has no snapshots.
+type Version uint64
+
+// infoVersion returns the version of the key whose latest snapshot has
+// the info.
+func infoVersion(info SnapshotInfo) Version {
+	if info.Sequence != 0 {
+		return Version(info.Sequence)
+	}
+	return Version(info.Timestamp)
+}
+
+// VersionMismatchError is returned by a conditional write when the
+// key is not at the expected version. It matches ErrVersionMismatch
+// with errors.Is.
+type VersionMismatchError struct {
+	Key      []byte
+	Expected Version
+	Current  Version // Version found, to retry with
+}
+
+func (e *VersionMismatchError) Error() string {
+	return fmt.Sprintf("gofiletable: key %q is at version %d, not %d", e.Key, e.Current, e.Expected)
+}
+
+// Is returns true if target is ErrVersionMismatch.
+func (e *VersionMismatchError) Is(target error) bool {
+	return target == ErrVersionMismatch
+}
+
+// Version returns the current version of the key. It is zero if the
+// key doesn't exist. ErrSnapshotsDisabled is returned if the table
+// doesn't keep snapshots, since its keys have no versions.
+func (tbl Table) Version(key []byte) (Version, error) {
+	if !tbl.keepSnapshots {
+		return 0, ErrSnapshotsDisabled
+	}
+	lock := tbl.locks.of(key)
+	lock.RLock()
+	defer lock.RUnlock()
+	return tbl.latestVersion(tbl.keyPath(key))
+}
+
+// checkVersion returns a *VersionMismatchError if the key is not at
+// the expected version. The caller must hold the lock of the key.
+func (tbl Table) checkVersion(key []byte, expected Version) error {
+	current, err := tbl.latestVersion(tbl.keyPath(key))
+	if err != nil {
+		return err
+	}
+	if current != expected {
+		return &VersionMismatchError{Key: key, Expected: expected, Current: current}
+	}
+	return nil
+}
+
+// PutVersion writes the value to the key like Put, and returns the
+// version written, which is zero if the table doesn't keep snapshots.
+func (tbl Table) PutVersion(key, value []byte) (Version, error) {
+	if tbl.readOnly {
+		return 0, ErrReadOnly
+	}
+	lock := tbl.locks.of(key)
+	lock.Lock()
+	defer lock.Unlock()
+	if err := tbl.batches.check(); err != nil {
+		return 0, err
+	}
+	return tbl.put(key, value)
+}
+
+// PutIf writes the value to the key like Put if the key is at the
+// expected version, and returns the version written. A
+// *VersionMismatchError with the current version is returned
+// otherwise. An expected version of zero writes the key only if it
+// doesn't exist. ErrSnapshotsDisabled is returned if the table doesn't
+// keep snapshots.
+func (tbl Table) PutIf(key, value []byte, expected Version) (Version, error) {
+	if tbl.readOnly {
+		return 0, ErrReadOnly
+	}
+	if !tbl.keepSnapshots {
+		return 0, ErrSnapshotsDisabled
+	}
+	lock := tbl.locks.of(key)
+	lock.Lock()
+	defer lock.Unlock()
+	if err := tbl.batches.check(); err != nil {
+		return 0, err
+	}
+	if err := tbl.checkVersion(key, expected); err != nil {
+		return 0, err
+	}
+	return tbl.put(key, value)
+}
+
+// PutIfAbsent writes the value to the key like Put if the key doesn't
+// exist, and returns the version written. A *VersionMismatchError with
+// the current version is returned otherwise.
+func (tbl Table) PutIfAbsent(key, value []byte) (Version, error) {
+	return tbl.PutIf(key, value, 0)
+}
+
+// RemoveIf removes the key if it is at the expected version, and
+// returns a *VersionMismatchError with the current version otherwise.
+// ErrSnapshotsDisabled is returned if the table doesn't keep
+// snapshots.
+func (tbl Table) RemoveIf(key []byte, expected Version) error {
+	if tbl.readOnly {
+		return ErrReadOnly
+	}
+	if !tbl.keepSnapshots {
+		return ErrSnapshotsDisabled
+	}
+	lock := tbl.locks.of(key)
+	lock.Lock()
+	defer lock.Unlock()
+	if err := tbl.batches.check(); err != nil {
+		return err
+	}
+	if err := tbl.checkVersion(key, expected); err != nil {
+		return err
+	}
+	if err := tbl.removeKeyFile(key, tbl.keyPath(key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package table
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/jaeyeom/gofiletable/filesystem"
+)
+
+func TestPutIf(t *testing.T) {
+	tbl, err := Create(TableOption{BaseDirectory: "/test-table", FileSystem: filesystem.NewMemoryFileSystem(), KeepSnapshots: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := []byte("key")
+	if v, err := tbl.Version(key); err != nil || v != 0 {
+		t.Fatalf("Version() of a missing key = %d, %v, want 0", v, err)
+	}
+	first, err := tbl.PutIfAbsent(key, []byte("first"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := tbl.Version(key); err != nil || first == 0 || v != first {
+		t.Fatalf("Version() = %d, %v, want the written %d", v, err, first)
+	}
+	_, err = tbl.PutIfAbsent(key, []byte("again"))
+	var mismatch *VersionMismatchError
+	if !errors.As(err, &mismatch) || mismatch.Current != first || mismatch.Expected != 0 {
+		t.Errorf("PutIfAbsent() on an existing key error = %v, want a mismatch at %d", err, first)
+	}
+	second, err := tbl.PutIf(key, []byte("second"), first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tbl.PutIf(key, []byte("stale"), first); !errors.Is(err, ErrVersionMismatch) {
+		t.Errorf("PutIf() with a stale version error = %v, want %v", err, ErrVersionMismatch)
+	}
+	if value, _ := tbl.Get(key); string(value) != "second" {
+		t.Errorf("Get() = %s, want second", value)
+	}
+	if v, _ := tbl.Version(key); v != second {
+		t.Errorf("Version() = %d, want the written %d", v, second)
+	}
+	if err := tbl.RemoveIf(key, first); !errors.Is(err, ErrVersionMismatch) {
+		t.Errorf("RemoveIf() with a stale version error = %v, want %v", err, ErrVersionMismatch)
+	}
+	if err := tbl.RemoveIf(key, second); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tbl.Get(key); !os.IsNotExist(err) {
+		t.Errorf("Get() after RemoveIf error = %v, want not exist", err)
+	}
+
+	plain, err := Create(TableOption{BaseDirectory: "/plain-table", FileSystem: filesystem.NewMemoryFileSystem()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := plain.PutIfAbsent(key, []byte("value")); err != ErrSnapshotsDisabled {
+		t.Errorf("PutIfAbsent() on a plain table error = %v, want %v", err, ErrSnapshotsDisabled)
+	}
+}
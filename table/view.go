@@ -0,0 +1,390 @@
+package table
+
+import (
+	"context"
+	"fmt"
+	"iter"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ReadView is a read-only view of a table as of a single point in
+// time, across all keys, while writers go on. It sees exactly the
+// snapshots whose sequence numbers are up to the cut of the view, and
+// those without sequence numbers written at or before its time.
+//
+// The view can't read snapshots dropped by the retention policy or
+// keys removed after its cut, since their history is gone. Key files
+// record the sequence numbers of the snapshots they dropped, and
+// Remove leaves a marker recording the removal, so for such keys the
+// view returns a *SnapshotExpiredError instead of an older value or
+// leaving the key out. The check is conservative: a key whose
+// snapshots were thinned out around the cut may be reported even if
+// the snapshot the view sees survived.
+//
+// Compact prunes the removal markers of removals that all the open
+// views of the Table see. A view whose cut is before a pruned removal,
+// such as a closed view, a view of a time before it or a view opened
+// by another process, can't tell which keys were removed, so it
+// reports every key it doesn't see as expired, and its listings
+// return ErrSnapshotExpired.
+type ReadView struct {
+	tbl Table
+	at  uint64 // Timestamp of the view
+	cut uint64 // Greatest sequence number seen by the view
+}
+
+// viewSet is the set of the open read views of a table, whose cuts
+// keep the removal markers they need from being pruned. It is shared
+// by the copies of a Table.
+type viewSet struct {
+	mu    sync.Mutex
+	views map[*ReadView]bool
+}
+
+// add adds the view to the set.
+func (s *viewSet) add(v *ReadView) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.views == nil {
+		s.views = map[*ReadView]bool{}
+	}
+	s.views[v] = true
+}
+
+// remove removes the view from the set.
+func (s *viewSet) remove(v *ReadView) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.views, v)
+}
+
+// min returns the least cut of the views in the set, and false if the
+// set is empty.
+func (s *viewSet) min() (uint64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var cut uint64
+	found := false
+	for v := range s.views {
+		if !found || v.cut < cut {
+			cut, found = v.cut, true
+		}
+	}
+	return cut, found
+}
+
+// SnapshotExpiredError is returned by a read view for a key whose
+// snapshots it may see were dropped by the retention policy or
+// removed after the view was created. It matches ErrSnapshotExpired
+// with errors.Is.
+type SnapshotExpiredError struct {
+	Key []byte
+}
+
+func (e *SnapshotExpiredError) Error() string {
+	return fmt.Sprintf("gofiletable: snapshots of key %q seen by the view are gone", e.Key)
+}
+
+// Is returns true if target is ErrSnapshotExpired.
+func (e *SnapshotExpiredError) Is(target error) bool {
+	return target == ErrSnapshotExpired
+}
+
+// ReadView returns a view of the table as of the time at. A time that
+// is not before the current time of the table clock is the present:
+// the view sees all writes that finished before ReadView returned, and
+// ReadView waits for the ongoing ones. For a time in the past, the
+// cut is the greatest sequence number of the snapshots and removals
+// done at or before at, which is found by reading the headers of all
+// key files and removal markers. The view should be closed when it is
+// no longer used. ErrSnapshotsDisabled is returned if the table
+// doesn't keep snapshots.
+func (tbl Table) ReadView(at time.Time) (*ReadView, error) {
+	if !tbl.keepSnapshots {
+		return nil, ErrSnapshotsDisabled
+	}
+	now := tbl.clock.Now()
+	stable, err := tbl.stableSequence()
+	if err != nil {
+		return nil, err
+	}
+	if !at.Before(now) {
+		view := &ReadView{tbl: tbl, at: timestamp(now), cut: stable}
+		tbl.views.add(view)
+		return view, nil
+	}
+	view := &ReadView{tbl: tbl, at: timestamp(at)}
+	for key, err := range tbl.IterKeys(context.Background()) {
+		if err != nil {
+			return nil, err
+		}
+		records, err := view.records(key)
+		if os.IsNotExist(err) {
+			// Removed since it was listed.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, rec := range records {
+			view.observe(rec.Info, stable)
+		}
+	}
+	err = tbl.walkMarkers(func(path string) error {
+		sf, err := tbl.openSnapshots(path)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		defer sf.Close()
+		view.observe(sf.header.removed, stable)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// The pruned markers are represented by the latest of them.
+	pruned, err := tbl.prunedRemoval()
+	if err != nil {
+		return nil, err
+	}
+	view.observe(pruned, stable)
+	tbl.views.add(view)
+	return view, nil
+}
+
+// observe moves the cut of the view being created to the sequence
+// number of the change with the info if it is done at or before the
+// time of the view and its sequence number is not after stable.
+func (v *ReadView) observe(info SnapshotInfo, stable uint64) {
+	seq := info.Sequence
+	if seq > v.cut && seq <= stable && info.Timestamp <= v.at {
+		v.cut = seq
+	}
+}
+
+// Close releases the view, so that Compact may prune the removal
+// markers it needs. The view can still be read after Close.
+func (v *ReadView) Close() error {
+	v.tbl.views.remove(v)
+	return nil
+}
+
+// checkPruned returns ErrSnapshotExpired if removal markers the view
+// needs may have been pruned.
+func (v *ReadView) checkPruned() error {
+	pruned, err := v.tbl.prunedRemoval()
+	if err != nil {
+		return err
+	}
+	if pruned.Sequence > v.cut {
+		return ErrSnapshotExpired
+	}
+	return nil
+}
+
+// Sequence returns the cut of the view, which is the greatest sequence
+// number it sees.
+func (v *ReadView) Sequence() uint64 {
+	return v.cut
+}
+
+// visible returns true if the view sees the snapshot with the info.
+func (v *ReadView) visible(info SnapshotInfo) bool {
+	if info.Sequence == 0 {
+		return info.Timestamp <= v.at
+	}
+	return info.Sequence <= v.cut
+}
+
+// records returns the records of the snapshots of the key.
+func (v *ReadView) records(key []byte) ([]record, error) {
+	sf, err := v.tbl.openKeySnapshots(key)
+	if err != nil {
+		return nil, err
+	}
+	defer sf.Close()
+	return sf.Records()
+}
+
+// find returns the key file of the key, opened, with its records and
+// the index of the latest record the view sees, which is -1 if the
+// view sees none or sees a later removal of the key. sf is nil if the
+// key file doesn't exist. A *SnapshotExpiredError is returned if
+// snapshots the view may see are gone. The caller must hold the lock
+// of the key.
+func (v *ReadView) find(key []byte) (sf *snapshotFile, records []record, found int, err error) {
+	name, _ := v.tbl.fileName(key)
+	marker, err := v.tbl.readMarker(name)
+	if err != nil {
+		return nil, nil, -1, err
+	}
+	lost := marker.lost
+	sf, err = v.tbl.openSnapshots(v.tbl.keyPath(key))
+	if err == nil {
+		if records, err = sf.Records(); err != nil {
+			sf.Close()
+			return nil, nil, -1, err
+		}
+		lost = lost.merge(sf.header.lost)
+	} else if os.IsNotExist(err) {
+		sf = nil
+	} else {
+		return nil, nil, -1, err
+	}
+	found = -1
+	for i, rec := range records {
+		if v.visible(rec.Info) && (found < 0 || rec.Info.Sequence >= records[found].Info.Sequence) {
+			found = i
+		}
+	}
+	// Sequence number of the latest change of the key the view sees
+	var latest uint64
+	if found >= 0 {
+		latest = records[found].Info.Sequence
+	}
+	if removed := marker.removed; removed.Sequence > latest && removed.Sequence <= v.cut {
+		latest, found = removed.Sequence, -1
+	}
+	expired := lost.last > latest && lost.first <= v.cut
+	if !expired && found < 0 {
+		if err := v.checkPruned(); err == ErrSnapshotExpired {
+			expired = true
+		} else if err != nil {
+			if sf != nil {
+				sf.Close()
+			}
+			return nil, nil, -1, err
+		}
+	}
+	if expired {
+		if sf != nil {
+			sf.Close()
+		}
+		return nil, nil, -1, &SnapshotExpiredError{Key: key}
+	}
+	return sf, records, found, nil
+}
+
+// Get gets the value of the key as of the view, which is the value of
+// the latest snapshot the view sees. A not exist error is returned if
+// the view sees no snapshot of the key, and a *SnapshotExpiredError if
+// snapshots it may see are gone.
+func (v *ReadView) Get(key []byte) ([]byte, error) {
+	lock := v.tbl.locks.of(key)
+	lock.RLock()
+	defer lock.RUnlock()
+	sf, records, found, err := v.find(key)
+	if err != nil {
+		return nil, err
+	}
+	if sf != nil {
+		defer sf.Close()
+	}
+	if found < 0 {
+		return nil, os.ErrNotExist
+	}
+	return v.tbl.value(sf, records[found])
+}
+
+// exists returns true if the view sees a snapshot of the key.
+func (v *ReadView) exists(key []byte) (bool, error) {
+	lock := v.tbl.locks.of(key)
+	lock.RLock()
+	defer lock.RUnlock()
+	sf, _, found, err := v.find(key)
+	if err != nil {
+		return false, err
+	}
+	if sf != nil {
+		sf.Close()
+	}
+	return found >= 0, nil
+}
+
+// IterKeys returns an iterator over the keys the view sees in no
+// particular order, like Table.IterKeys. Keys removed since the view
+// was created are listed from their removal markers. A
+// *SnapshotExpiredError is yielded for each key whose snapshots the
+// view may see are gone, and the iteration goes on if the caller
+// continues.
+func (v *ReadView) IterKeys(ctx context.Context) iter.Seq2[[]byte, error] {
+	return func(yield func([]byte, error) bool) {
+		listed := map[string]bool{}
+		check := func(key []byte, err error) bool {
+			if err == nil {
+				var ok bool
+				if ok, err = v.exists(key); err == nil && !ok {
+					return true
+				}
+			}
+			if err != nil {
+				key = nil
+			}
+			return yield(key, err)
+		}
+		for key, err := range v.tbl.IterKeys(ctx) {
+			if err == nil {
+				listed[string(key)] = true
+			}
+			if !check(key, err) {
+				return
+			}
+		}
+		stopped := false
+		err := v.tbl.walkMarkers(func(path string) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			key, err := v.tbl.pathKey(path)
+			if os.IsNotExist(err) || (err == nil && listed[string(key)]) {
+				return nil
+			}
+			if !check(key, err) {
+				stopped = true
+				return filepath.SkipAll
+			}
+			return nil
+		})
+		if err == nil {
+			err = v.checkPruned()
+		}
+		if err != nil && !stopped {
+			yield(nil, err)
+		}
+	}
+}
+
+// Scan returns the keys the view sees from start inclusive to end
+// exclusive in lexicographic byte order, like Table.Scan, with their
+// values as of the view if the values are read. Keys removed since the
+// view was created are listed from their removal markers, and a
+// *SnapshotExpiredError is returned if snapshots the view may see of
+// a key in the range are gone.
+func (v *ReadView) Scan(start, end []byte, option ScanOption) ([]ScanItem, error) {
+	if err := v.checkPruned(); err != nil {
+		return nil, err
+	}
+	get := v.Get
+	if !option.Values {
+		get = func(key []byte) ([]byte, error) {
+			ok, err := v.exists(key)
+			if err == nil && !ok {
+				err = os.ErrNotExist
+			}
+			return nil, err
+		}
+	}
+	return v.tbl.scan(start, end, option, true, get)
+}
+
+// ScanPrefix returns the keys the view sees starting with the prefix
+// in lexicographic byte order, like Scan.
+func (v *ReadView) ScanPrefix(prefix []byte, option ScanOption) ([]ScanItem, error) {
+	return v.Scan(prefix, PrefixEnd(prefix), option)
+}
@@ -0,0 +1,414 @@
+package table
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jaeyeom/gofiletable/filesystem"
+)
+
+// viewKeys returns the sorted keys the view sees.
+func viewKeys(t *testing.T, view *ReadView) []string {
+	var keys []string
+	for key, err := range view.IterKeys(context.Background()) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, string(key))
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestReadView(t *testing.T) {
+	clock := &fakeClock{time.Unix(0, 100)}
+	tbl, err := Create(TableOption{BaseDirectory: "/test-table", FileSystem: filesystem.NewMemoryFileSystem(), KeepSnapshots: true, Clock: clock})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tbl.Put([]byte("a"), []byte("a1"))
+	clock.now = time.Unix(0, 200)
+	tbl.Put([]byte("b"), []byte("b1"))
+	clock.now = time.Unix(0, 300)
+	present, err := tbl.ReadView(clock.now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tbl.Put([]byte("a"), []byte("a2"))
+	tbl.Put([]byte("c"), []byte("c1"))
+
+	examples := []struct {
+		name   string
+		at     int64
+		view   *ReadView
+		values map[string]string
+	}{
+		{"present", 300, present, map[string]string{"a": "a1", "b": "b1"}},
+		{"past", 150, nil, map[string]string{"a": "a1"}},
+		{"past after the view", 300, nil, map[string]string{"a": "a2", "b": "b1", "c": "c1"}},
+	}
+	clock.now = time.Unix(0, 400)
+	for _, example := range examples {
+		view := example.view
+		if view == nil {
+			if view, err = tbl.ReadView(time.Unix(0, example.at)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		items, err := view.Scan(nil, nil, ScanOption{Values: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		values := map[string]string{}
+		for _, item := range items {
+			values[string(item.Key)] = string(item.Value)
+		}
+		if !reflect.DeepEqual(values, example.values) {
+			t.Errorf("%s: Scan() = %v, want %v", example.name, values, example.values)
+		}
+		var want []string
+		for key := range example.values {
+			want = append(want, key)
+		}
+		sort.Strings(want)
+		if got := viewKeys(t, view); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: IterKeys() = %q, want %q", example.name, got, want)
+		}
+		if _, ok := example.values["c"]; !ok {
+			if _, err := view.Get([]byte("c")); !os.IsNotExist(err) {
+				t.Errorf("%s: Get(c) error = %v, want not exist", example.name, err)
+			}
+		}
+	}
+
+	plain, err := Create(TableOption{BaseDirectory: "/plain-table", FileSystem: filesystem.NewMemoryFileSystem()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := plain.ReadView(time.Now()); err != ErrSnapshotsDisabled {
+		t.Errorf("ReadView() on a plain table error = %v, want %v", err, ErrSnapshotsDisabled)
+	}
+}
+
+func TestReadViewConsistent(t *testing.T) {
+	const (
+		transfers = 50
+		views     = 20
+		total     = 100
+	)
+	tbl, err := Create(TableOption{BaseDirectory: "/test-table", FileSystem: filesystem.NewMemoryFileSystem(), KeepSnapshots: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tbl.Put([]byte("a"), []byte(strconv.Itoa(total)))
+	tbl.Put([]byte("b"), []byte("0"))
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		// Move one unit at a time from a to b, so the sum stays the
+		// same in every consistent view.
+		for i := 1; i <= transfers; i++ {
+			b := tbl.NewBatch()
+			b.Put([]byte("a"), []byte(strconv.Itoa(total-i)))
+			b.Put([]byte("b"), []byte(strconv.Itoa(i)))
+			if err := b.Commit(); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	for i := 0; i < views; i++ {
+		view, err := tbl.ReadView(time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		sum := 0
+		for _, key := range []string{"a", "b"} {
+			value, err := view.Get([]byte(key))
+			if err != nil {
+				t.Fatal(err)
+			}
+			n, _ := strconv.Atoi(string(value))
+			sum += n
+		}
+		if sum != total {
+			t.Errorf("sum in view %d = %d, want %d", view.Sequence(), sum, total)
+		}
+	}
+	wg.Wait()
+}
+
+// checkExpired checks that the view reports the key as expired from
+// Get, Scan and IterKeys.
+func checkExpired(t *testing.T, name string, view *ReadView, key string) {
+	t.Helper()
+	var expired *SnapshotExpiredError
+	if _, err := view.Get([]byte(key)); !errors.As(err, &expired) || string(expired.Key) != key {
+		t.Errorf("%s: Get(%s) error = %v, want expired", name, key, err)
+	}
+	if _, err := view.Scan(nil, nil, ScanOption{}); !errors.Is(err, ErrSnapshotExpired) {
+		t.Errorf("%s: Scan() error = %v, want %v", name, err, ErrSnapshotExpired)
+	}
+	found := false
+	for _, err := range view.IterKeys(context.Background()) {
+		if errors.As(err, &expired) && string(expired.Key) == key {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("%s: IterKeys() didn't yield %s as expired", name, key)
+	}
+}
+
+func TestReadViewRetention(t *testing.T) {
+	clock := &fakeClock{time.Unix(0, 100)}
+	tbl, err := Create(TableOption{BaseDirectory: "/test-table", FileSystem: filesystem.NewMemoryFileSystem(), KeepSnapshots: true, Retention: KeepLast(1), Clock: clock})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tbl.Put([]byte("a"), []byte("a1"))
+	tbl.Put([]byte("b"), []byte("b1"))
+	clock.now = time.Unix(0, 200)
+	view, err := tbl.ReadView(clock.now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock.now = time.Unix(0, 300)
+	tbl.Put([]byte("a"), []byte("a2"))
+	tbl.Put([]byte("c"), []byte("c1"))
+	tbl.Put([]byte("c"), []byte("c2"))
+
+	checkExpired(t, "dropped after the view", view, "a")
+	if value, err := view.Get([]byte("b")); err != nil || string(value) != "b1" {
+		t.Errorf("Get(b) = %s, %v, want b1", value, err)
+	}
+	if _, err := view.Get([]byte("c")); !os.IsNotExist(err) {
+		t.Errorf("Get(c) written and dropped after the view error = %v, want not exist", err)
+	}
+	present, err := tbl.ReadView(clock.now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := viewKeys(t, present), []string{"a", "b", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("IterKeys() of a new view = %q, want %q", got, want)
+	}
+
+	// Reopened, the dropped snapshots are read from the key file.
+	tbl.Close()
+	option := TableOption{BaseDirectory: "/test-table", FileSystem: tbl.fileSystem, KeepSnapshots: true, Clock: clock}
+	if tbl, err = Open(option); err != nil {
+		t.Fatal(err)
+	}
+	defer tbl.Close()
+	if past, err := tbl.ReadView(time.Unix(0, 200)); err != nil {
+		t.Fatal(err)
+	} else if _, err := past.Get([]byte("a")); !errors.Is(err, ErrSnapshotExpired) {
+		t.Errorf("Get(a) of a past view after Open error = %v, want %v", err, ErrSnapshotExpired)
+	}
+}
+
+func TestReadViewRemove(t *testing.T) {
+	for _, batch := range []bool{false, true} {
+		name := "Remove"
+		remove := func(tbl *Table, key string) error {
+			return tbl.Remove([]byte(key))
+		}
+		if batch {
+			name = "Batch.Remove"
+			remove = func(tbl *Table, key string) error {
+				b := tbl.NewBatch()
+				b.Remove([]byte(key))
+				return b.Commit()
+			}
+		}
+		clock := &fakeClock{time.Unix(0, 100)}
+		tbl, err := Create(TableOption{BaseDirectory: "/test-table", FileSystem: filesystem.NewMemoryFileSystem(), KeepSnapshots: true, Clock: clock})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tbl.Put([]byte("a"), []byte("a1"))
+		tbl.Put([]byte("b"), []byte("b1"))
+		clock.now = time.Unix(0, 200)
+		view, err := tbl.ReadView(clock.now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		clock.now = time.Unix(0, 300)
+		if err := remove(tbl, "a"); err != nil {
+			t.Fatal(err)
+		}
+		tbl.Put([]byte("c"), []byte("c1"))
+		if err := remove(tbl, "c"); err != nil {
+			t.Fatal(err)
+		}
+
+		checkExpired(t, name, view, "a")
+		if _, err := view.Get([]byte("c")); !os.IsNotExist(err) {
+			t.Errorf("%s: Get(c) written and removed after the view error = %v, want not exist", name, err)
+		}
+		clock.now = time.Unix(0, 400)
+		present, err := tbl.ReadView(clock.now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := present.Get([]byte("a")); !os.IsNotExist(err) {
+			t.Errorf("%s: Get(a) of a view after the removal error = %v, want not exist", name, err)
+		}
+		if got, want := viewKeys(t, present), []string{"b"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: IterKeys() of a view after the removal = %q, want %q", name, got, want)
+		}
+		tbl.Put([]byte("a"), []byte("a2"))
+		checkExpired(t, name+" and Put", view, "a")
+		if _, err := present.Get([]byte("a")); !os.IsNotExist(err) {
+			t.Errorf("%s: Get(a) written again after the view error = %v, want not exist", name, err)
+		}
+		for _, example := range []struct {
+			at      int64
+			expired bool
+		}{{200, true}, {350, false}} {
+			past, err := tbl.ReadView(time.Unix(0, example.at))
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = past.Get([]byte("a"))
+			if expired := errors.Is(err, ErrSnapshotExpired); expired != example.expired || !expired && !os.IsNotExist(err) {
+				t.Errorf("%s: Get(a) of a view at %d error = %v, want expired %t", name, example.at, err, example.expired)
+			}
+		}
+	}
+}
+
+func TestReadViewGetWhilePut(t *testing.T) {
+	tbl, err := Create(TableOption{BaseDirectory: "/test-table", FileSystem: filesystem.NewMemoryFileSystem(), KeepSnapshots: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tbl.Put([]byte("key"), []byte("0"))
+	view, err := tbl.ReadView(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan bool)
+	go func() {
+		var wg sync.WaitGroup
+		for g := 0; g < 4; g++ {
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				for i := 1; i <= 500; i++ {
+					tbl.Put([]byte("key"), []byte(strconv.Itoa(i)))
+				}
+			}()
+			go func() {
+				defer wg.Done()
+				for i := 0; i < 500; i++ {
+					if value, err := view.Get([]byte("key")); err != nil || string(value) != "0" {
+						t.Errorf("Get() while Put = %q, %v; want 0", value, err)
+						return
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Get() of a view and Put() of the same key deadlocked")
+	}
+}
+
+// markerDepths returns the number of removal markers of the table at
+// each depth of subdirectories.
+func markerDepths(tbl *Table) map[int]int {
+	depths := map[int]int{}
+	tbl.walkMarkers(func(path string) error {
+		rel, _ := filepath.Rel(tbl.markerDirectory(), path)
+		depths[strings.Count(rel, string(filepath.Separator))]++
+		return nil
+	})
+	return depths
+}
+
+func TestReadViewPruneMarkers(t *testing.T) {
+	tbl, err := Create(TableOption{BaseDirectory: "/test-table", FileSystem: filesystem.NewMemoryFileSystem(), KeepSnapshots: true, ShardLevels: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a", "b", "c"} {
+		tbl.Put([]byte(key), []byte(key+"1"))
+	}
+	view, err := tbl.ReadView(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tbl.Remove([]byte("a"))
+	if got, want := markerDepths(tbl), map[int]int{1: 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("removal markers at depths %v; want %v", got, want)
+	}
+	if err := tbl.Reshard(context.Background(), 2); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := markerDepths(tbl), map[int]int{2: 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("removal markers after Reshard() at depths %v; want %v", got, want)
+	}
+	checkExpired(t, "Reshard", view, "a")
+
+	later, err := tbl.ReadView(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tbl.Remove([]byte("b"))
+	if report, err := tbl.Compact(false); err != nil || report.PrunedMarkers != 0 {
+		t.Errorf("Compact() with an open view before the removals = %+v, %v; want no pruned markers", report, err)
+	}
+	checkExpired(t, "Compact", view, "a")
+	view.Close()
+	if report, err := tbl.Compact(true); err != nil || report.PrunedMarkers != 1 {
+		t.Errorf("Compact(dryRun) = %+v, %v; want 1 pruned marker", report, err)
+	}
+	if got := len(markerDepths(tbl)); got == 0 {
+		t.Error("Compact(dryRun) pruned removal markers")
+	}
+	if report, err := tbl.Compact(false); err != nil || report.PrunedMarkers != 1 {
+		t.Errorf("Compact() with a view between the removals = %+v, %v; want 1 pruned marker", report, err)
+	}
+	if _, err := view.Get([]byte("a")); !errors.Is(err, ErrSnapshotExpired) {
+		t.Errorf("Get(a) of a closed view behind the pruned removal error = %v, want expired", err)
+	}
+	if _, err := later.Get([]byte("a")); !os.IsNotExist(err) {
+		t.Errorf("Get(a) of a view after the pruned removal error = %v, want not exist", err)
+	}
+	checkExpired(t, "Compact", later, "b")
+	later.Close()
+	if report, err := tbl.Compact(false); err != nil || report.PrunedMarkers != 1 {
+		t.Errorf("Compact() without open views = %+v, %v; want 1 pruned marker", report, err)
+	}
+	if got := markerDepths(tbl); len(got) != 0 {
+		t.Errorf("removal markers left at depths %v; want none", got)
+	}
+	if _, err := later.Scan(nil, nil, ScanOption{}); err != ErrSnapshotExpired {
+		t.Errorf("Scan() of a view behind the pruned removals error = %v, want ErrSnapshotExpired", err)
+	}
+	present, err := tbl.ReadView(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer present.Close()
+	if got, want := viewKeys(t, present), []string{"c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("IterKeys() of a view after pruning = %q, want %q", got, want)
+	}
+	if value, err := present.Get([]byte("c")); err != nil || string(value) != "c1" {
+		t.Errorf("Get(c) of a view after pruning = %q, %v; want c1", value, err)
+	}
+}
@@ -1,11 +1,17 @@
 package main
 
 import (
-	"encoding/base64"
+	"bytes"
+	"errors"
 	"flag"
 	"fmt"
+	"html"
+	"io"
 	"log"
 	"net/http"
+	"net/url"
+	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -15,61 +21,224 @@ import (
 var (
 	addr      = flag.String("addr", ":9001", "address of server")
 	tablePath = flag.String("table_path", "", "path to the backend table")
+	writable  = flag.Bool("writable", false, "accept PUT and DELETE requests to keys")
+	maxBody   = flag.Int64("max_body_size", 1<<20, "maximum size in bytes of the value in a PUT request")
 )
 
 var tbl *table.Table
 
-// encodeKey encodes key to base64 URL encoder to avoid illegal
-// characters in the filename.
-func encodeKey(key []byte) []byte {
-	size := base64.URLEncoding.EncodedLen(len(key))
-	encoded := make([]byte, size)
-	base64.URLEncoding.Encode(encoded, key)
-	return encoded
+// pageSize is the default number of keys on a page of the index.
+const pageSize = 100
+
+// listKeys lists a page of the keys starting with the prefix query
+// parameter, after the encoded key in the after parameter, with a
+// link to the next page.
+func listKeys(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	prefix := []byte(query.Get("prefix"))
+	limit := pageSize
+	if s := query.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	start := prefix
+	if after := query.Get("after"); after != "" {
+		key, err := tbl.KeyEncoding().DecodeKey(after)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if next := append(key, 0); bytes.Compare(next, start) > 0 {
+			start = next
+		}
+	}
+	// One more key tells if there is a next page.
+	items, err := tbl.Scan(start, table.PrefixEnd(prefix), table.ScanOption{Limit: limit + 1})
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	fmt.Fprint(w, "<ul>")
+	for i, item := range items {
+		if i == limit {
+			break
+		}
+		// Keys are linked by the names of their files, which
+		// may contain '%'.
+		encoded := url.PathEscape(tbl.KeyEncoding().EncodeKey(item.Key))
+		fmt.Fprintf(w, "<li><a href=\"/%s\">%s</a></li>", encoded, html.EscapeString(string(item.Key)))
+	}
+	fmt.Fprint(w, "</ul>")
+	if len(items) > limit {
+		next := url.Values{
+			"prefix": {string(prefix)},
+			"after":  {tbl.KeyEncoding().EncodeKey(items[limit-1].Key)},
+			"limit":  {strconv.Itoa(limit)},
+		}
+		fmt.Fprintf(w, "<a href=\"/?%s\">Next</a>", html.EscapeString(next.Encode()))
+	}
+}
+
+// requestKey returns the key in the path of the request, or nil for
+// the index.
+func requestKey(r *http.Request) ([]byte, error) {
+	if r.URL.Path == "/" {
+		return nil, nil
+	}
+	splitted := strings.Split(r.URL.Path, "/")
+	if len(splitted) != 2 || splitted[1] == "" {
+		return nil, fmt.Errorf("invalid path %q", r.URL.Path)
+	}
+	return tbl.KeyEncoding().DecodeKey(splitted[1])
+}
+
+// etag returns the entity tag of the version of a key.
+func etag(version table.Version) string {
+	return fmt.Sprintf("\"%d\"", version)
 }
 
-// decodeKey decodes base64 URL to the key.
-func decodeKey(encoded []byte) ([]byte, error) {
-	size := base64.URLEncoding.DecodedLen(len(encoded))
-	key := make([]byte, size)
-	n, err := base64.URLEncoding.Decode(key, encoded)
-	return key[0:n], err
+// parseETag returns the version of the strong entity tag.
+func parseETag(tag string) (table.Version, error) {
+	if len(tag) < 2 || tag[0] != '"' || tag[len(tag)-1] != '"' {
+		return 0, fmt.Errorf("invalid entity tag %s", tag)
+	}
+	version, err := strconv.ParseUint(tag[1:len(tag)-1], 10, 64)
+	return table.Version(version), err
+}
+
+// writeHandler puts the body of a PUT request to the key, or removes
+// the key for a DELETE request. The write is conditioned on the
+// version of the key in the If-Match header, or on the key not
+// existing if the If-None-Match header is "*", and fails with 412
+// Precondition Failed and the current version in the ETag header
+// otherwise.
+func writeHandler(w http.ResponseWriter, r *http.Request) {
+	if !*writable {
+		http.Error(w, "table is read-only", http.StatusMethodNotAllowed)
+		return
+	}
+	key, err := requestKey(r)
+	if err != nil || key == nil {
+		http.Error(w, "invalid key", http.StatusBadRequest)
+		return
+	}
+	conditional := true
+	var expected, written table.Version
+	switch ifMatch := r.Header.Get("If-Match"); {
+	case r.Header.Get("If-None-Match") == "*":
+		expected = 0
+	case ifMatch == "*":
+		if expected, err = tbl.Version(key); err == nil && expected == 0 {
+			err = &table.VersionMismatchError{Key: key}
+		}
+	case ifMatch != "":
+		if expected, err = parseETag(ifMatch); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		conditional = false
+	}
+	if err == nil {
+		switch {
+		case r.Method == "DELETE" && conditional:
+			err = tbl.RemoveIf(key, expected)
+		case r.Method == "DELETE":
+			err = tbl.Remove(key)
+		default:
+			var value []byte
+			if value, err = io.ReadAll(http.MaxBytesReader(w, r.Body, *maxBody)); err != nil {
+				status := http.StatusBadRequest
+				var tooLarge *http.MaxBytesError
+				if errors.As(err, &tooLarge) {
+					status = http.StatusRequestEntityTooLarge
+				}
+				http.Error(w, err.Error(), status)
+				return
+			}
+			if conditional {
+				written, err = tbl.PutIf(key, value, expected)
+			} else {
+				written, err = tbl.PutVersion(key, value)
+			}
+		}
+	}
+	var mismatch *table.VersionMismatchError
+	switch {
+	case errors.As(err, &mismatch):
+		if mismatch.Current != 0 {
+			w.Header().Set("ETag", etag(mismatch.Current))
+		}
+		http.Error(w, err.Error(), http.StatusPreconditionFailed)
+		return
+	case os.IsNotExist(err):
+		http.Error(w, "key not found", http.StatusNotFound)
+		return
+	case err != nil:
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if written != 0 {
+		w.Header().Set("ETag", etag(written))
+	}
+	w.WriteHeader(http.StatusNoContent)
 }
 
 // indexHandler is index page handler.
 func indexHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "PUT" || r.Method == "DELETE" {
+		writeHandler(w, r)
+		return
+	}
 	if r.Method != "GET" {
 		return
 	}
+	if key, err := requestKey(r); err == nil && key != nil {
+		if version, err := tbl.Version(key); err == nil && version != 0 {
+			w.Header().Set("ETag", etag(version))
+		}
+	}
 	w.Header().Set("Content-Type", "text/html")
 	fmt.Fprint(w, "<html><body>")
 	defer fmt.Fprint(w, "</body></html>")
 	if r.URL.Path == "/" {
-		fmt.Fprint(w, "<ul>")
-		for key := range tbl.Keys() {
-			encoded := encodeKey(key)
-			fmt.Fprintf(w, "<li><a href=\"/%s\">%s</a></li>", string(encoded), string(key))
-		}
-		fmt.Fprint(w, "</ul>")
+		listKeys(w, r)
 		return
 	}
-	splitted := strings.Split(r.URL.Path, "/")
-	if len(splitted) == 2 && splitted[1] != "" {
-		key, err := decodeKey([]byte(splitted[1]))
+	key, err := requestKey(r)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if at := r.URL.Query().Get("at"); at != "" {
+		t, err := time.Parse(time.RFC3339Nano, at)
 		if err != nil {
-			log.Println(err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		cs, cerr := tbl.GetSnapshots(key)
-		for s := range cs {
-			fmt.Fprintf(w, "<h2>%s</h2>", time.Unix(0, int64(s.Info.Timestamp)))
-			fmt.Fprintf(w, "<p>\n%s\n</p>", string(s.Value))
-		}
-		err = <-cerr
+		value, err := tbl.GetAt(key, t)
 		if err != nil {
 			log.Println(err)
 			return
 		}
+		fmt.Fprintf(w, "<h2>%s</h2>", html.EscapeString(t.String()))
+		fmt.Fprintf(w, "<p>\n%s\n</p>", html.EscapeString(string(value)))
+		return
+	}
+	cs, cerr := tbl.GetSnapshots(key)
+	for s := range cs {
+		fmt.Fprintf(w, "<h2>%s</h2>", time.Unix(0, int64(s.Info.Timestamp)))
+		fmt.Fprintf(w, "<p>\n%s\n</p>", html.EscapeString(string(s.Value)))
+	}
+	err = <-cerr
+	if err != nil {
+		log.Println(err)
+		return
 	}
 }
 
@@ -80,14 +249,17 @@ func faviconHandler(w http.ResponseWriter, r *http.Request) {
 func main() {
 	flag.Parse()
 	var err error
-	tbl, err = table.Create(table.TableOption{
+	tbl, err = table.Open(table.TableOption{
 		BaseDirectory: *tablePath,
 		KeepSnapshots: true,
+		AdoptManifest: true,
+		ReadOnly:      !*writable,
 	})
 	if err != nil {
 		log.Println(err)
 		return
 	}
+	defer tbl.Close()
 	http.HandleFunc("/", indexHandler)
 	http.HandleFunc("/favicon.ico", faviconHandler)
 	http.ListenAndServe(*addr, nil)